@@ -2,11 +2,15 @@ package main
 
 import (
     "github.com/animal-crossing-exchange/ace-server/schema"
+    "github.com/animal-crossing-exchange/ace-server/types"
 
     "context"
     "encoding/json"
     "fmt"
     "log"
+    "os"
+    "strconv"
+    "strings"
     "time"
 
     "net/http"
@@ -14,6 +18,8 @@ import (
     "go.mongodb.org/mongo-driver/mongo"
     "go.mongodb.org/mongo-driver/mongo/options"
     "github.com/graphql-go/graphql"
+    "github.com/graphql-go/graphql/language/ast"
+    "github.com/graphql-go/graphql/language/parser"
 )
 
 func main() {
@@ -34,16 +40,43 @@ func main() {
 
     rootQuery := graphql.ObjectConfig{ Name: "RootQuery", Fields: schema.GenerateQuerySchema(ctx, *client.Database("acex")) }
     rootMutation := graphql.ObjectConfig{ Name: "RootMutation", Fields: schema.GenerateMutationSchema(ctx, *client.Database("acex")) }
-    schemaConfig := graphql.SchemaConfig{ Query: graphql.NewObject(rootQuery), Mutation: graphql.NewObject(rootMutation) }
+    rootSubscription := graphql.ObjectConfig{ Name: "RootSubscription", Fields: schema.GenerateSubscriptionSchema(ctx, *client.Database("acex")) }
+    schemaConfig := graphql.SchemaConfig{
+        Query: graphql.NewObject(rootQuery),
+        Mutation: graphql.NewObject(rootMutation),
+        Subscription: graphql.NewObject(rootSubscription),
+        Extensions: []graphql.Extension{ types.WarningsExtension{} },
+    }
     schema, err := graphql.NewSchema(schemaConfig)
     if err != nil {
         log.Fatal(err)
     }
 
+    // ACE_DEV allows running without the secrets a real deployment needs
+    err = types.InitDodoCodeKey(os.Getenv("ACE_DODO_CODE_KEY"), os.Getenv("ACE_DEV") != "")
+    if err != nil {
+        log.Fatal(err)
+    }
+    durationFromEnv("ACE_DODO_CODE_EXPIRY", &types.DodoCodeExpiry)
+    durationFromEnv("ACE_TRANSACTION_REPORT_DEADLINE", &types.TransactionReportDeadline)
+    durationFromEnv("ACE_TRANSACTION_STALE_DEADLINE", &types.TransactionStaleDeadline)
+    durationFromEnv("ACE_TRANSACTION_SWEEP_INTERVAL", &types.TransactionSweepInterval)
+    if val := os.Getenv("ACE_STALE_TRANSACTIONS_DISPUTE"); val != "" {
+        types.StaleTransactionsDispute, err = strconv.ParseBool(val)
+        if err != nil {
+            log.Fatalf("ACE_STALE_TRANSACTIONS_DISPUTE: %s", err)
+        }
+    }
+    err = types.EnsureIndexes(ctx, *client.Database("acex"))
+    if err != nil {
+        log.Fatal(err)
+    }
+    types.StartJobs(ctx, *client.Database("acex"))
+
     http.HandleFunc("/graphql", func(w http.ResponseWriter, r *http.Request) {
         fmt.Println("hit")
         query := r.URL.Query().Get("query")
-        params := graphql.Params{ Schema: schema, RequestString: query }
+        params := graphql.Params{ Schema: schema, RequestString: query, Context: r.Context() }
         result := graphql.Do(params)
         if len(result.Errors) > 0 {
             for _, err := range result.Errors {
@@ -53,8 +86,96 @@ func main() {
         json.NewEncoder(w).Encode(result)
     })
 
+    // subscriptions are streamed as server-sent events, running the subscription query
+    // once for every new message and sending the results that aren't empty
+    http.HandleFunc("/graphql/subscriptions", func(w http.ResponseWriter, r *http.Request) {
+        flusher, ok := w.(http.Flusher)
+        if !ok {
+            http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+            return
+        }
+        query := r.URL.Query().Get("query")
+        // anything else would be run again for every message
+        doc, err := parser.Parse(parser.ParseParams{ Source: query })
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        for _, def := range doc.Definitions {
+            if op, ok := def.(*ast.OperationDefinition); ok && op.Operation != ast.OperationTypeSubscription {
+                http.Error(w, "Only subscriptions can be streamed", http.StatusBadRequest)
+                return
+            }
+        }
+        w.Header().Set("Content-Type", "text/event-stream")
+        w.Header().Set("Cache-Control", "no-cache")
+
+        messages, unsubscribe := types.SubscribeMessages()
+        defer unsubscribe()
+        for {
+            select {
+            case <-r.Context().Done():
+                return
+            case message := <-messages:
+                root := map[string]interface{}{ "message": message }
+                params := graphql.Params{ Schema: schema, RequestString: query, RootObject: root, Context: r.Context() }
+                result := graphql.Do(params)
+                empty := len(result.Errors) == 0
+                if data, ok := result.Data.(map[string]interface{}); ok {
+                    for _, val := range data {
+                        if val != nil {
+                            empty = false
+                        }
+                    }
+                }
+                if empty {
+                    continue
+                }
+                body, err := json.Marshal(result)
+                if err != nil {
+                    log.Print(err)
+                    return
+                }
+                fmt.Fprintf(w, "data: %s\n\n", body)
+                flusher.Flush()
+            }
+        }
+    })
+
+    // a user's upcoming confirmed trades as an iCalendar file, at /calendar/<token>.ics with
+    // the token from resetCalendarToken
+    http.HandleFunc("/calendar/", func(w http.ResponseWriter, r *http.Request) {
+        token := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/calendar/"), ".ics")
+        timeout, cancel := context.WithTimeout(r.Context(), time.Second)
+        defer cancel()
+        calendar, err := types.UpcomingTradesCalendar(timeout, *client.Database("acex"), token)
+        if err == mongo.ErrNoDocuments {
+            http.NotFound(w, r)
+            return
+        } else if err != nil {
+            log.Print(err)
+            http.Error(w, "Calendar could not be made", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+        fmt.Fprint(w, calendar)
+    })
+
     fmt.Println("API started")
     http.ListenAndServe(":8080", nil)
 
 }
 
+// durationFromEnv overrides a setting with the duration in an environment variable, e.g.
+// "90m", if it is set.
+func durationFromEnv(name string, setting *time.Duration) {
+    val := os.Getenv(name)
+    if val == "" {
+        return
+    }
+    d, err := time.ParseDuration(val)
+    if err != nil {
+        log.Fatalf("%s: %s", name, err)
+    }
+    *setting = d
+}
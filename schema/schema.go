@@ -21,13 +21,49 @@ func GenerateQuerySchema(ctx context.Context, db mongo.Database) graphql.Fields
     types.InitTransactionType(ctx, db)
     types.InitUserType(ctx, db)
     types.InitUserReportType(ctx, db)
+    types.InitTrendingItemType(ctx, db)
+    types.InitNotificationType(ctx, db)
+    types.InitAuctionType(ctx, db)
+    types.InitBuyOrderType(ctx, db)
+    types.InitPriceType(ctx, db)
+    types.InitLineItemType(ctx, db)
+    types.InitOfferType(ctx, db)
+    types.InitMessageType(ctx, db)
+    types.InitTradeSlotType(ctx, db)
+    types.InitDisputeType(ctx, db)
+    types.InitRatingType(ctx, db)
+    types.InitReviewType(ctx, db)
 
     GetItem := types.GetItem(ctx, *db.Collection("items"))
     GetItems := types.Items(ctx, *db.Collection("items"))
 
+    Listings := types.Listings(ctx, db)
+
+    PriceHistory := types.PriceHistory(ctx, db)
+    SuggestedPrice := types.SuggestedPrice(ctx, db)
+
+    TrendingItems := types.TrendingItems(ctx, db)
+    MarketDepth := types.MarketDepth(ctx, db)
+
+    FlaggedListings := types.FlaggedListings(ctx, db)
+    Disputes := types.Disputes(ctx, db)
+    Reports := types.Reports(ctx, db)
+
     return graphql.Fields {
         "item": &GetItem,
         "items": &GetItems,
+
+        "listings": &Listings,
+
+        "priceHistory": &PriceHistory,
+        "suggestedPrice": &SuggestedPrice,
+
+        "trendingItems": &TrendingItems,
+        "marketDepth": &MarketDepth,
+
+        "flaggedListings": &FlaggedListings,
+        "disputes": &Disputes,
+        "reports": &Reports,
     }
 }
 
@@ -40,13 +76,49 @@ func GenerateMutationSchema(ctx context.Context, db mongo.Database) graphql.Fiel
     SetUserAdmin := types.SetUserAdmin(ctx, *db.Collection("users"))
     UnbanUser := types.UnbanUser(ctx, *db.Collection("users"))
 
-    ReportUser := types.ReportUser(ctx, *db.Collection("reports"))
+    ReportUser := types.ReportUser(ctx, db)
+    ResolveReport := types.ResolveReport(ctx, db)
+    DismissReport := types.DismissReport(ctx, db)
 
     CreateInquiry := types.CreateInquiry(ctx, db)
     DeleteInquiry := types.DeleteInquiry(ctx, db)
+    DeclineInquiry := types.DeclineInquiry(ctx, db)
+    WithdrawInquiry := types.WithdrawInquiry(ctx, db)
+    MakeOffer := types.MakeOffer(ctx, db)
+    AcceptOffer := types.AcceptOffer(ctx, db)
 
     CreateListing := types.CreateListing(ctx, db)
     DeleteListing := types.DeleteListing(ctx, db)
+    RestoreListing := types.RestoreListing(ctx, db)
+    UpdateListing := types.UpdateListing(ctx, db)
+    RenewListing := types.RenewListing(ctx, db)
+
+    PlaceBid := types.PlaceBid(ctx, db)
+
+    ShareDodoCode := types.ShareDodoCode(ctx, db)
+    TransactionSecret := types.TransactionSecret(ctx, db)
+    SetTimeZone := types.SetTimeZone(ctx, db)
+    ResetCalendarToken := types.ResetCalendarToken(ctx, db)
+    ProposeTradeTime := types.ProposeTradeTime(ctx, db)
+    ConfirmTradeTime := types.ConfirmTradeTime(ctx, db)
+    ReportTransactionComplete := types.ReportTransactionComplete(ctx, db)
+    ReportTransactionFailed := types.ReportTransactionFailed(ctx, db)
+    OpenDispute := types.OpenDispute(ctx, db)
+    ResolveDispute := types.ResolveDispute(ctx, db)
+    RateTransaction := types.RateTransaction(ctx, db)
+    RecomputeReputation := types.RecomputeReputation(ctx, db)
+    ReplyToReview := types.ReplyToReview(ctx, db)
+    RemoveReview := types.RemoveReview(ctx, db)
+
+    CreateBuyOrder := types.CreateBuyOrder(ctx, db)
+    CancelBuyOrder := types.CancelBuyOrder(ctx, db)
+
+    MarkNotificationsRead := types.MarkNotificationsRead(ctx, db)
+
+    SendMessage := types.SendMessage(ctx, db)
+    MarkMessagesRead := types.MarkMessagesRead(ctx, db)
+
+    AggregateMarket := types.AggregateMarket(ctx, db)
 
     return graphql.Fields {
         "addUser": &AddUser,
@@ -56,12 +128,57 @@ func GenerateMutationSchema(ctx context.Context, db mongo.Database) graphql.Fiel
         "unbanUser": &UnbanUser,
 
         "reportUser": &ReportUser,
+        "resolveReport": &ResolveReport,
+        "dismissReport": &DismissReport,
 
         "createInquiry": &CreateInquiry,
         "deleteInquiry": &DeleteInquiry,
+        "declineInquiry": &DeclineInquiry,
+        "withdrawInquiry": &WithdrawInquiry,
+        "makeOffer": &MakeOffer,
+        "acceptOffer": &AcceptOffer,
 
         "createListing": &CreateListing,
         "deleteListing": &DeleteListing,
+        "restoreListing": &RestoreListing,
+        "updateListing": &UpdateListing,
+        "renewListing": &RenewListing,
+
+        "placeBid": &PlaceBid,
+
+        "shareDodoCode": &ShareDodoCode,
+        "transactionSecret": &TransactionSecret,
+        "setTimeZone": &SetTimeZone,
+        "resetCalendarToken": &ResetCalendarToken,
+        "proposeTradeTime": &ProposeTradeTime,
+        "confirmTradeTime": &ConfirmTradeTime,
+        "reportTransactionComplete": &ReportTransactionComplete,
+        "reportTransactionFailed": &ReportTransactionFailed,
+        "openDispute": &OpenDispute,
+        "resolveDispute": &ResolveDispute,
+        "rateTransaction": &RateTransaction,
+        "recomputeReputation": &RecomputeReputation,
+        "replyToReview": &ReplyToReview,
+        "removeReview": &RemoveReview,
+
+        "createBuyOrder": &CreateBuyOrder,
+        "cancelBuyOrder": &CancelBuyOrder,
+
+        "markNotificationsRead": &MarkNotificationsRead,
+
+        "sendMessage": &SendMessage,
+        "markMessagesRead": &MarkMessagesRead,
+
+        "aggregateMarket": &AggregateMarket,
     }
 }
 
+// GenerateSubscriptionSchema creates the Fields object containing subscriptions. This
+// function should be called after GenerateQuerySchema.
+func GenerateSubscriptionSchema(ctx context.Context, db mongo.Database) graphql.Fields {
+    MessageReceived := types.MessageReceived(ctx, db)
+
+    return graphql.Fields {
+        "messageReceived": &MessageReceived,
+    }
+}
@@ -2,6 +2,7 @@ package thelpers
 
 import (
     "github.com/animal-crossing-exchange/ace-server/schema"
+    "github.com/animal-crossing-exchange/ace-server/types"
 
     "context"
     "encoding/json"
@@ -36,15 +37,29 @@ func StartServer(dbName string, end chan bool) {
 
     rootQuery := graphql.ObjectConfig{ Name: "RootQuery", Fields: schema.GenerateQuerySchema(ctx, *client.Database(dbName)) }
     rootMutation := graphql.ObjectConfig{ Name: "RootMutation", Fields: schema.GenerateMutationSchema(ctx, *client.Database(dbName)) }
-    schemaConfig := graphql.SchemaConfig{ Query: graphql.NewObject(rootQuery), Mutation: graphql.NewObject(rootMutation) }
+    rootSubscription := graphql.ObjectConfig{ Name: "RootSubscription", Fields: schema.GenerateSubscriptionSchema(ctx, *client.Database(dbName)) }
+    schemaConfig := graphql.SchemaConfig{
+        Query: graphql.NewObject(rootQuery),
+        Mutation: graphql.NewObject(rootMutation),
+        Subscription: graphql.NewObject(rootSubscription),
+        Extensions: []graphql.Extension{ types.WarningsExtension{} },
+    }
     schema, err := graphql.NewSchema(schemaConfig)
     if err != nil {
         panic(err)
     }
+    err = types.InitDodoCodeKey("", true)
+    if err != nil {
+        panic(err)
+    }
+    err = types.EnsureIndexes(ctx, *client.Database(dbName))
+    if err != nil {
+        panic(err)
+    }
 
     http.HandleFunc("/test/graphql", func(w http.ResponseWriter, r *http.Request) {
         query := r.URL.Query().Get("query")
-        params := graphql.Params{ Schema: schema, RequestString: query }
+        params := graphql.Params{ Schema: schema, RequestString: query, Context: r.Context() }
         result := graphql.Do(params)
         /*
         if len(result.Errors) > 0 {
@@ -112,6 +127,38 @@ func ClearDB(ctx context.Context, db mongo.Database) {
     if err != nil {
         panic(err)
     }
+    _, err = db.Collection("notifications").DeleteMany(ctx, bson.M{}, nil)
+    if err != nil {
+        panic(err)
+    }
+    _, err = db.Collection("bids").DeleteMany(ctx, bson.M{}, nil)
+    if err != nil {
+        panic(err)
+    }
+    _, err = db.Collection("buyorders").DeleteMany(ctx, bson.M{}, nil)
+    if err != nil {
+        panic(err)
+    }
+    _, err = db.Collection("messages").DeleteMany(ctx, bson.M{}, nil)
+    if err != nil {
+        panic(err)
+    }
+    _, err = db.Collection("auditlog").DeleteMany(ctx, bson.M{}, nil)
+    if err != nil {
+        panic(err)
+    }
+    _, err = db.Collection("disputes").DeleteMany(ctx, bson.M{}, nil)
+    if err != nil {
+        panic(err)
+    }
+    _, err = db.Collection("ratings").DeleteMany(ctx, bson.M{}, nil)
+    if err != nil {
+        panic(err)
+    }
+    _, err = db.Collection("reviews").DeleteMany(ctx, bson.M{}, nil)
+    if err != nil {
+        panic(err)
+    }
 }
 
 func ExecQuery(query string) map[string]interface{} {
@@ -0,0 +1,109 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/types"
+
+    "context"
+    "fmt"
+    "testing"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestAggregateMarketRecords(t *testing.T) {
+    ctx := context.Background()
+    day := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+    at := func(d time.Duration) primitive.ObjectID {
+        return primitive.NewObjectIDFromTimestamp(day.Add(d))
+    }
+    sellerObjID, _ := primitive.ObjectIDFromHex(insertUser(t, bson.M{"discordID": 6161}))
+    soldObjID, _ := primitive.ObjectIDFromHex(insertItem(t, bson.M{"name": "cherry-blossom clock"}))
+    unsoldObjID, _ := primitive.ObjectIDFromHex(insertItem(t, bson.M{"name": "cherry-blossom pond stone"}))
+
+    // insertListing adds a listing of an item made at the given time of the day
+    insertListing := func(objID primitive.ObjectID, itemObjID primitive.ObjectID, price int) primitive.ObjectID {
+        listingID := insertDoc(t, "listings", bson.M{
+            "_id": objID,
+            "price": price,
+            "variation": nil,
+            "deleted": false,
+            "accepted": nil,
+            "seller": sellerObjID,
+            "buyer": nil,
+            "item": itemObjID,
+            "inquiries": bson.A{},
+        }, nil)
+        listingObjID, _ := primitive.ObjectIDFromHex(listingID)
+        return listingObjID
+    }
+    listingObjID := insertListing(at(time.Hour), soldObjID, 1000)
+    unsoldListingObjID := insertListing(at(2 * time.Hour), unsoldObjID, 500)
+
+    // insertTransaction adds a completed transaction for the listing
+    insertTransaction := func(objID primitive.ObjectID, price int, settled interface{}) {
+        insertDoc(t, "transactions", bson.M{
+            "_id": objID,
+            "state": types.TransactionStateCompleted,
+            "price": price,
+            "listing": listingObjID,
+            "buyer": primitive.NewObjectID(),
+            "seller": sellerObjID,
+            "settled": settled,
+        }, nil)
+    }
+    // started the day before but settled on the day, so it counts
+    insertTransaction(at(-20 * time.Hour), 2000, primitive.NewDateTimeFromTime(day.Add(3 * time.Hour)))
+    // started on the day but settled the day after, so it doesn't
+    insertTransaction(at(4 * time.Hour), 9000, primitive.NewDateTimeFromTime(day.Add(30 * time.Hour)))
+    // from before settled was recorded, so it counts on the day it started
+    insertTransaction(at(5 * time.Hour), 3000, nil)
+
+    countRecords := func(itemObjID primitive.ObjectID) int64 {
+        count, err := db.Collection("records").CountDocuments(ctx, bson.M{"item": itemObjID, "date": "2020-05-01"})
+        if err != nil {
+            t.Fatal(err)
+        }
+        return count
+    }
+
+    for run := 1; run <= 2; run++ {
+        if _, err := types.AggregateMarketRecords(ctx, db, day); err != nil {
+            t.Fatalf("AggregateMarketRecords: run %d: %s", run, err)
+        }
+        if count := countRecords(soldObjID); count != 1 {
+            t.Fatalf("AggregateMarketRecords: run %d: expected 1 record, got %d", run, count)
+        }
+        var record bson.M
+        err := db.Collection("records").FindOne(ctx, bson.M{"item": soldObjID, "date": "2020-05-01"}).Decode(&record)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if fmt.Sprint(record["avg"]) != "2000" || fmt.Sprint(record["high"]) != "3000" || fmt.Sprint(record["numListings"]) != "1" {
+            t.Errorf("AggregateMarketRecords: run %d: Wrong record, expected avg 2000, high 3000 and 1 listing, got %v", run, record)
+        }
+    }
+
+    // the only activity of the unsold item goes away, so its record has to as well
+    if countRecords(unsoldObjID) != 1 {
+        t.Fatal("AggregateMarketRecords: no record for the unsold item")
+    }
+    _, err := db.Collection("listings").UpdateOne(ctx, bson.M{"_id": unsoldListingObjID}, bson.M{"$set": bson.M{"deleted": true}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err = types.AggregateMarketRecords(ctx, db, day); err != nil {
+        t.Fatalf("AggregateMarketRecords: %s", err)
+    }
+    if count := countRecords(unsoldObjID); count != 0 {
+        t.Errorf("AggregateMarketRecords: stale record not removed, got %d", count)
+    }
+    var item bson.M
+    if err = db.Collection("items").FindOne(ctx, bson.M{"_id": unsoldObjID}).Decode(&item); err != nil {
+        t.Fatal(err)
+    }
+    if len(item["records"].(bson.A)) != 0 || item["currentMedian"] != nil {
+        t.Errorf("AggregateMarketRecords: stale record left on its item, got %v", item)
+    }
+}
@@ -0,0 +1,93 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/thelpers"
+    "github.com/animal-crossing-exchange/ace-server/types"
+
+    "context"
+    "fmt"
+    "testing"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPriceFixingFlags(t *testing.T) {
+    ctx := context.Background()
+    itemID := insertItem(t, bson.M{"name": "frozen tree"})
+    itemObjID, _ := primitive.ObjectIDFromHex(itemID)
+    for i := 0; i < types.AnomalyMinSamples; i++ {
+        insertDoc(t, "records", bson.M{
+            "item": itemObjID,
+            "variation": nil,
+            "date": time.Now().AddDate(0, 0, -i).UTC().Format("2006-01-02"),
+            "median": 1000,
+        }, nil)
+    }
+
+    createListing := func(discordID int) (string, string) {
+        userID := insertUser(t, bson.M{"discordID": discordID})
+        query := fmt.Sprintf(`
+        mutation {
+            createListing(itemID: "%s", userID: "%s", price: 2000) {
+                id
+            }
+        }`, itemID, userID)
+        result := thelpers.ExecQuery(query)
+        if _, prs := result["errors"]; prs {
+            t.Fatalf("CreateListing: listing rejected: %v", result["errors"])
+        }
+        return result["data"].(map[string]interface{})["createListing"].(map[string]interface{})["id"].(string), userID
+    }
+    priceFixing := func(listingID string) bool {
+        listingObjID, _ := primitive.ObjectIDFromHex(listingID)
+        var listing bson.M
+        if err := db.Collection("listings").FindOne(ctx, bson.M{"_id": listingObjID}).Decode(&listing); err != nil {
+            t.Fatal(err)
+        }
+        flags, _ := listing["flags"].(bson.A)
+        for _, flag := range flags {
+            if flag.(bson.M)["kind"] == types.ListingFlagPriceFixing {
+                return true
+            }
+        }
+        return false
+    }
+
+    // an expired listing at the same price isn't part of the cluster
+    expiredID, _ := createListing(5151)
+    expiredObjID, _ := primitive.ObjectIDFromHex(expiredID)
+    _, err := db.Collection("listings").UpdateOne(ctx, bson.M{"_id": expiredObjID}, bson.M{"$set": bson.M{"expired": true}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    first, _ := createListing(5252)
+    second, _ := createListing(5353)
+    if priceFixing(first) || priceFixing(second) {
+        t.Fatal("CreateListing: cluster with an expired listing flagged for price fixing")
+    }
+
+    third, thirdSellerID := createListing(5454)
+    for _, listingID := range []string{first, second, third} {
+        if !priceFixing(listingID) {
+            t.Errorf("CreateListing: listing %s of the cluster not flagged for price fixing", listingID)
+        }
+    }
+
+    // once the third listing comes down in price, what's left is too small to be a cluster
+    query := fmt.Sprintf(`
+    mutation {
+        updateListing(listingID: "%s", userID: "%s", price: 1000) {
+            id
+        }
+    }`, third, thirdSellerID)
+    if result := thelpers.ExecQuery(query); result["errors"] != nil {
+        t.Fatalf("UpdateListing: update rejected: %v", result["errors"])
+    }
+    for _, listingID := range []string{first, second, third} {
+        if priceFixing(listingID) {
+            t.Errorf("UpdateListing: listing %s still flagged for price fixing after the cluster broke up", listingID)
+        }
+    }
+}
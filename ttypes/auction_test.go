@@ -0,0 +1,142 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/thelpers"
+    "github.com/animal-crossing-exchange/ace-server/types"
+
+    "context"
+    "fmt"
+    "testing"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCloseAuctions(t *testing.T) {
+    ctx := context.Background()
+    sellerID := insertUser(t, bson.M{"discordID": 7171})
+    winnerID := insertUser(t, bson.M{"discordID": 7272})
+    sellerObjID, _ := primitive.ObjectIDFromHex(sellerID)
+    winnerObjID, _ := primitive.ObjectIDFromHex(winnerID)
+    itemObjID, _ := primitive.ObjectIDFromHex(insertItem(t, bson.M{"name": "golden toilet"}))
+
+    // insertAuction adds an auction that ended an hour ago with the given high bid
+    insertAuction := func(highBid int, highBidder primitive.ObjectID, reservePrice int) primitive.ObjectID {
+        listingID := insertDoc(t, "listings", bson.M{
+            "mode": types.ListingModeAuction,
+            "price": nil,
+            "variation": nil,
+            "deleted": false,
+            "accepted": nil,
+            "seller": sellerObjID,
+            "buyer": nil,
+            "item": itemObjID,
+            "inquiries": bson.A{},
+            "bids": bson.A{},
+        }, bson.M{"auction": bson.M{
+            "startPrice": 100,
+            "reservePrice": reservePrice,
+            "minIncrement": 10,
+            "endsAt": primitive.NewDateTimeFromTime(time.Now().Add(-time.Hour)),
+            "closed": false,
+            "highBid": highBid,
+            "highBidder": highBidder,
+        }})
+        listingObjID, _ := primitive.ObjectIDFromHex(listingID)
+        return listingObjID
+    }
+    // a winner that doesn't exist makes creating the transaction fail
+    failed := insertAuction(5000, primitive.NewObjectID(), 1000)
+    sold := insertAuction(5000, winnerObjID, 1000)
+    belowReserve := insertAuction(500, winnerObjID, 1000)
+
+    if err := types.RunJob(ctx, db, "auction closer"); err != nil {
+        t.Fatalf("closeAuctions: %s", err)
+    }
+
+    getListing := func(listingObjID primitive.ObjectID) bson.M {
+        var listing bson.M
+        if err := db.Collection("listings").FindOne(ctx, bson.M{"_id": listingObjID}).Decode(&listing); err != nil {
+            t.Fatal(err)
+        }
+        return listing
+    }
+
+    listing := getListing(sold)
+    if listing["auction"].(bson.M)["closed"] != true || listing["buyer"] != winnerObjID || listing["accepted"] == nil {
+        t.Errorf("closeAuctions: auction not sold to the high bidder, got %v", listing)
+    }
+    count, err := db.Collection("transactions").CountDocuments(ctx, bson.M{"listing": sold, "buyer": winnerObjID, "price": 5000})
+    if err != nil || count != 1 {
+        t.Errorf("closeAuctions: expected 1 transaction for the sold auction, got %d (%v)", count, err)
+    }
+
+    listing = getListing(belowReserve)
+    if listing["auction"].(bson.M)["closed"] != true || listing["buyer"] != nil || listing["accepted"] != nil {
+        t.Errorf("closeAuctions: auction below the reserve not closed unsold, got %v", listing)
+    }
+    count, err = db.Collection("notifications").CountDocuments(ctx, bson.M{"user": sellerObjID, "listing": belowReserve, "kind": types.NotificationAuctionEnded})
+    if err != nil || count != 1 {
+        t.Errorf("closeAuctions: seller of the auction below the reserve not notified, got %d (%v)", count, err)
+    }
+
+    listing = getListing(failed)
+    if listing["auction"].(bson.M)["closed"] != false || listing["buyer"] != nil || listing["accepted"] != nil {
+        t.Errorf("closeAuctions: auction that failed to close not reopened, got %v", listing)
+    }
+    count, err = db.Collection("transactions").CountDocuments(ctx, bson.M{"listing": failed})
+    if err != nil || count != 0 {
+        t.Errorf("closeAuctions: transaction left behind for the auction that failed to close, got %d (%v)", count, err)
+    }
+}
+
+func TestAuctionReserve(t *testing.T) {
+    itemID := insertItem(t, bson.M{"name": "royal crown"})
+    sellerID := insertUser(t, bson.M{"discordID": 7373})
+    bidderID := insertUser(t, bson.M{"discordID": 7474})
+
+    query := fmt.Sprintf(`
+    mutation {
+        createListing(itemID: "%s", userID: "%s", mode: AUCTION, startPrice: 1000, reservePrice: 5000, endsAt: "%s") {
+            id
+            auction {
+                reservePrice(viewerID: "%s")
+                reserveMet
+            }
+        }
+    }`, itemID, sellerID, time.Now().Add(time.Hour).Format(time.RFC3339), sellerID)
+    result := thelpers.ExecQuery(query)
+    if _, prs := result["errors"]; prs {
+        t.Fatalf("CreateListing: auction rejected: %v", result["errors"])
+    }
+    listing := result["data"].(map[string]interface{})["createListing"].(map[string]interface{})
+    auction := listing["auction"].(map[string]interface{})
+    if auction["reservePrice"] != 5000.0 || auction["reserveMet"] != false {
+        t.Errorf("Auction: expected the seller to see a reserve of 5000 that isn't met, got %v", auction)
+    }
+
+    placeBid := func(amount int, fields string) map[string]interface{} {
+        query := fmt.Sprintf(`
+        mutation {
+            placeBid(listingID: "%s", userID: "%s", amount: %d) {
+                auction {
+                    %s
+                }
+            }
+        }`, listing["id"], bidderID, amount, fields)
+        return thelpers.ExecQuery(query)
+    }
+    result = placeBid(2000, fmt.Sprintf(`reservePrice(viewerID: "%s")`, bidderID))
+    if _, prs := result["errors"]; !prs {
+        t.Error("Auction: reserve price shown to a bidder")
+    }
+    result = placeBid(6000, "reserveMet")
+    if _, prs := result["errors"]; prs {
+        t.Fatalf("PlaceBid: bid rejected: %v", result["errors"])
+    }
+    auction = result["data"].(map[string]interface{})["placeBid"].(map[string]interface{})["auction"].(map[string]interface{})
+    if auction["reserveMet"] != true {
+        t.Errorf("Auction: reserve not met by a bid above it, got %v", auction)
+    }
+}
@@ -0,0 +1,70 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/thelpers"
+
+    "fmt"
+    "testing"
+
+    "go.mongodb.org/mongo-driver/bson"
+)
+
+func TestCreateBuyOrderMatching(t *testing.T) {
+    itemID := insertItem(t, bson.M{"name": "wobbelina", "inGamePrice": 1500})
+    sellerID := insertUser(t, bson.M{"discordID": 8181})
+    buyerID := insertUser(t, bson.M{"discordID": 8282})
+
+    query := fmt.Sprintf(`
+    mutation {
+        createListing(itemID: "%s", userID: "%s", price: 2000) {
+            id
+        }
+    }`, itemID, sellerID)
+    result := thelpers.ExecQuery(query)
+    listingID := result["data"].(map[string]interface{})["createListing"].(map[string]interface{})["id"].(string)
+
+    createBuyOrder := func(maxPrice int) map[string]interface{} {
+        query := fmt.Sprintf(`
+        mutation {
+            createBuyOrder(itemID: "%s", userID: "%s", maxPrice: %d) {
+                status
+                matchedListing {
+                    id
+                }
+                inquiry {
+                    id
+                }
+                buyer {
+                    buyOrders {
+                        status
+                    }
+                }
+            }
+        }`, itemID, buyerID, maxPrice)
+        result := thelpers.ExecQuery(query)
+        if _, prs := result["errors"]; prs {
+            t.Fatalf("CreateBuyOrder: buy order rejected: %v", result["errors"])
+        }
+        return result["data"].(map[string]interface{})["createBuyOrder"].(map[string]interface{})
+    }
+
+    data := createBuyOrder(1000)
+    if data["status"] != "OPEN" || data["matchedListing"] != nil || data["inquiry"] != nil {
+        t.Errorf("CreateBuyOrder: order below the ask matched, got %v", data)
+    }
+
+    data = createBuyOrder(2500)
+    if data["status"] != "MATCHED" {
+        t.Fatalf("CreateBuyOrder: Wrong status, expected MATCHED, got %v", data["status"])
+    }
+    if matched, _ := data["matchedListing"].(map[string]interface{}); matched == nil || matched["id"] != listingID {
+        t.Errorf("CreateBuyOrder: Wrong matched listing, expected %s, got %v", listingID, data["matchedListing"])
+    }
+    if data["inquiry"] == nil {
+        t.Error("CreateBuyOrder: no inquiry made for the matched listing")
+    }
+    buyer := data["buyer"].(map[string]interface{})
+    if len(buyer["buyOrders"].([]interface{})) != 2 {
+        t.Errorf("CreateBuyOrder: Wrong number of buy orders of the buyer, expected 2, got %v", buyer["buyOrders"])
+    }
+}
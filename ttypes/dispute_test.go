@@ -0,0 +1,99 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/thelpers"
+    "github.com/animal-crossing-exchange/ace-server/types"
+
+    "context"
+    "fmt"
+    "testing"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestResolveDispute(t *testing.T) {
+    ctx := context.Background()
+    adminID := insertUser(t, bson.M{"discordID": 11101, "admin": true})
+    buyerObjID, _ := primitive.ObjectIDFromHex(insertUser(t, bson.M{"discordID": 11202}))
+    sellerID := insertUser(t, bson.M{"discordID": 11303})
+    sellerObjID, _ := primitive.ObjectIDFromHex(sellerID)
+
+    // insertDispute adds an open dispute on a disputed transaction with the given seller
+    insertDispute := func(sellerObjID primitive.ObjectID) string {
+        transactionObjID, _ := primitive.ObjectIDFromHex(insertDoc(t, "transactions", bson.M{
+            "state": types.TransactionStateDisputed,
+            "price": 1000,
+            "settled": nil,
+            "listing": primitive.NewObjectID(),
+            "buyer": buyerObjID,
+            "seller": sellerObjID,
+        }, nil))
+        return insertDoc(t, "disputes", bson.M{
+            "transaction": transactionObjID,
+            "openedBy": buyerObjID,
+            "reason": "never came",
+            "status": types.DisputeStatusOpen,
+            "outcome": nil,
+            "adminNote": nil,
+            "resolvedBy": nil,
+            "resolved": nil,
+            "bannedLoser": false,
+            "loser": nil,
+        }, nil)
+    }
+    resolve := func(disputeID string) map[string]interface{} {
+        query := fmt.Sprintf(`
+        mutation {
+            resolveDispute(disputeID: "%s", adminID: "%s", outcome: FAVOR_BUYER, note: "scammer", banLoser: true) {
+                status
+                loser {
+                    id
+                }
+            }
+        }`, disputeID, adminID)
+        return thelpers.ExecQuery(query)
+    }
+    dispute := func(disputeID string) bson.M {
+        disputeObjID, _ := primitive.ObjectIDFromHex(disputeID)
+        var dispute bson.M
+        if err := db.Collection("disputes").FindOne(ctx, bson.M{"_id": disputeObjID}).Decode(&dispute); err != nil {
+            t.Fatal(err)
+        }
+        return dispute
+    }
+
+    // a loser that can't be banned leaves the dispute open
+    goneID := insertDispute(primitive.NewObjectID())
+    if _, prs := resolve(goneID)["errors"]; !prs {
+        t.Error("ResolveDispute: dispute resolved without banning the loser")
+    }
+    if d := dispute(goneID); d["status"] != types.DisputeStatusOpen {
+        t.Errorf("ResolveDispute: dispute no longer open after the ban failed, got %v", d)
+    }
+
+    disputeID := insertDispute(sellerObjID)
+    result := resolve(disputeID)
+    if _, prs := result["errors"]; prs {
+        t.Fatalf("ResolveDispute: resolution rejected: %v", result["errors"])
+    }
+    data := result["data"].(map[string]interface{})["resolveDispute"].(map[string]interface{})
+    loser, _ := data["loser"].(map[string]interface{})
+    if data["status"] != types.DisputeStatusResolved || loser == nil || loser["id"] != sellerID {
+        t.Errorf("ResolveDispute: expected a resolved dispute lost by %s, got %v", sellerID, data)
+    }
+    if d := dispute(disputeID); d["loser"] != sellerObjID {
+        t.Errorf("ResolveDispute: loser not recorded, got %v", d)
+    }
+    var seller bson.M
+    if err := db.Collection("users").FindOne(ctx, bson.M{"_id": sellerObjID}).Decode(&seller); err != nil {
+        t.Fatal(err)
+    }
+    if seller["banned"] == nil {
+        t.Errorf("ResolveDispute: loser not banned, got %v", seller)
+    }
+
+    if _, prs := resolve(disputeID)["errors"]; !prs {
+        t.Error("ResolveDispute: dispute resolved twice")
+    }
+}
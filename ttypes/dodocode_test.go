@@ -0,0 +1,106 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/thelpers"
+    "github.com/animal-crossing-exchange/ace-server/types"
+
+    "context"
+    "fmt"
+    "testing"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDodoCode(t *testing.T) {
+    ctx := context.Background()
+    buyerID := insertUser(t, bson.M{"discordID": 1212})
+    sellerID := insertUser(t, bson.M{"discordID": 1313})
+    buyerObjID, _ := primitive.ObjectIDFromHex(buyerID)
+    sellerObjID, _ := primitive.ObjectIDFromHex(sellerID)
+
+    // insertTransaction adds an in-progress transaction between the buyer and seller
+    insertTransaction := func() string {
+        return insertDoc(t, "transactions", bson.M{
+            "state": types.TransactionStateInProgress,
+            "price": 1000,
+            "listing": primitive.NewObjectID(),
+            "buyer": buyerObjID,
+            "seller": sellerObjID,
+            "dodoCode": nil,
+        }, nil)
+    }
+    getSecret := func(transactionID string, userID string) map[string]interface{} {
+        query := fmt.Sprintf(`
+        mutation {
+            transactionSecret(transactionID: "%s", userID: "%s")
+        }`, transactionID, userID)
+        return thelpers.ExecQuery(query)
+    }
+    secretOf := func(transactionID string) string {
+        result := getSecret(transactionID, buyerID)
+        if _, prs := result["errors"]; prs {
+            t.Fatalf("TransactionSecret: buyer could not get the secret: %v", result["errors"])
+        }
+        return result["data"].(map[string]interface{})["transactionSecret"].(string)
+    }
+    // readDodoCode reads the Dodo code of a transaction as the buyer, through a message
+    readDodoCode := func(transactionID string, secret string) map[string]interface{} {
+        query := fmt.Sprintf(`
+        mutation {
+            sendMessage(userID: "%s", transactionID: "%s", body: "flying over") {
+                transaction {
+                    dodoCode(viewerID: "%s", secret: "%s")
+                }
+            }
+        }`, buyerID, transactionID, buyerID, secret)
+        return thelpers.ExecQuery(query)
+    }
+
+    transactionID := insertTransaction()
+    query := fmt.Sprintf(`
+    mutation {
+        shareDodoCode(transactionID: "%s", userID: "%s", code: "ab12c") {
+            id
+        }
+    }`, transactionID, sellerID)
+    if result := thelpers.ExecQuery(query); result["errors"] != nil {
+        t.Fatalf("ShareDodoCode: code rejected: %v", result["errors"])
+    }
+
+    if _, prs := getSecret(transactionID, insertUser(t, bson.M{"discordID": 1414}))["errors"]; !prs {
+        t.Error("TransactionSecret: secret given to someone outside of the transaction")
+    }
+    secret := secretOf(transactionID)
+    if secretOf(transactionID) != secret {
+        t.Error("TransactionSecret: secret changed when asked for again")
+    }
+
+    if _, prs := readDodoCode(transactionID, "not the secret")["errors"]; !prs {
+        t.Error("Transaction: Dodo code revealed without the secret")
+    }
+    result := readDodoCode(transactionID, secret)
+    if _, prs := result["errors"]; prs {
+        t.Fatalf("Transaction: Dodo code could not be read: %v", result["errors"])
+    }
+    transaction := result["data"].(map[string]interface{})["sendMessage"].(map[string]interface{})["transaction"].(map[string]interface{})
+    if transaction["dodoCode"] != "AB12C" {
+        t.Errorf("Transaction: Wrong Dodo code, expected AB12C, got %v", transaction["dodoCode"])
+    }
+
+    // the sealed code is bound to its transaction, so it can't be moved onto another
+    transactionObjID, _ := primitive.ObjectIDFromHex(transactionID)
+    var sealed bson.M
+    if err := db.Collection("transactions").FindOne(ctx, bson.M{"_id": transactionObjID}).Decode(&sealed); err != nil {
+        t.Fatal(err)
+    }
+    otherID := insertTransaction()
+    otherObjID, _ := primitive.ObjectIDFromHex(otherID)
+    _, err := db.Collection("transactions").UpdateOne(ctx, bson.M{"_id": otherObjID}, bson.M{"$set": bson.M{"dodoCode": sealed["dodoCode"]}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, prs := readDodoCode(otherID, secretOf(otherID))["errors"]; !prs {
+        t.Error("Transaction: Dodo code moved from another transaction was decrypted")
+    }
+}
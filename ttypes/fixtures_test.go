@@ -0,0 +1,48 @@
+package ttypes
+
+import (
+    "context"
+    "testing"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// insertDoc adds a document straight to a collection for a test, starting from defaults
+// that fields adds to or overrides, and returns its ID.
+func insertDoc(t *testing.T, collection string, defaults bson.M, fields bson.M) string {
+    doc := bson.M{}
+    for key, val := range defaults {
+        doc[key] = val
+    }
+    for key, val := range fields {
+        doc[key] = val
+    }
+    res, err := db.Collection(collection).InsertOne(context.Background(), doc)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return res.InsertedID.(primitive.ObjectID).Hex()
+}
+
+// insertItem adds an item with no records or listings for a test, returning its ID.
+func insertItem(t *testing.T, fields bson.M) string {
+    return insertDoc(t, "items", bson.M{
+        "variations": bson.A{},
+        "category": "Furniture",
+        "records": bson.A{},
+        "listings": bson.A{},
+    }, fields)
+}
+
+// insertUser adds a user with nothing to their name for a test, returning its ID.
+func insertUser(t *testing.T, fields bson.M) string {
+    return insertDoc(t, "users", bson.M{
+        "reputation": 0,
+        "admin": false,
+        "banned": nil,
+        "listings": bson.A{},
+        "inquiries": bson.A{},
+        "transactions": bson.A{},
+    }, fields)
+}
@@ -0,0 +1,67 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/thelpers"
+
+    "fmt"
+    "testing"
+
+    "go.mongodb.org/mongo-driver/bson"
+)
+
+func TestCreateInquiryOnePerListing(t *testing.T) {
+    itemID := insertItem(t, bson.M{"name": "froggy chair", "inGamePrice": 1440})
+    sellerID := insertUser(t, bson.M{"discordID": 5151})
+    buyerID := insertUser(t, bson.M{"discordID": 5252})
+
+    listingIDs := make([]string, 2)
+    for i := range listingIDs {
+        query := fmt.Sprintf(`
+        mutation {
+            createListing(itemID: "%s", userID: "%s", price: 2000) {
+                id
+            }
+        }`, itemID, sellerID)
+        result := thelpers.ExecQuery(query)
+        listingIDs[i] = result["data"].(map[string]interface{})["createListing"].(map[string]interface{})["id"].(string)
+    }
+
+    createInquiry := func(listingID string) map[string]interface{} {
+        query := fmt.Sprintf(`
+        mutation {
+            createInquiry(listingID: "%s", userID: "%s") {
+                id
+            }
+        }`, listingID, buyerID)
+        return thelpers.ExecQuery(query)
+    }
+
+    result := createInquiry(listingIDs[0])
+    if _, prs := result["errors"]; prs {
+        t.Fatalf("CreateInquiry: first inquiry rejected: %v", result["errors"])
+    }
+    inquiryID := result["data"].(map[string]interface{})["createInquiry"].(map[string]interface{})["id"].(string)
+
+    if _, prs := createInquiry(listingIDs[1])["errors"]; prs {
+        t.Error("CreateInquiry: inquiry on another listing rejected")
+    }
+    if _, prs := createInquiry(listingIDs[0])["errors"]; !prs {
+        t.Error("CreateInquiry: second open inquiry on the same listing allowed")
+    }
+
+    query := fmt.Sprintf(`
+    mutation {
+        withdrawInquiry(inquiryID: "%s", userID: "%s") {
+            open
+        }
+    }`, inquiryID, buyerID)
+    result = thelpers.ExecQuery(query)
+    data := result["data"].(map[string]interface{})["withdrawInquiry"].(map[string]interface{})
+    if data["open"] != false {
+        t.Error("WithdrawInquiry: inquiry still open")
+    }
+
+    if _, prs := createInquiry(listingIDs[0])["errors"]; prs {
+        t.Error("CreateInquiry: inquiry after withdrawal rejected")
+    }
+}
@@ -0,0 +1,156 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/thelpers"
+
+    "fmt"
+    "testing"
+
+    "go.mongodb.org/mongo-driver/bson"
+)
+
+func TestCreateListingVariation(t *testing.T) {
+    itemID := insertItem(t, bson.M{
+        "name": "piano",
+        "variations": bson.A{"Black", "White"},
+        "inGamePrice": 65000,
+    })
+    userID := insertUser(t, bson.M{"discordID": 4242})
+
+    query := fmt.Sprintf(`
+    mutation {
+        createListing(itemID: "%s", userID: "%s", price: 100000) {
+            id
+        }
+    }`, itemID, userID)
+    result := thelpers.ExecQuery(query)
+    if _, prs := result["errors"]; !prs {
+        t.Error("CreateListing: listing created without a variation")
+    }
+
+    query = fmt.Sprintf(`
+    mutation {
+        createListing(itemID: "%s", userID: "%s", price: 100000, variation: "Purple") {
+            id
+        }
+    }`, itemID, userID)
+    result = thelpers.ExecQuery(query)
+    if _, prs := result["errors"]; !prs {
+        t.Error("CreateListing: listing created with an invalid variation")
+    }
+
+    query = fmt.Sprintf(`
+    mutation {
+        createListing(itemID: "%s", userID: "%s", price: 100000, variation: "Black") {
+            variation
+        }
+    }`, itemID, userID)
+    result = thelpers.ExecQuery(query)
+    data := result["data"].(map[string]interface{})["createListing"].(map[string]interface{})
+    if data["variation"] != "Black" {
+        t.Errorf("CreateListing: Wrong variation, expected %s, got %v", "Black", data["variation"])
+    }
+
+    query = fmt.Sprintf(`
+    {
+        item(id: "%s") {
+            listings(variation: "White") {
+                id
+            }
+        }
+    }`, itemID)
+    result = thelpers.ExecQuery(query)
+    data = result["data"].(map[string]interface{})["item"].(map[string]interface{})
+    if len(data["listings"].([]interface{})) != 0 {
+        t.Error("Item: listings not filtered by variation")
+    }
+}
+
+func TestCreateListingBundle(t *testing.T) {
+    itemIDs := make([]string, 2)
+    for i, name := range []string{"star fragment", "large star fragment"} {
+        itemIDs[i] = insertItem(t, bson.M{
+            "name": name,
+            "category": "Materials",
+            "inGamePrice": 100 * (i + 1),
+        })
+    }
+    userID := insertUser(t, bson.M{"discordID": 4343})
+
+    query := fmt.Sprintf(`
+    mutation {
+        createListing(userID: "%s", price: 5000, lineItems: [{itemID: "%s", quantity: 10}, {itemID: "%s", quantity: 2}]) {
+            id
+            bundle
+            lineItems {
+                quantity
+                remaining
+            }
+        }
+    }`, userID, itemIDs[0], itemIDs[1])
+    result := thelpers.ExecQuery(query)
+    data := result["data"].(map[string]interface{})["createListing"].(map[string]interface{})
+    if data["bundle"] != true {
+        t.Error("CreateListing: listing with several line items not marked as a bundle")
+    }
+    lineItems := data["lineItems"].([]interface{})
+    if len(lineItems) != 2 || lineItems[0].(map[string]interface{})["remaining"] != 10.0 {
+        t.Errorf("CreateListing: Wrong line items, got %v", lineItems)
+    }
+
+    for _, itemID := range itemIDs {
+        query = fmt.Sprintf(`
+        {
+            item(id: "%s") {
+                listings {
+                    id
+                }
+            }
+        }`, itemID)
+        result = thelpers.ExecQuery(query)
+        item := result["data"].(map[string]interface{})["item"].(map[string]interface{})
+        if len(item["listings"].([]interface{})) != 1 {
+            t.Errorf("CreateListing: bundle not added to the listings of item %s", itemID)
+        }
+    }
+}
+
+func TestDeleteListing(t *testing.T) {
+    itemID := insertItem(t, bson.M{"name": "robot hero"})
+    sellerID := insertUser(t, bson.M{"discordID": 4646})
+    otherID := insertUser(t, bson.M{"discordID": 4747})
+    adminID := insertUser(t, bson.M{"discordID": 4848, "admin": true})
+
+    createListing := func() string {
+        query := fmt.Sprintf(`
+        mutation {
+            createListing(itemID: "%s", userID: "%s", price: 5000) {
+                id
+            }
+        }`, itemID, sellerID)
+        result := thelpers.ExecQuery(query)
+        return result["data"].(map[string]interface{})["createListing"].(map[string]interface{})["id"].(string)
+    }
+    deleteListing := func(listingID string, userID string) map[string]interface{} {
+        query := fmt.Sprintf(`
+        mutation {
+            deleteListing(listingID: "%s", userID: "%s") {
+                id
+            }
+        }`, listingID, userID)
+        return thelpers.ExecQuery(query)
+    }
+
+    listingID := createListing()
+    if _, prs := deleteListing(listingID, otherID)["errors"]; !prs {
+        t.Error("DeleteListing: listing deleted by someone other than the seller")
+    }
+    if result := deleteListing(listingID, sellerID); result["errors"] != nil {
+        t.Errorf("DeleteListing: seller could not delete their listing: %v", result["errors"])
+    }
+
+    listingID = createListing()
+    if result := deleteListing(listingID, adminID); result["errors"] != nil {
+        t.Errorf("DeleteListing: admin could not delete a listing: %v", result["errors"])
+    }
+}
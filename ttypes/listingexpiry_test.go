@@ -0,0 +1,70 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/types"
+
+    "context"
+    "testing"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestExpireListings(t *testing.T) {
+    ctx := context.Background()
+    sellerObjID, _ := primitive.ObjectIDFromHex(insertUser(t, bson.M{"discordID": 3131}))
+    itemObjID, _ := primitive.ObjectIDFromHex(insertItem(t, bson.M{"name": "lucky cat"}))
+
+    // insertListing adds an open listing that expires at the given time
+    insertListing := func(expiresAt time.Time) primitive.ObjectID {
+        listingID := insertDoc(t, "listings", bson.M{
+            "price": 1000,
+            "variation": nil,
+            "deleted": false,
+            "accepted": nil,
+            "seller": sellerObjID,
+            "buyer": nil,
+            "item": itemObjID,
+            "inquiries": bson.A{},
+            "expiresAt": primitive.NewDateTimeFromTime(expiresAt),
+        }, nil)
+        listingObjID, _ := primitive.ObjectIDFromHex(listingID)
+        return listingObjID
+    }
+    due := insertListing(time.Now().Add(-time.Hour))
+    notDue := insertListing(time.Now().Add(time.Hour))
+    inquiryID := insertDoc(t, "inquiries", bson.M{
+        "listing": due,
+        "buyer": primitive.NewObjectID(),
+        "open": true,
+        "accepted": nil,
+    }, nil)
+    inquiryObjID, _ := primitive.ObjectIDFromHex(inquiryID)
+
+    if err := types.RunJob(ctx, db, "listing expiry"); err != nil {
+        t.Fatalf("expireListings: %s", err)
+    }
+
+    getDoc := func(collection string, objID primitive.ObjectID) bson.M {
+        var doc bson.M
+        if err := db.Collection(collection).FindOne(ctx, bson.M{"_id": objID}).Decode(&doc); err != nil {
+            t.Fatal(err)
+        }
+        return doc
+    }
+    if listing := getDoc("listings", due); listing["expired"] != true {
+        t.Errorf("expireListings: listing past its expiresAt not expired, got %v", listing)
+    }
+    if listing := getDoc("listings", notDue); listing["expired"] == true {
+        t.Errorf("expireListings: listing expired early, got %v", listing)
+    }
+    inquiry := getDoc("inquiries", inquiryObjID)
+    if inquiry["open"] != false || inquiry["closedReason"] != types.InquiryClosedListingExpired {
+        t.Errorf("expireListings: inquiry on the expired listing not declined, got %v", inquiry)
+    }
+    count, err := db.Collection("notifications").CountDocuments(ctx, bson.M{"user": sellerObjID, "listing": due, "kind": types.NotificationListingExpired})
+    if err != nil || count != 1 {
+        t.Errorf("expireListings: seller not notified, got %d (%v)", count, err)
+    }
+}
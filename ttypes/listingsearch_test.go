@@ -0,0 +1,68 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/thelpers"
+
+    "fmt"
+    "testing"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestListingsVariation(t *testing.T) {
+    itemID := insertItem(t, bson.M{"name": "throwback rocket", "variations": bson.A{"Red", "Blue"}})
+    itemObjID, _ := primitive.ObjectIDFromHex(itemID)
+    otherObjID, _ := primitive.ObjectIDFromHex(insertItem(t, bson.M{"name": "throwback race-car bed", "variations": bson.A{"Red"}}))
+    sellerObjID, _ := primitive.ObjectIDFromHex(insertUser(t, bson.M{"discordID": 4141}))
+
+    // insertListing adds an open listing of the item
+    insertListing := func(fields bson.M) string {
+        return insertDoc(t, "listings", bson.M{
+            "price": 1000,
+            "bellPrice": 1000,
+            "variation": nil,
+            "deleted": false,
+            "accepted": nil,
+            "seller": sellerObjID,
+            "item": itemObjID,
+        }, fields)
+    }
+    single := insertListing(bson.M{"variation": "Red"})
+    bundle := insertListing(bson.M{"item": nil, "bundle": true, "lineItems": bson.A{
+        bson.M{"item": itemObjID, "variation": "Red", "quantity": 1, "remaining": 1},
+        bson.M{"item": otherObjID, "variation": nil, "quantity": 1, "remaining": 1},
+    }})
+    // the seller of this one is gone, which mustn't hide it
+    orphaned := insertListing(bson.M{"variation": "Red", "seller": primitive.NewObjectID()})
+    insertListing(bson.M{"variation": "Blue"})
+    // red, but on the other item of the bundle
+    insertListing(bson.M{"item": nil, "bundle": true, "lineItems": bson.A{
+        bson.M{"item": itemObjID, "variation": "Blue", "quantity": 1, "remaining": 1},
+        bson.M{"item": otherObjID, "variation": "Red", "quantity": 1, "remaining": 1},
+    }})
+
+    query := fmt.Sprintf(`
+    query {
+        listings(itemID: "%s", variation: "Red") {
+            edges {
+                node {
+                    id
+                }
+            }
+            totalCount
+        }
+    }`, itemID)
+    result := thelpers.ExecQuery(query)
+    if _, prs := result["errors"]; prs {
+        t.Fatalf("Listings: query rejected: %v", result["errors"])
+    }
+    data := result["data"].(map[string]interface{})["listings"].(map[string]interface{})
+    found := make(map[string]bool)
+    for _, edge := range data["edges"].([]interface{}) {
+        found[edge.(map[string]interface{})["node"].(map[string]interface{})["id"].(string)] = true
+    }
+    if len(found) != 3 || !found[single] || !found[bundle] || !found[orphaned] || data["totalCount"] != 3.0 {
+        t.Errorf("Listings: expected %s, %s and %s, got %v", single, bundle, orphaned, data)
+    }
+}
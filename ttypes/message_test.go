@@ -0,0 +1,58 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/thelpers"
+
+    "fmt"
+    "testing"
+
+    "go.mongodb.org/mongo-driver/bson"
+)
+
+func TestUnreadMessages(t *testing.T) {
+    itemID := insertItem(t, bson.M{"name": "cute music player"})
+    sellerID := insertUser(t, bson.M{"discordID": 2121})
+    buyerID := insertUser(t, bson.M{"discordID": 2222})
+
+    query := fmt.Sprintf(`
+    mutation {
+        createListing(itemID: "%s", userID: "%s", price: 3000) {
+            id
+        }
+    }`, itemID, sellerID)
+    result := thelpers.ExecQuery(query)
+    listingID := result["data"].(map[string]interface{})["createListing"].(map[string]interface{})["id"].(string)
+
+    query = fmt.Sprintf(`
+    mutation {
+        createInquiry(listingID: "%s", userID: "%s") {
+            id
+        }
+    }`, listingID, buyerID)
+    result = thelpers.ExecQuery(query)
+    inquiryID := result["data"].(map[string]interface{})["createInquiry"].(map[string]interface{})["id"].(string)
+
+    sendMessage := func(viewerID string) map[string]interface{} {
+        query := fmt.Sprintf(`
+        mutation {
+            sendMessage(userID: "%s", inquiryID: "%s", body: "still available?") {
+                recipient {
+                    unreadMessages(viewerID: "%s")
+                }
+            }
+        }`, buyerID, inquiryID, viewerID)
+        return thelpers.ExecQuery(query)
+    }
+    result = sendMessage(sellerID)
+    if _, prs := result["errors"]; prs {
+        t.Fatalf("SendMessage: message rejected: %v", result["errors"])
+    }
+    recipient := result["data"].(map[string]interface{})["sendMessage"].(map[string]interface{})["recipient"].(map[string]interface{})
+    if recipient["unreadMessages"] != 1.0 {
+        t.Errorf("User: Wrong number of unread messages, expected 1, got %v", recipient["unreadMessages"])
+    }
+
+    if _, prs := sendMessage(buyerID)["errors"]; !prs {
+        t.Error("User: unread messages counted for someone other than their recipient")
+    }
+}
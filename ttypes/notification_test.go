@@ -0,0 +1,105 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/thelpers"
+
+    "fmt"
+    "testing"
+
+    "go.mongodb.org/mongo-driver/bson"
+)
+
+func TestNotificationNullRefs(t *testing.T) {
+    itemID := insertItem(t, bson.M{"name": "rocking chair", "inGamePrice": 1100})
+    sellerID := insertUser(t, bson.M{"discordID": 7171})
+    buyerID := insertUser(t, bson.M{"discordID": 7272})
+
+    query := fmt.Sprintf(`
+    mutation {
+        createListing(itemID: "%s", userID: "%s", price: 3000) {
+            id
+        }
+    }`, itemID, sellerID)
+    result := thelpers.ExecQuery(query)
+    listingID := result["data"].(map[string]interface{})["createListing"].(map[string]interface{})["id"].(string)
+
+    query = fmt.Sprintf(`
+    mutation {
+        createInquiry(listingID: "%s", userID: "%s") {
+            id
+        }
+    }`, listingID, buyerID)
+    result = thelpers.ExecQuery(query)
+    inquiryID := result["data"].(map[string]interface{})["createInquiry"].(map[string]interface{})["id"].(string)
+
+    query = fmt.Sprintf(`
+    mutation {
+        updateListing(listingID: "%s", userID: "%s", price: 2500) {
+            id
+        }
+    }`, listingID, sellerID)
+    if result = thelpers.ExecQuery(query); result["errors"] != nil {
+        t.Fatalf("UpdateListing: price drop rejected: %v", result["errors"])
+    }
+
+    // a price drop notification points at the listing and inquiry but not a transaction
+    query = fmt.Sprintf(`
+    mutation {
+        withdrawInquiry(inquiryID: "%s", userID: "%s") {
+            transaction {
+                id
+            }
+            buyer {
+                notifications(viewerID: "%s") {
+                    kind
+                    listing {
+                        id
+                    }
+                    transaction {
+                        id
+                    }
+                }
+            }
+        }
+    }`, inquiryID, buyerID, buyerID)
+    result = thelpers.ExecQuery(query)
+    if _, prs := result["errors"]; prs {
+        t.Fatalf("Notification: null refs could not be read: %v", result["errors"])
+    }
+    inquiry := result["data"].(map[string]interface{})["withdrawInquiry"].(map[string]interface{})
+    if inquiry["transaction"] != nil {
+        t.Errorf("ListingInquiry: expected no transaction, got %v", inquiry["transaction"])
+    }
+    notifications := inquiry["buyer"].(map[string]interface{})["notifications"].([]interface{})
+    if len(notifications) != 1 {
+        t.Fatalf("Notification: expected 1 notification, got %d", len(notifications))
+    }
+    notification := notifications[0].(map[string]interface{})
+    if notification["kind"] != "PRICE_DROP" {
+        t.Errorf("Notification: Wrong kind, expected PRICE_DROP, got %v", notification["kind"])
+    }
+    if notification["transaction"] != nil {
+        t.Errorf("Notification: expected no transaction, got %v", notification["transaction"])
+    }
+    listing, ok := notification["listing"].(map[string]interface{})
+    if !ok || listing["id"] != listingID {
+        t.Errorf("Notification: Wrong listing, expected %s, got %v", listingID, notification["listing"])
+    }
+
+    // nobody else gets to read them
+    query = fmt.Sprintf(`
+    {
+        item(id: "%s") {
+            listings {
+                seller {
+                    notifications(viewerID: "%s") {
+                        kind
+                    }
+                }
+            }
+        }
+    }`, itemID, buyerID)
+    if _, prs := thelpers.ExecQuery(query)["errors"]; !prs {
+        t.Error("Notification: notifications read by someone other than their user")
+    }
+}
@@ -0,0 +1,98 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/thelpers"
+
+    "context"
+    "fmt"
+    "testing"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestAcceptOffer(t *testing.T) {
+    ctx := context.Background()
+    itemID := insertItem(t, bson.M{"name": "iron wall lamp", "inGamePrice": 800})
+    sellerID := insertUser(t, bson.M{"discordID": 9191})
+    buyerID := insertUser(t, bson.M{"discordID": 9292})
+
+    query := fmt.Sprintf(`
+    mutation {
+        createListing(userID: "%s", price: 3000, lineItems: [{itemID: "%s", quantity: 3}]) {
+            id
+        }
+    }`, sellerID, itemID)
+    result := thelpers.ExecQuery(query)
+    listingID := result["data"].(map[string]interface{})["createListing"].(map[string]interface{})["id"].(string)
+    listingObjID, _ := primitive.ObjectIDFromHex(listingID)
+
+    query = fmt.Sprintf(`
+    mutation {
+        createInquiry(listingID: "%s", userID: "%s") {
+            id
+        }
+    }`, listingID, buyerID)
+    result = thelpers.ExecQuery(query)
+    inquiryID := result["data"].(map[string]interface{})["createInquiry"].(map[string]interface{})["id"].(string)
+
+    query = fmt.Sprintf(`
+    mutation {
+        makeOffer(inquiryID: "%s", userID: "%s", price: 2500) {
+            id
+        }
+    }`, inquiryID, buyerID)
+    if result = thelpers.ExecQuery(query); result["errors"] != nil {
+        t.Fatalf("MakeOffer: offer rejected: %v", result["errors"])
+    }
+
+    acceptOffer := func(userID string) map[string]interface{} {
+        query := fmt.Sprintf(`
+        mutation {
+            acceptOffer(inquiryID: "%s", userID: "%s") {
+                price
+            }
+        }`, inquiryID, userID)
+        return thelpers.ExecQuery(query)
+    }
+
+    if _, prs := acceptOffer(buyerID)["errors"]; !prs {
+        t.Error("AcceptOffer: buyer accepted their own offer")
+    }
+
+    // without the buyer the transaction can't be created, so the sale has to be undone
+    buyerObjID, _ := primitive.ObjectIDFromHex(buyerID)
+    var buyer bson.M
+    if err := db.Collection("users").FindOneAndDelete(ctx, bson.M{"_id": buyerObjID}).Decode(&buyer); err != nil {
+        t.Fatal(err)
+    }
+    if _, prs := acceptOffer(sellerID)["errors"]; !prs {
+        t.Fatal("AcceptOffer: offer accepted without a transaction")
+    }
+    var listing bson.M
+    if err := db.Collection("listings").FindOne(ctx, bson.M{"_id": listingObjID}).Decode(&listing); err != nil {
+        t.Fatal(err)
+    }
+    lineItem := listing["lineItems"].(bson.A)[0].(bson.M)
+    if listing["accepted"] != nil || listing["buyer"] != nil || fmt.Sprint(lineItem["remaining"]) != "3" {
+        t.Errorf("AcceptOffer: line items not put back after a failed sale, got %v", listing)
+    }
+    if _, err := db.Collection("users").InsertOne(ctx, buyer); err != nil {
+        t.Fatal(err)
+    }
+
+    result = acceptOffer(sellerID)
+    if _, prs := result["errors"]; prs {
+        t.Fatalf("AcceptOffer: offer rejected: %v", result["errors"])
+    }
+    data := result["data"].(map[string]interface{})["acceptOffer"].(map[string]interface{})
+    if data["price"] != 2500.0 {
+        t.Errorf("AcceptOffer: Wrong price, expected 2500, got %v", data["price"])
+    }
+    if err := db.Collection("listings").FindOne(ctx, bson.M{"_id": listingObjID}).Decode(&listing); err != nil {
+        t.Fatal(err)
+    }
+    if listing["buyer"] != buyerObjID || listing["accepted"] == nil {
+        t.Errorf("AcceptOffer: listing not sold to the buyer, got %v", listing)
+    }
+}
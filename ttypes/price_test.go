@@ -0,0 +1,60 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/types"
+
+    "context"
+    "fmt"
+    "testing"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestItemBasketBellPrice(t *testing.T) {
+    ctx := context.Background()
+    itemObjID, _ := primitive.ObjectIDFromHex(insertItem(t, bson.M{"name": "bunny day bed"}))
+    valuedObjID, _ := primitive.ObjectIDFromHex(insertItem(t, bson.M{"name": "bunny day lamp", "inGamePrice": 300}))
+    deletedObjID := primitive.NewObjectID()
+
+    // insertListing adds an open listing asking for the given items, with a bellPrice
+    // that is out of date
+    insertListing := func(items bson.A) primitive.ObjectID {
+        listingID := insertDoc(t, "listings", bson.M{
+            "price": nil,
+            "askingPrice": bson.M{"currency": types.CurrencyItems, "items": items},
+            "bellPrice": 12345,
+            "variation": nil,
+            "deleted": false,
+            "accepted": nil,
+            "item": itemObjID,
+        }, nil)
+        listingObjID, _ := primitive.ObjectIDFromHex(listingID)
+        return listingObjID
+    }
+    partlyDeleted := insertListing(bson.A{
+        bson.M{"item": deletedObjID, "variation": nil, "quantity": 2},
+        bson.M{"item": valuedObjID, "variation": nil, "quantity": 2},
+    })
+    allDeleted := insertListing(bson.A{
+        bson.M{"item": deletedObjID, "variation": nil, "quantity": 2},
+    })
+
+    if err := types.RunJob(ctx, db, "market aggregation"); err != nil {
+        t.Fatalf("refreshBellPrices: %s", err)
+    }
+
+    getListing := func(listingObjID primitive.ObjectID) bson.M {
+        var listing bson.M
+        if err := db.Collection("listings").FindOne(ctx, bson.M{"_id": listingObjID}).Decode(&listing); err != nil {
+            t.Fatal(err)
+        }
+        return listing
+    }
+    if listing := getListing(partlyDeleted); fmt.Sprint(listing["bellPrice"]) != "600" {
+        t.Errorf("refreshBellPrices: Wrong bellPrice, expected 600, got %v", listing["bellPrice"])
+    }
+    if listing := getListing(allDeleted); listing["bellPrice"] != nil {
+        t.Errorf("refreshBellPrices: basket of deleted items given a bellPrice, got %v", listing["bellPrice"])
+    }
+}
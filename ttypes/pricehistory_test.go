@@ -0,0 +1,78 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/thelpers"
+    "github.com/animal-crossing-exchange/ace-server/types"
+
+    "fmt"
+    "testing"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPriceHistory(t *testing.T) {
+    itemID := insertItem(t, bson.M{"name": "mush lamp"})
+    itemObjID, _ := primitive.ObjectIDFromHex(itemID)
+    date := func(day int) time.Time {
+        return time.Date(2020, 6, day, 12, 0, 0, 0, time.UTC)
+    }
+
+    listingID := insertDoc(t, "listings", bson.M{
+        "_id": primitive.NewObjectIDFromTimestamp(date(1)),
+        "price": 1000,
+        "variation": nil,
+        "deleted": false,
+        "item": itemObjID,
+    }, nil)
+    listingObjID, _ := primitive.ObjectIDFromHex(listingID)
+
+    // insertTransaction adds a completed transaction for the listing
+    insertTransaction := func(started time.Time, price int, settled interface{}) {
+        insertDoc(t, "transactions", bson.M{
+            "_id": primitive.NewObjectIDFromTimestamp(started),
+            "state": types.TransactionStateCompleted,
+            "price": price,
+            "listing": listingObjID,
+            "settled": settled,
+        }, nil)
+    }
+    // started before the history but completed within it
+    insertTransaction(time.Date(2020, 5, 20, 12, 0, 0, 0, time.UTC), 1500, primitive.NewDateTimeFromTime(date(3)))
+    // from before settled was recorded, so it counts when it started
+    insertTransaction(date(5), 1200, nil)
+    // started within the history but completed after it
+    insertTransaction(date(2), 9999, primitive.NewDateTimeFromTime(time.Date(2020, 7, 5, 12, 0, 0, 0, time.UTC)))
+
+    query := fmt.Sprintf(`
+    query {
+        priceHistory(itemID: "%s", from: "2020-06-01", to: "2020-06-30") {
+            start
+            high
+            volume
+        }
+    }`, itemID)
+    result := thelpers.ExecQuery(query)
+    if _, prs := result["errors"]; prs {
+        t.Fatalf("PriceHistory: query rejected: %v", result["errors"])
+    }
+    highs := make(map[string]float64)
+    for _, b := range result["data"].(map[string]interface{})["priceHistory"].([]interface{}) {
+        bucket := b.(map[string]interface{})
+        highs[bucket["start"].(string)] = bucket["high"].(float64)
+    }
+    expected := map[string]float64{
+        "2020-06-01T00:00:00Z": 1000,
+        "2020-06-03T00:00:00Z": 1500,
+        "2020-06-05T00:00:00Z": 1200,
+    }
+    if len(highs) != len(expected) {
+        t.Errorf("PriceHistory: Wrong buckets, expected %v, got %v", expected, highs)
+    }
+    for start, high := range expected {
+        if highs[start] != high {
+            t.Errorf("PriceHistory: Wrong high for %s, expected %v, got %v", start, high, highs[start])
+        }
+    }
+}
@@ -0,0 +1,59 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/thelpers"
+    "github.com/animal-crossing-exchange/ace-server/types"
+
+    "fmt"
+    "testing"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSuggestedPrice(t *testing.T) {
+    itemID := insertItem(t, bson.M{"name": "pearl wardrobe"})
+    itemObjID, _ := primitive.ObjectIDFromHex(itemID)
+    longAgo := time.Now().Add(-types.PriceSuggestionWindow - 10 * 24 * time.Hour)
+
+    listingID := insertDoc(t, "listings", bson.M{
+        "_id": primitive.NewObjectIDFromTimestamp(longAgo),
+        "price": 1000,
+        "variation": nil,
+        "deleted": false,
+        "item": itemObjID,
+    }, nil)
+    listingObjID, _ := primitive.ObjectIDFromHex(listingID)
+
+    // insertTransaction adds a completed transaction for the listing
+    insertTransaction := func(started time.Time, price int, settled interface{}) {
+        insertDoc(t, "transactions", bson.M{
+            "_id": primitive.NewObjectIDFromTimestamp(started),
+            "state": types.TransactionStateCompleted,
+            "price": price,
+            "listing": listingObjID,
+            "settled": settled,
+        }, nil)
+    }
+    // started before the window but completed within it
+    insertTransaction(longAgo, 1500, primitive.NewDateTimeFromTime(time.Now().Add(-48 * time.Hour)))
+    // from before settled was recorded, so it counts when it started
+    insertTransaction(longAgo.Add(time.Hour), 9999, nil)
+
+    query := fmt.Sprintf(`
+    query {
+        suggestedPrice(itemID: "%s") {
+            recommended
+            sampleSize
+        }
+    }`, itemID)
+    result := thelpers.ExecQuery(query)
+    if _, prs := result["errors"]; prs {
+        t.Fatalf("SuggestedPrice: query rejected: %v", result["errors"])
+    }
+    data := result["data"].(map[string]interface{})["suggestedPrice"].(map[string]interface{})
+    if data["sampleSize"] != 1.0 || data["recommended"] != 1500.0 {
+        t.Errorf("SuggestedPrice: expected the one transaction completed within the window, got %v", data)
+    }
+}
@@ -0,0 +1,49 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/thelpers"
+
+    "context"
+    "fmt"
+    "testing"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRecomputeAllReputations(t *testing.T) {
+    ctx := context.Background()
+    adminID := insertUser(t, bson.M{"discordID": 12101, "admin": true})
+    userObjID, _ := primitive.ObjectIDFromHex(insertUser(t, bson.M{"discordID": 12202}))
+
+    // a user whose reputation can't be recomputed mustn't stop everyone else's
+    _, err := db.Collection("users").InsertOne(ctx, bson.M{"_id": "imported", "discordID": 12303})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Collection("users").DeleteOne(ctx, bson.M{"_id": "imported"})
+    expected, err := db.Collection("users").CountDocuments(ctx, bson.M{"_id": bson.M{"$type": "objectId"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    query := fmt.Sprintf(`
+    mutation {
+        recomputeReputation(adminID: "%s")
+    }`, adminID)
+    result := thelpers.ExecQuery(query)
+    if _, prs := result["errors"]; prs {
+        t.Fatalf("RecomputeReputation: recompute failed: %v", result["errors"])
+    }
+    if count := result["data"].(map[string]interface{})["recomputeReputation"]; count != float64(expected) {
+        t.Errorf("RecomputeReputation: Wrong count, expected %d, got %v", expected, count)
+    }
+
+    var user bson.M
+    if err = db.Collection("users").FindOne(ctx, bson.M{"_id": userObjID}).Decode(&user); err != nil {
+        t.Fatal(err)
+    }
+    if user["reputationBreakdown"] == nil {
+        t.Errorf("RecomputeReputation: reputation of %s not recomputed, got %v", userObjID.Hex(), user)
+    }
+}
@@ -0,0 +1,72 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/thelpers"
+    "github.com/animal-crossing-exchange/ace-server/types"
+
+    "fmt"
+    "testing"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestReplyToReview(t *testing.T) {
+    buyerID := insertUser(t, bson.M{"discordID": 13101})
+    sellerID := insertUser(t, bson.M{"discordID": 13202})
+    buyerObjID, _ := primitive.ObjectIDFromHex(buyerID)
+    sellerObjID, _ := primitive.ObjectIDFromHex(sellerID)
+    transactionObjID, _ := primitive.ObjectIDFromHex(insertDoc(t, "transactions", bson.M{
+        "state": types.TransactionStateCompleted,
+        "price": 1000,
+        "listing": primitive.NewObjectID(),
+        "buyer": buyerObjID,
+        "seller": sellerObjID,
+    }, nil))
+
+    // insertReview adds a published review on the transaction
+    insertReview := func(author primitive.ObjectID, subject primitive.ObjectID) string {
+        return insertDoc(t, "reviews", bson.M{
+            "rating": primitive.NewObjectID(),
+            "transaction": transactionObjID,
+            "author": author,
+            "subject": subject,
+            "score": 2,
+            "comment": "slow",
+            "reply": nil,
+            "removed": nil,
+        }, nil)
+    }
+    reply := func(reviewID string, userID string) map[string]interface{} {
+        query := fmt.Sprintf(`
+        mutation {
+            replyToReview(reviewID: "%s", userID: "%s", text: "sorry") {
+                reply {
+                    text
+                }
+            }
+        }`, reviewID, userID)
+        return thelpers.ExecQuery(query)
+    }
+
+    // the buyer was reviewed by the seller, but only sellers can reply
+    if _, prs := reply(insertReview(sellerObjID, buyerObjID), buyerID)["errors"]; !prs {
+        t.Error("ReplyToReview: buyer allowed to reply")
+    }
+
+    reviewID := insertReview(buyerObjID, sellerObjID)
+    if _, prs := reply(reviewID, buyerID)["errors"]; !prs {
+        t.Error("ReplyToReview: author allowed to reply to their own review")
+    }
+    result := reply(reviewID, sellerID)
+    if _, prs := result["errors"]; prs {
+        t.Fatalf("ReplyToReview: seller's reply rejected: %v", result["errors"])
+    }
+    data := result["data"].(map[string]interface{})["replyToReview"].(map[string]interface{})
+    if r, _ := data["reply"].(map[string]interface{}); r == nil || r["text"] != "sorry" {
+        t.Errorf("ReplyToReview: Wrong reply, expected sorry, got %v", data["reply"])
+    }
+    if _, prs := reply(reviewID, sellerID)["errors"]; !prs {
+        t.Error("ReplyToReview: second reply allowed")
+    }
+}
@@ -0,0 +1,73 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/thelpers"
+    "github.com/animal-crossing-exchange/ace-server/types"
+
+    "context"
+    "fmt"
+    "strings"
+    "testing"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestCalendarToken(t *testing.T) {
+    ctx := context.Background()
+    buyerID := insertUser(t, bson.M{"discordID": 1515})
+    buyerObjID, _ := primitive.ObjectIDFromHex(buyerID)
+    insertDoc(t, "transactions", bson.M{
+        "state": types.TransactionStateInProgress,
+        "price": 1000,
+        "listing": primitive.NewObjectID(),
+        "buyer": buyerObjID,
+        "seller": primitive.NewObjectID(),
+        "confirmedTime": bson.M{
+            "start": primitive.NewDateTimeFromTime(time.Now().Add(time.Hour)),
+            "end": primitive.NewDateTimeFromTime(time.Now().Add(2 * time.Hour)),
+        },
+    }, nil)
+
+    resetToken := func(revoke bool) interface{} {
+        query := fmt.Sprintf(`
+        mutation {
+            resetCalendarToken(userID: "%s", revoke: %t)
+        }`, buyerID, revoke)
+        result := thelpers.ExecQuery(query)
+        if _, prs := result["errors"]; prs {
+            t.Fatalf("ResetCalendarToken: reset rejected: %v", result["errors"])
+        }
+        return result["data"].(map[string]interface{})["resetCalendarToken"]
+    }
+
+    token := resetToken(false).(string)
+    calendar, err := types.UpcomingTradesCalendar(ctx, db, token)
+    if err != nil {
+        t.Fatalf("UpcomingTradesCalendar: %s", err)
+    }
+    if strings.Count(calendar, "BEGIN:VEVENT") != 1 {
+        t.Errorf("UpcomingTradesCalendar: expected 1 trade, got %q", calendar)
+    }
+
+    // a new token replaces the old one
+    newToken := resetToken(false).(string)
+    if newToken == token {
+        t.Error("ResetCalendarToken: same token given again")
+    }
+    if _, err = types.UpcomingTradesCalendar(ctx, db, token); err != mongo.ErrNoDocuments {
+        t.Errorf("UpcomingTradesCalendar: replaced token still works, got %v", err)
+    }
+
+    if revoked := resetToken(true); revoked != nil {
+        t.Errorf("ResetCalendarToken: token given when revoking, got %v", revoked)
+    }
+    if _, err = types.UpcomingTradesCalendar(ctx, db, newToken); err != mongo.ErrNoDocuments {
+        t.Errorf("UpcomingTradesCalendar: revoked token still works, got %v", err)
+    }
+    if _, err = types.UpcomingTradesCalendar(ctx, db, ""); err != mongo.ErrNoDocuments {
+        t.Errorf("UpcomingTradesCalendar: empty token works, got %v", err)
+    }
+}
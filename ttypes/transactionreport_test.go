@@ -0,0 +1,148 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/thelpers"
+    "github.com/animal-crossing-exchange/ace-server/types"
+
+    "context"
+    "fmt"
+    "testing"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestTransactionReports(t *testing.T) {
+    buyerID := insertUser(t, bson.M{"discordID": 10101})
+    sellerID := insertUser(t, bson.M{"discordID": 10202})
+    buyerObjID, _ := primitive.ObjectIDFromHex(buyerID)
+    sellerObjID, _ := primitive.ObjectIDFromHex(sellerID)
+
+    // insertTransaction adds an in-progress transaction between the buyer and seller
+    insertTransaction := func(fields bson.M) string {
+        return insertDoc(t, "transactions", bson.M{
+            "state": types.TransactionStateInProgress,
+            "price": 1000,
+            "buyerReportedComplete": nil,
+            "sellerReportedComplete": nil,
+            "reportedFailed": nil,
+            "note": nil,
+            "settled": nil,
+            "autoSettled": false,
+            "confirmedTime": nil,
+            "listing": primitive.NewObjectID(),
+            "buyer": buyerObjID,
+            "seller": sellerObjID,
+            "unhappyUser": nil,
+        }, fields)
+    }
+    report := func(mutation string, transactionID string, userID string) string {
+        query := fmt.Sprintf(`
+        mutation {
+            %s(transactionID: "%s", userID: "%s") {
+                state
+            }
+        }`, mutation, transactionID, userID)
+        result := thelpers.ExecQuery(query)
+        if _, prs := result["errors"]; prs {
+            t.Fatalf("%s: report rejected: %v", mutation, result["errors"])
+        }
+        return result["data"].(map[string]interface{})[mutation].(map[string]interface{})["state"].(string)
+    }
+
+    cases := []struct {
+        name string
+        buyerReport string
+        sellerReport string
+        state string
+    } {
+        {"complete", "reportTransactionComplete", "reportTransactionComplete", types.TransactionStateCompleted},
+        {"failed", "reportTransactionFailed", "reportTransactionFailed", types.TransactionStateFailed},
+        {"dispute", "reportTransactionComplete", "reportTransactionFailed", types.TransactionStateDisputed},
+    }
+    for _, c := range cases {
+        transactionID := insertTransaction(nil)
+        if state := report(c.buyerReport, transactionID, buyerID); state != types.TransactionStateInProgress {
+            t.Errorf("%s: transaction settled after one report, got %s", c.name, state)
+        }
+        if state := report(c.sellerReport, transactionID, sellerID); state != c.state {
+            t.Errorf("%s: Wrong state, expected %s, got %s", c.name, c.state, state)
+        }
+    }
+
+    // a report the other side didn't answer in time stands
+    reported := primitive.NewDateTimeFromTime(time.Now().Add(-types.TransactionReportDeadline - time.Hour))
+    transactionID := insertTransaction(bson.M{"buyerReportedComplete": reported})
+    if err := types.RunJob(context.Background(), db, "stale transactions"); err != nil {
+        t.Fatalf("settleStaleTransactions: %s", err)
+    }
+    transactionObjID, _ := primitive.ObjectIDFromHex(transactionID)
+    var transaction bson.M
+    err := db.Collection("transactions").FindOne(context.Background(), bson.M{"_id": transactionObjID}).Decode(&transaction)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if transaction["state"] != types.TransactionStateCompleted || transaction["autoSettled"] != true {
+        t.Errorf("settleStaleTransactions: unanswered report not settled, got %v", transaction)
+    }
+}
+
+func TestFailedTransactionReopensListing(t *testing.T) {
+    buyerID := insertUser(t, bson.M{"discordID": 10303})
+    sellerID := insertUser(t, bson.M{"discordID": 10404})
+    buyerObjID, _ := primitive.ObjectIDFromHex(buyerID)
+    sellerObjID, _ := primitive.ObjectIDFromHex(sellerID)
+    itemObjID, _ := primitive.ObjectIDFromHex(insertItem(t, bson.M{"name": "golden toilet"}))
+
+    // the buyer took the last one, selling the listing out
+    listingID := insertDoc(t, "listings", bson.M{
+        "price": 1000,
+        "variation": nil,
+        "deleted": false,
+        "accepted": primitive.NewDateTimeFromTime(time.Now()),
+        "buyer": buyerObjID,
+        "seller": sellerObjID,
+        "item": itemObjID,
+        "lineItems": bson.A{bson.M{"item": itemObjID, "variation": nil, "quantity": 2, "remaining": 0}},
+    }, nil)
+    listingObjID, _ := primitive.ObjectIDFromHex(listingID)
+    transactionID := insertDoc(t, "transactions", bson.M{
+        "state": types.TransactionStateInProgress,
+        "price": 1000,
+        "buyerReportedComplete": nil,
+        "sellerReportedComplete": nil,
+        "reportedFailed": nil,
+        "note": nil,
+        "settled": nil,
+        "autoSettled": false,
+        "confirmedTime": nil,
+        "listing": listingObjID,
+        "buyer": buyerObjID,
+        "seller": sellerObjID,
+        "unhappyUser": nil,
+        "lineItems": bson.A{bson.M{"item": itemObjID, "variation": nil, "quantity": 1}},
+    }, nil)
+
+    for _, userID := range []string{buyerID, sellerID} {
+        query := fmt.Sprintf(`
+        mutation {
+            reportTransactionFailed(transactionID: "%s", userID: "%s") {
+                state
+            }
+        }`, transactionID, userID)
+        if result := thelpers.ExecQuery(query); result["errors"] != nil {
+            t.Fatalf("ReportTransactionFailed: report rejected: %v", result["errors"])
+        }
+    }
+
+    var listing bson.M
+    err := db.Collection("listings").FindOne(context.Background(), bson.M{"_id": listingObjID}).Decode(&listing)
+    if err != nil {
+        t.Fatal(err)
+    }
+    remaining := listing["lineItems"].(bson.A)[0].(bson.M)["remaining"]
+    if listing["accepted"] != nil || listing["buyer"] != nil || fmt.Sprint(remaining) != "1" {
+        t.Errorf("ReportTransactionFailed: listing not reopened, got %v", listing)
+    }
+}
@@ -0,0 +1,71 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/thelpers"
+    "github.com/animal-crossing-exchange/ace-server/types"
+
+    "context"
+    "testing"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestTrendingItems(t *testing.T) {
+    itemID := insertItem(t, bson.M{"name": "ironwood kitchenette"})
+    itemObjID, _ := primitive.ObjectIDFromHex(itemID)
+
+    // insertListings adds listings of the item made just now
+    insertListings := func(n int, fields bson.M) []string {
+        listingIDs := make([]string, n)
+        for i := range listingIDs {
+            listingIDs[i] = insertDoc(t, "listings", bson.M{
+                "price": 1000,
+                "variation": nil,
+                "deleted": false,
+                "accepted": nil,
+                "item": itemObjID,
+            }, fields)
+        }
+        return listingIDs
+    }
+    listingIDs := insertListings(30, nil)
+    // deleted and expired listings don't count towards the trend
+    insertListings(5, bson.M{"deleted": true})
+    insertListings(5, bson.M{"expired": true})
+    for _, listingID := range listingIDs[:5] {
+        listingObjID, _ := primitive.ObjectIDFromHex(listingID)
+        insertDoc(t, "inquiries", bson.M{"listing": listingObjID, "buyer": primitive.NewObjectID(), "open": true}, nil)
+    }
+
+    if err := types.RunJob(context.Background(), db, "trending items"); err != nil {
+        t.Fatalf("refreshTrending: %s", err)
+    }
+
+    query := `
+    query {
+        trendingItems(window: DAY, limit: 1) {
+            item {
+                id
+            }
+            score
+            newListings
+            inquiries
+        }
+    }`
+    result := thelpers.ExecQuery(query)
+    if _, prs := result["errors"]; prs {
+        t.Fatalf("TrendingItems: query rejected: %v", result["errors"])
+    }
+    trending := result["data"].(map[string]interface{})["trendingItems"].([]interface{})
+    if len(trending) != 1 {
+        t.Fatalf("TrendingItems: Wrong number of items, expected 1, got %d", len(trending))
+    }
+    top := trending[0].(map[string]interface{})
+    if top["item"].(map[string]interface{})["id"] != itemID {
+        t.Errorf("TrendingItems: Wrong top item, expected %s, got %v", itemID, top)
+    }
+    if top["newListings"] != 30.0 || top["inquiries"] != 5.0 || top["score"] != 40.0 {
+        t.Errorf("TrendingItems: expected 30 listings, 5 inquiries and a score of 40, got %v", top)
+    }
+}
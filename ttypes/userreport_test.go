@@ -0,0 +1,165 @@
+package ttypes
+
+import (
+    "github.com/animal-crossing-exchange/ace-server/thelpers"
+
+    "context"
+    "fmt"
+    "testing"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestReportUser(t *testing.T) {
+    reporterID := insertUser(t, bson.M{"discordID": 6161})
+    scumbagID := insertUser(t, bson.M{"discordID": 6262})
+
+    reportUser := func(reporterID string, scumbagID string) map[string]interface{} {
+        query := fmt.Sprintf(`
+        mutation {
+            reportUser(reporterID: "%s", scumbagID: "%s", reason: NO_SHOW, note: "never came") {
+                reason
+                status
+                listing {
+                    id
+                }
+                inquiry {
+                    id
+                }
+                transaction {
+                    id
+                }
+            }
+        }`, reporterID, scumbagID)
+        return thelpers.ExecQuery(query)
+    }
+
+    if _, prs := reportUser(reporterID, reporterID)["errors"]; !prs {
+        t.Error("ReportUser: self-report allowed")
+    }
+    if _, prs := reportUser(reporterID, primitive.NewObjectID().Hex())["errors"]; !prs {
+        t.Error("ReportUser: report on a user that doesn't exist allowed")
+    }
+
+    result := reportUser(reporterID, scumbagID)
+    if _, prs := result["errors"]; prs {
+        t.Fatalf("ReportUser: report rejected: %v", result["errors"])
+    }
+    data := result["data"].(map[string]interface{})["reportUser"].(map[string]interface{})
+    if data["reason"] != "NO_SHOW" {
+        t.Errorf("ReportUser: Wrong reason, expected NO_SHOW, got %v", data["reason"])
+    }
+    if data["status"] != "OPEN" {
+        t.Errorf("ReportUser: Wrong status, expected OPEN, got %v", data["status"])
+    }
+    for _, key := range []string{"listing", "inquiry", "transaction"} {
+        if data[key] != nil {
+            t.Errorf("ReportUser: Wrong %s, expected null, got %v", key, data[key])
+        }
+    }
+
+    // reports from before they could be about a listing, inquiry or transaction
+    scumbagObjID, _ := primitive.ObjectIDFromHex(scumbagID)
+    reporterObjID, _ := primitive.ObjectIDFromHex(insertUser(t, bson.M{"discordID": 6363}))
+    insertDoc(t, "reports", bson.M{}, bson.M{"reporter": reporterObjID, "scumbag": scumbagObjID, "note": "old", "status": "OPEN"})
+    query := fmt.Sprintf(`
+    {
+        reports(adminID: "%s") {
+            edges {
+                node {
+                    listing {
+                        id
+                    }
+                    inquiry {
+                        id
+                    }
+                    transaction {
+                        id
+                    }
+                }
+            }
+        }
+    }`, insertUser(t, bson.M{"discordID": 6464, "admin": true}))
+    result = thelpers.ExecQuery(query)
+    if _, prs := result["errors"]; prs {
+        t.Errorf("Reports: reports without a listing, inquiry or transaction failed: %v", result["errors"])
+    }
+
+    if _, prs := reportUser(reporterID, scumbagID)["errors"]; !prs {
+        t.Error("ReportUser: second open report on the same user allowed")
+    }
+}
+
+func TestResolveReport(t *testing.T) {
+    ctx := context.Background()
+    adminID := insertUser(t, bson.M{"discordID": 6565, "admin": true})
+    reporterID := insertUser(t, bson.M{"discordID": 6666})
+    scumbagID := insertUser(t, bson.M{"discordID": 6767})
+    reporterObjID, _ := primitive.ObjectIDFromHex(reporterID)
+    scumbagObjID, _ := primitive.ObjectIDFromHex(scumbagID)
+
+    // insertReport adds an open report on the scumbag by the reporter
+    insertReport := func(scumbagObjID primitive.ObjectID) string {
+        return insertDoc(t, "reports", bson.M{
+            "reporter": reporterObjID,
+            "scumbag": scumbagObjID,
+            "reason": "SCAM",
+            "note": "took the bells",
+            "status": "OPEN",
+        }, nil)
+    }
+    resolve := func(reportID string) map[string]interface{} {
+        query := fmt.Sprintf(`
+        mutation {
+            resolveReport(reportID: "%s", adminID: "%s", note: "confirmed", ban: true, banNote: "scamming") {
+                status
+                banned
+            }
+        }`, reportID, adminID)
+        return thelpers.ExecQuery(query)
+    }
+    status := func(reportID string) interface{} {
+        reportObjID, _ := primitive.ObjectIDFromHex(reportID)
+        var report bson.M
+        if err := db.Collection("reports").FindOne(ctx, bson.M{"_id": reportObjID}).Decode(&report); err != nil {
+            t.Fatal(err)
+        }
+        return report["status"]
+    }
+
+    // a ban that fails leaves the report open
+    goneID := insertReport(primitive.NewObjectID())
+    if _, prs := resolve(goneID)["errors"]; !prs {
+        t.Error("ResolveReport: report resolved as banned without a ban")
+    }
+    if s := status(goneID); s != "OPEN" {
+        t.Errorf("ResolveReport: report closed after the ban failed, got %v", s)
+    }
+
+    reportID := insertReport(scumbagObjID)
+    result := resolve(reportID)
+    if _, prs := result["errors"]; prs {
+        t.Fatalf("ResolveReport: resolution rejected: %v", result["errors"])
+    }
+    data := result["data"].(map[string]interface{})["resolveReport"].(map[string]interface{})
+    if data["status"] != "RESOLVED" || data["banned"] != true {
+        t.Errorf("ResolveReport: expected a resolved report with a ban, got %v", data)
+    }
+    var scumbag bson.M
+    if err := db.Collection("users").FindOne(ctx, bson.M{"_id": scumbagObjID}).Decode(&scumbag); err != nil {
+        t.Fatal(err)
+    }
+    if scumbag["banned"] == nil || scumbag["banNote"] != "scamming" {
+        t.Errorf("ResolveReport: reported user not banned with the ban note, got %v", scumbag)
+    }
+    if _, prs := resolve(reportID)["errors"]; !prs {
+        t.Error("ResolveReport: report resolved twice")
+    }
+
+    // only open reports count towards one per pair
+    insertReport(scumbagObjID)
+    if _, err := db.Collection("reports").InsertOne(ctx, bson.M{"reporter": reporterObjID, "scumbag": scumbagObjID, "status": "OPEN"}); err == nil {
+        t.Error("ReportUser: second open report on the same user stored")
+    }
+}
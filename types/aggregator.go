@@ -0,0 +1,291 @@
+package types
+
+import (
+    "context"
+    "errors"
+    "sort"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "github.com/graphql-go/graphql"
+)
+
+// MarketAggregationInterval is how often the market aggregation job runs.
+var MarketAggregationInterval = time.Hour
+
+// marketKey identifies the prices that go into a single market record. A nil variation
+// means the record covers every variation of the item.
+type marketKey struct {
+    item primitive.ObjectID
+    variation interface{}
+}
+
+// marketStats returns the fields of a market record computed from a set of prices.
+func marketStats(prices []int) bson.M {
+    sorted := make([]int, len(prices))
+    copy(sorted, prices)
+    sort.Ints(sorted)
+
+    sum := 0
+    for _, price := range sorted {
+        sum += price
+    }
+    mid := len(sorted) / 2
+    median := sorted[mid]
+    if len(sorted) % 2 == 0 {
+        median = (sorted[mid - 1] + sorted[mid]) / 2
+    }
+    return bson.M{
+        "avg": sum / len(sorted),
+        "median": median,
+        "high": sorted[len(sorted) - 1],
+        "low": sorted[0],
+    }
+}
+
+// completedBetween matches the transactions completed between from and to. Transactions
+// from before settled was recorded count as completed when they started.
+func completedBetween(from time.Time, to time.Time) bson.M {
+    return bson.M{
+        "state": TransactionStateCompleted,
+        "$or": bson.A{
+            bson.M{"settled": bson.M{
+                "$gte": primitive.NewDateTimeFromTime(from),
+                "$lt": primitive.NewDateTimeFromTime(to),
+            }},
+            bson.M{"settled": nil, "_id": objectIDRange(from, to)},
+        },
+    }
+}
+
+// completedTime is the expression for when a transaction was completed, following the
+// same fallback as completedBetween.
+var completedTime = bson.M{"$ifNull": bson.A{"$settled", bson.M{"$toDate": "$_id"}}}
+
+// AggregateMarketRecords computes the market records for a day (in UTC) from the listings
+// created and the transactions completed that day. Every item with activity gets a record
+// covering all of its variations, and one more for each variation that was sold. Records
+// are upserted on item, date and variation, and records of that day with no activity left
+// are removed, so running this again for the same day replaces that day's records instead
+// of adding to them. Afterwards the currentAvg and currentMedian of each affected item are
+// refreshed from its latest record. Listings priced in Nook Miles Tickets or items are
+// converted to bells first, and left out if their value in bells can't be worked out yet.
+// Prices of bundles are split between their items, so that records always hold the price
+// of a single unit.
+func AggregateMarketRecords(ctx context.Context, db mongo.Database, day time.Time) ([]bson.M, error) {
+    itemsCollection := db.Collection("items")
+    listingsCollection := db.Collection("listings")
+    recordsCollection := db.Collection("records")
+    transactionsCollection := db.Collection("transactions")
+
+    start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+    date := start.Format("2006-01-02")
+    idRange := objectIDRange(start, start.Add(24 * time.Hour))
+
+    prices := make(map[marketKey][]int)
+    numListings := make(map[marketKey]int)
+    normalizer, err := newPriceNormalizer(ctx, db)
+    if err != nil {
+        return nil, err
+    }
+    // add splits the price of a sale of some line items into the price of a single
+    // unit of each, and adds those to the records of their items
+    add := func(lineItems primitive.A, price int, isListing bool) error {
+        units, err := normalizer.unitPrices(ctx, lineItems, price)
+        if err != nil {
+            return err
+        }
+        for _, unit := range units {
+            keys := []marketKey{{unit.item, nil}}
+            if variation, ok := unit.variation.(string); ok {
+                keys = append(keys, marketKey{unit.item, variation})
+            }
+            for _, key := range keys {
+                prices[key] = append(prices[key], unit.price)
+                if isListing {
+                    numListings[key]++
+                }
+            }
+        }
+        return nil
+    }
+    cursor, err := listingsCollection.Find(ctx, bson.M{"_id": idRange, "deleted": bson.M{"$ne": true}})
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+    for cursor.Next(ctx) {
+        var listing bson.M
+        if err = cursor.Decode(&listing); err != nil {
+            return nil, err
+        }
+        bells, ok, err := normalizer.toBells(ctx, listing)
+        if err != nil {
+            return nil, err
+        }
+        if !ok {
+            continue
+        }
+        if err = add(listingLineItems(listing), bells, true); err != nil {
+            return nil, err
+        }
+    }
+    if err := cursor.Err(); err != nil {
+        return nil, err
+    }
+
+    cursor, err = transactionsCollection.Find(ctx, completedBetween(start, start.Add(24 * time.Hour)))
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+    for cursor.Next(ctx) {
+        var transaction bson.M
+        if err = cursor.Decode(&transaction); err != nil {
+            return nil, err
+        }
+        var listing bson.M
+        err = listingsCollection.FindOne(ctx, bson.M{"_id": transaction["listing"]}).Decode(&listing)
+        if err == mongo.ErrNoDocuments {
+            continue
+        } else if err != nil {
+            return nil, err
+        }
+        price, ok := toInt(transaction["price"])
+        if !ok {
+            continue
+        }
+        lineItems, ok := transaction["lineItems"].(primitive.A)
+        if !ok {
+            lineItems = listingLineItems(listing)
+        }
+        if err = add(lineItems, price, false); err != nil {
+            return nil, err
+        }
+    }
+    if err := cursor.Err(); err != nil {
+        return nil, err
+    }
+
+    records := make([]bson.M, 0, len(prices))
+    recordObjIDs := make(bson.A, 0, len(prices))
+    refresh := make(map[primitive.ObjectID]bool)
+    for key, keyPrices := range prices {
+        stats := marketStats(keyPrices)
+        stats["numListings"] = numListings[key]
+        filter := bson.M{"item": key.item, "date": date, "variation": key.variation}
+        update := bson.M{"$set": stats}
+        opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+        var record bson.M
+        err = recordsCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&record)
+        if err != nil {
+            return nil, err
+        }
+        err = addToBsonArray(ctx, key.item, *itemsCollection, "records", record["_id"])
+        if err != nil {
+            return nil, err
+        }
+        records = append(records, record)
+        recordObjIDs = append(recordObjIDs, record["_id"])
+        refresh[key.item] = true
+    }
+
+    // records left over from an earlier run for keys that no longer have any prices
+    cursor, err = recordsCollection.Find(ctx, bson.M{"date": date, "_id": bson.M{"$nin": recordObjIDs}})
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+    for cursor.Next(ctx) {
+        var record bson.M
+        if err = cursor.Decode(&record); err != nil {
+            return nil, err
+        }
+        itemObjID := record["item"].(primitive.ObjectID)
+        if _, err = recordsCollection.DeleteOne(ctx, bson.M{"_id": record["_id"]}); err != nil {
+            return nil, err
+        }
+        if err = pullFromBsonArray(ctx, itemObjID, *itemsCollection, "records", record["_id"]); err != nil && err != mongo.ErrNoDocuments {
+            return nil, err
+        }
+        refresh[itemObjID] = true
+    }
+    if err := cursor.Err(); err != nil {
+        return nil, err
+    }
+
+    for itemObjID := range refresh {
+        update := bson.M{"$set": bson.M{"currentAvg": nil, "currentMedian": nil}}
+        var latest bson.M
+        opts := options.FindOne().SetSort(bson.M{"date": -1})
+        err = recordsCollection.FindOne(ctx, bson.M{"item": itemObjID, "variation": nil}, opts).Decode(&latest)
+        if err == nil {
+            update = bson.M{"$set": bson.M{"currentAvg": latest["avg"], "currentMedian": latest["median"]}}
+        } else if err != mongo.ErrNoDocuments {
+            return nil, err
+        }
+        _, err = itemsCollection.UpdateOne(ctx, bson.M{"_id": itemObjID}, update)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return records, nil
+}
+
+// aggregateRecentMarketRecords is the scheduled form of AggregateMarketRecords. It
+// recomputes today's records so far, along with yesterday's so that activity from the
+// end of the day is picked up once the day is over. The bellPrice of listings priced in
+// something else is refreshed afterwards, since it depends on the new records.
+func aggregateRecentMarketRecords(ctx context.Context, db mongo.Database) error {
+    now := time.Now().UTC()
+    if _, err := AggregateMarketRecords(ctx, db, now.Add(-24 * time.Hour)); err != nil {
+        return err
+    }
+    if _, err := AggregateMarketRecords(ctx, db, now); err != nil {
+        return err
+    }
+    return refreshBellPrices(ctx, db)
+}
+
+// AggregateMarket is a mutation for admins to run the market aggregation for a day on
+// demand, e.g. to backfill records. It defaults to the current day.
+func AggregateMarket(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: graphql.NewList(ItemMarketRecordType),
+        Description: "Compute the market records for a day",
+        Args: graphql.FieldConfigArgument {
+            "adminID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "date": &graphql.ArgumentConfig {
+                Type: graphql.String,
+                DefaultValue: nil,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            day := time.Now().UTC()
+            if date, prs := p.Args["date"]; prs && date != nil {
+                var err error
+                day, err = parseDate(date.(string))
+                if err != nil {
+                    return nil, err
+                }
+            }
+            if day.After(time.Now()) {
+                return nil, errors.New("Cannot aggregate market records for a future date")
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second * 30)
+            defer cancel()
+
+            if err := requireAdmin(timeout, db, p.Args["adminID"]); err != nil {
+                return nil, err
+            }
+            return AggregateMarketRecords(timeout, db, day)
+        },
+    }
+}
@@ -0,0 +1,304 @@
+package types
+
+import (
+    "context"
+    "fmt"
+    "math"
+    "sort"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "github.com/graphql-go/graphql"
+)
+
+// AnomalyWindow is how far back the rolling median and spread used to check listing
+// prices are computed over.
+var AnomalyWindow = 14 * 24 * time.Hour
+
+// AnomalyMinSamples is how many market samples an item needs before its listings are
+// checked, since a median of a couple of prices says little about the market.
+var AnomalyMinSamples = 5
+
+// AnomalyThreshold is how many spreads away from the median a price has to be before
+// it counts as an outlier.
+var AnomalyThreshold = 10.0
+
+// PriceFixingMinListings is how many open listings from different sellers have to share
+// an inflated price before they are flagged for price fixing.
+var PriceFixingMinListings = 3
+
+// Values of ListingFlagKindEnum
+const (
+    ListingFlagLikelyTypo = "LIKELY_TYPO"
+    ListingFlagBellTransfer = "BELL_TRANSFER"
+    ListingFlagPriceFixing = "PRICE_FIXING"
+)
+
+// ListingFlagKindEnum is the reason a listing's price was flagged
+var ListingFlagKindEnum = graphql.NewEnum(
+    graphql.EnumConfig {
+        Name: "ListingFlagKind",
+        Values: graphql.EnumValueConfigMap {
+            ListingFlagLikelyTypo: &graphql.EnumValueConfig {
+                Value: ListingFlagLikelyTypo,
+                Description: "The price is off from the median by about a power of ten",
+            },
+            ListingFlagBellTransfer: &graphql.EnumValueConfig {
+                Value: ListingFlagBellTransfer,
+                Description: "The price is so far above the median that the listing may be used to move bells between users",
+            },
+            ListingFlagPriceFixing: &graphql.EnumValueConfig {
+                Value: ListingFlagPriceFixing,
+                Description: "Several sellers are asking the same inflated price",
+            },
+        },
+    },
+)
+
+// ListingFlagType is an entry of the flags array of a listing
+var ListingFlagType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "ListingFlag",
+        Fields: graphql.Fields {
+            "kind": &graphql.Field {
+                Type: ListingFlagKindEnum,
+            },
+            "reason": &graphql.Field {
+                Type: graphql.String,
+            },
+            "median": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "spread": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "created": &graphql.Field {
+                Type: graphql.String, // TODO Date scalar
+            },
+        },
+    },
+)
+
+// FlaggedListingType is a result of the flaggedListings query, pairing a listing with
+// its flags. Flags are kept off of ListingType so that only admins can see them.
+var FlaggedListingType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "FlaggedListing",
+        Fields: graphql.Fields {
+            "listing": &graphql.Field {
+                Type: ListingType,
+                Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+                    return p.Source, nil
+                },
+            },
+            "flags": &graphql.Field {
+                Type: graphql.NewList(ListingFlagType),
+            },
+        },
+    },
+)
+
+// rollingMedianAndSpread returns the median of a set of market samples, and their spread
+// as the median absolute deviation scaled to match a standard deviation. The spread is
+// never less than a tenth of the median, so that a quiet market where everything sells
+// for the same price doesn't make every other price an outlier.
+func rollingMedianAndSpread(samples []int) (float64, float64) {
+    sorted := make([]float64, len(samples))
+    for i, sample := range samples {
+        sorted[i] = float64(sample)
+    }
+    sort.Float64s(sorted)
+    median := sorted[len(sorted) / 2]
+    deviations := make([]float64, len(sorted))
+    for i, sample := range sorted {
+        deviations[i] = math.Abs(sample - median)
+    }
+    sort.Float64s(deviations)
+    spread := deviations[len(deviations) / 2] * 1.4826
+    return median, math.Max(spread, median / 10)
+}
+
+// detectPriceAnomalies checks the price of a listing against the rolling median and spread
+// of its item, and returns a flag for each way the price looks wrong. When the listing
+// completes a price fixing cluster, the other listings in it are flagged as well.
+func detectPriceAnomalies(ctx context.Context, db mongo.Database, listing bson.M) ([]bson.M, error) {
+    price, ok := toInt(listing["price"])
+    itemObjID, isID := listing["item"].(primitive.ObjectID)
+    if !ok || !isID {
+        return nil, nil
+    }
+    samples, _, err := marketSamples(ctx, db, itemObjID, listing["variation"], time.Now().Add(-AnomalyWindow))
+    if err != nil {
+        return nil, err
+    }
+    if len(samples) < AnomalyMinSamples {
+        return nil, nil
+    }
+    median, spread := rollingMedianAndSpread(samples)
+    if median <= 0 {
+        return nil, nil
+    }
+
+    flags := make([]bson.M, 0)
+    flag := func(kind string, reason string) {
+        flags = append(flags, bson.M{
+            "kind": kind,
+            "reason": reason,
+            "median": int(median),
+            "spread": int(spread),
+            "created": primitive.NewDateTimeFromTime(time.Now()),
+        })
+    }
+
+    ratio := float64(price) / median
+    outlier := math.Abs(float64(price) - median) > AnomalyThreshold * spread
+    magnitude := math.Log10(ratio)
+    if outlier && price > 0 && math.Abs(magnitude) >= 0.9 && math.Abs(magnitude - math.Round(magnitude)) < 0.1 {
+        flag(ListingFlagLikelyTypo, fmt.Sprintf("Price %d is about %.0fx the median of %.0f", price, math.Pow(10, math.Round(magnitude)), median))
+    } else if outlier && ratio >= 5 {
+        flag(ListingFlagBellTransfer, fmt.Sprintf("Price %d is %.1fx the median of %.0f", price, ratio, median))
+    }
+
+    if float64(price) > median + 3 * spread {
+        filter := bson.M{
+            "_id": bson.M{"$ne": listing["_id"]},
+            "item": itemObjID,
+            "variation": listing["variation"],
+            "price": price,
+            "bundle": bson.M{"$ne": true},
+            "seller": bson.M{"$ne": listing["seller"]},
+            "accepted": nil,
+            "deleted": bson.M{"$ne": true},
+            "expired": bson.M{"$ne": true},
+        }
+        sellers, err := db.Collection("listings").Distinct(ctx, "seller", filter)
+        if err != nil {
+            return nil, err
+        }
+        if len(sellers) + 1 >= PriceFixingMinListings {
+            flag(ListingFlagPriceFixing, fmt.Sprintf("%d sellers are asking %d against a median of %.0f", len(sellers) + 1, price, median))
+            // the rest of the cluster is flagged too, unless it already was
+            filter["flags.kind"] = bson.M{"$ne": ListingFlagPriceFixing}
+            update := bson.M{
+                "$push": bson.M{"flags": flags[len(flags) - 1]},
+                "$set": bson.M{"flagged": true},
+            }
+            if _, err = db.Collection("listings").UpdateMany(ctx, filter, update); err != nil {
+                return nil, err
+            }
+        }
+    }
+
+    return flags, nil
+}
+
+// flagListing runs the price anomaly checks on a listing and stores the result in its
+// flags, replacing any flags from an earlier version of the listing. The listing
+// document passed in is updated to match.
+func flagListing(ctx context.Context, db mongo.Database, listing bson.M) error {
+    flags, err := detectPriceAnomalies(ctx, db, listing)
+    if err != nil {
+        return err
+    }
+    if flags == nil {
+        flags = make([]bson.M, 0)
+    }
+    update := bson.M{"$set": bson.M{"flags": flags, "flagged": len(flags) > 0}}
+    _, err = db.Collection("listings").UpdateOne(ctx, bson.M{"_id": listing["_id"]}, update)
+    if err != nil {
+        return err
+    }
+    listing["flags"] = flags
+    listing["flagged"] = len(flags) > 0
+    return nil
+}
+
+// recheckPriceFixing is for when a listing stops asking a price, because its price
+// changed or it was taken down. If that leaves fewer than PriceFixingMinListings open
+// listings from different sellers asking the price, the price fixing flags of the
+// cluster are taken off again, including those of the listing itself.
+func recheckPriceFixing(ctx context.Context, db mongo.Database, listing bson.M, price interface{}) error {
+    if price == nil || listing["bundle"] == true {
+        return nil
+    }
+    listingsCollection := db.Collection("listings")
+    cluster := bson.M{
+        "item": listing["item"],
+        "variation": listing["variation"],
+        "price": price,
+        "bundle": bson.M{"$ne": true},
+        "accepted": nil,
+    }
+    open := bson.M{"deleted": bson.M{"$ne": true}, "expired": bson.M{"$ne": true}}
+    for key, val := range cluster {
+        open[key] = val
+    }
+    sellers, err := listingsCollection.Distinct(ctx, "seller", open)
+    if err != nil {
+        return err
+    }
+    if len(sellers) >= PriceFixingMinListings {
+        return nil
+    }
+    cluster["flags.kind"] = ListingFlagPriceFixing
+    update := bson.M{"$pull": bson.M{"flags": bson.M{"kind": ListingFlagPriceFixing}}}
+    if _, err = listingsCollection.UpdateMany(ctx, cluster, update); err != nil {
+        return err
+    }
+    delete(cluster, "flags.kind")
+    cluster["flagged"] = true
+    cluster["flags"] = bson.M{"$size": 0}
+    _, err = listingsCollection.UpdateMany(ctx, cluster, bson.M{"$set": bson.M{"flagged": false}})
+    return err
+}
+
+// FlaggedListings is an admin query for listings whose prices were flagged, newest first.
+func FlaggedListings(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: graphql.NewList(FlaggedListingType),
+        Description: "Get listings with flagged prices",
+        Args: graphql.FieldConfigArgument {
+            "adminID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "kind": &graphql.ArgumentConfig {
+                Type: ListingFlagKindEnum,
+                DefaultValue: nil,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            timeout, cancel := context.WithTimeout(ctx, time.Second * 3)
+            defer cancel()
+
+            if err := requireAdmin(timeout, db, p.Args["adminID"]); err != nil {
+                return nil, err
+            }
+
+            filter := bson.M{"flagged": true}
+            if kind, prs := p.Args["kind"]; prs && kind != nil {
+                filter["flags.kind"] = kind
+            }
+            opts := options.Find().SetSort(bson.M{"_id": -1})
+            cursor, err := db.Collection("listings").Find(timeout, filter, opts)
+            if err != nil {
+                return nil, err
+            }
+            defer cursor.Close(timeout)
+            listings := make([]bson.M, 0)
+            for cursor.Next(timeout) {
+                var listing bson.M
+                if err = cursor.Decode(&listing); err != nil {
+                    return nil, err
+                }
+                listings = append(listings, listing)
+            }
+            if err := cursor.Err(); err != nil {
+                return nil, err
+            }
+            return listings, nil
+        },
+    }
+}
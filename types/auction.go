@@ -0,0 +1,456 @@
+package types
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "github.com/graphql-go/graphql"
+)
+
+// AuctionCloseInterval is how often ended auctions are looked for.
+var AuctionCloseInterval = time.Minute
+
+// MaxAuctionLength is the longest an auction can run for.
+var MaxAuctionLength = 14 * 24 * time.Hour
+
+// Values of ListingModeEnum
+const (
+    ListingModeFixed = "FIXED"
+    ListingModeAuction = "AUCTION"
+)
+
+// ListingModeEnum is how the price of a listing is decided
+var ListingModeEnum = graphql.NewEnum(
+    graphql.EnumConfig {
+        Name: "ListingMode",
+        Values: graphql.EnumValueConfigMap {
+            ListingModeFixed: &graphql.EnumValueConfig {
+                Value: ListingModeFixed,
+                Description: "The seller asks a fixed price",
+            },
+            ListingModeAuction: &graphql.EnumValueConfig {
+                Value: ListingModeAuction,
+                Description: "The highest bid when the auction ends wins",
+            },
+        },
+    },
+)
+
+// AuctionType is the auction field of a listing in AUCTION mode
+var AuctionType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "Auction",
+        Fields: graphql.Fields {
+            "startPrice": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "reservePrice": &graphql.Field {
+                Type: graphql.Int,
+                Description: "Only the seller can see the reserve price",
+                Args: graphql.FieldConfigArgument {
+                    "viewerID": &graphql.ArgumentConfig {
+                        Type: graphql.ID,
+                    },
+                },
+                Resolve: reservePriceResolver,
+            },
+            "reserveMet": &graphql.Field {
+                Type: graphql.Boolean,
+                Description: "Whether the high bid meets the reserve price, or there is no reserve",
+                Resolve: reserveMetResolver,
+            },
+            "minIncrement": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "endsAt": &graphql.Field {
+                Type: graphql.String, // TODO Date scalar
+            },
+            "highBid": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "bidCount": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "closed": &graphql.Field {
+                Type: graphql.Boolean,
+            },
+        },
+    },
+)
+
+// BidType corresponds to the "bids" collection
+var BidType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "Bid",
+        Fields: graphql.Fields {
+            "id": &graphql.Field {
+                Type: graphql.ID,
+                Resolve: idResolver,
+            },
+            "created": &graphql.Field {
+                Type: graphql.String,
+                Resolve: timestampResolver,
+            },
+            "amount": &graphql.Field {
+                Type: graphql.Int,
+            },
+        },
+    },
+)
+
+// auctionResolver gets the auction of a listing, along with its seller so that the
+// fields of the auction can tell who is looking at it.
+func auctionResolver(p graphql.ResolveParams) (interface{}, error) {
+    listing := p.Source.(primitive.M)
+    auction, ok := listing["auction"].(primitive.M)
+    if !ok {
+        return nil, nil
+    }
+    withSeller := bson.M{"seller": listing["seller"]}
+    for key, val := range auction {
+        withSeller[key] = val
+    }
+    return withSeller, nil
+}
+
+// reservePriceResolver gets the reserve price of an auction for its seller. Bidders only
+// get to know whether the reserve was met.
+func reservePriceResolver(p graphql.ResolveParams) (interface{}, error) {
+    auction := p.Source.(primitive.M)
+    viewerID, ok := p.Args["viewerID"].(string)
+    if !ok {
+        return nil, errors.New("Viewer ID not given for reading the reserve price")
+    }
+    viewerObjID, err := primitive.ObjectIDFromHex(viewerID)
+    if err != nil {
+        return nil, err
+    }
+    if viewerObjID != auction["seller"] {
+        return nil, errors.New("Only the seller can see the reserve price")
+    }
+    return auction["reservePrice"], nil
+}
+
+func reserveMetResolver(p graphql.ResolveParams) (interface{}, error) {
+    auction := p.Source.(primitive.M)
+    reservePrice, hasReserve := toInt(auction["reservePrice"])
+    if !hasReserve {
+        return true, nil
+    }
+    highBid, hasBid := toInt(auction["highBid"])
+    return hasBid && highBid >= reservePrice, nil
+}
+
+func InitAuctionType(ctx context.Context, db mongo.Database) {
+    AuctionType.AddFieldConfig("highBidder", &graphql.Field {
+        Type: UserType,
+        Resolve: resolverGenerator(ctx, "highBidder", *db.Collection("users")),
+    })
+    BidType.AddFieldConfig("bidder", &graphql.Field {
+        Type: UserType,
+        Resolve: resolverGenerator(ctx, "bidder", *db.Collection("users")),
+    })
+    BidType.AddFieldConfig("listing", &graphql.Field {
+        Type: ListingType,
+        Resolve: resolverGenerator(ctx, "listing", *db.Collection("listings")),
+    })
+}
+
+// auctionFromArgs builds the auction of a new listing from the arguments of CreateListing.
+func auctionFromArgs(args map[string]interface{}) (bson.M, error) {
+    startPrice, prs := args["startPrice"].(int)
+    if !prs {
+        return nil, errors.New("Start price not given for auction")
+    }
+    if startPrice < 0 || startPrice > 100000000 {
+        return nil, errors.New("Start price must be between 0 and 100 mil")
+    }
+    reservePrice, hasReserve := args["reservePrice"].(int)
+    if hasReserve && (reservePrice < startPrice || reservePrice > 100000000) {
+        return nil, errors.New("Reserve price must be between the start price and 100 mil")
+    }
+    minIncrement, _ := args["minIncrement"].(int)
+    if minIncrement < 1 {
+        return nil, errors.New("Minimum increment must be at least 1")
+    }
+    endsAtArg, prs := args["endsAt"].(string)
+    if !prs {
+        return nil, errors.New("End time not given for auction")
+    }
+    endsAt, err := parseDate(endsAtArg)
+    if err != nil {
+        return nil, err
+    }
+    if !endsAt.After(time.Now()) || endsAt.After(time.Now().Add(MaxAuctionLength)) {
+        return nil, errors.New(fmt.Sprintf("Auction must end within %s from now", MaxAuctionLength))
+    }
+
+    auction := bson.M{
+        "startPrice": startPrice,
+        "reservePrice": nil,
+        "minIncrement": minIncrement,
+        "endsAt": primitive.NewDateTimeFromTime(endsAt),
+        "highBid": nil,
+        "highBidder": nil,
+        "bidCount": 0,
+        "closed": false,
+    }
+    if hasReserve {
+        auction["reservePrice"] = reservePrice
+    }
+    return auction, nil
+}
+
+// PlaceBid bids on an auction. The bid has to be at least the start price, or the
+// current high bid plus the minimum increment. The check and the update are done in
+// a single operation so that two bidders can't both beat the same high bid. The price
+// of the listing follows the high bid, and the bidder who was outbid is notified.
+func PlaceBid(ctx context.Context, db mongo.Database) graphql.Field {
+    listingsCollection := db.Collection("listings")
+    bidsCollection := db.Collection("bids")
+    usersCollection := db.Collection("users")
+
+    return graphql.Field {
+        Type: BidType,
+        Description: "Bid on an auction",
+        Args: graphql.FieldConfigArgument {
+            "listingID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "amount": &graphql.ArgumentConfig {
+                Type: graphql.Int,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            listingID, prs := p.Args["listingID"]
+            if !prs {
+                return nil, errors.New("Listing ID not given for bid")
+            }
+            listingObjID, err := primitive.ObjectIDFromHex(listingID.(string))
+            if err != nil {
+                return nil, err
+            }
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for bid")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
+            amount, prs := p.Args["amount"].(int)
+            if !prs {
+                return nil, errors.New("Amount not given for bid")
+            }
+            if amount < 0 || amount > 100000000 {
+                return nil, errors.New("Amount must be between 0 and 100 mil")
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            var user bson.M
+            err = usersCollection.FindOne(timeout, bson.M{"_id": userObjID}).Decode(&user)
+            if err != nil {
+                return nil, err
+            }
+            if user["banned"] != nil {
+                return nil, errors.New("Banned users cannot bid")
+            }
+
+            now := primitive.NewDateTimeFromTime(time.Now())
+            minBid := bson.M{"$cond": bson.A{
+                bson.M{"$eq": bson.A{"$auction.highBid", nil}},
+                "$auction.startPrice",
+                bson.M{"$add": bson.A{"$auction.highBid", "$auction.minIncrement"}},
+            }}
+            filter := bson.M{
+                "_id": listingObjID,
+                "mode": ListingModeAuction,
+                "seller": bson.M{"$ne": userObjID},
+                "deleted": bson.M{"$ne": true},
+                "auction.closed": false,
+                "auction.endsAt": bson.M{"$gt": now},
+                "$expr": bson.M{"$gte": bson.A{amount, minBid}},
+            }
+            update := bson.M{
+                "$set": bson.M{"auction.highBid": amount, "auction.highBidder": userObjID, "price": amount, "bellPrice": amount},
+                "$inc": bson.M{"auction.bidCount": 1},
+            }
+            var before bson.M
+            err = listingsCollection.FindOneAndUpdate(timeout, filter, update).Decode(&before)
+            if err == mongo.ErrNoDocuments {
+                return nil, bidRejection(timeout, db, listingObjID, userObjID)
+            } else if err != nil {
+                return nil, err
+            }
+
+            res, err := bidsCollection.InsertOne(timeout, bson.M{
+                "amount": amount,
+                "bidder": userObjID,
+                "listing": listingObjID,
+            })
+            if err != nil {
+                return nil, err
+            }
+            var bid bson.M
+            err = bidsCollection.FindOne(timeout, bson.M{"_id": res.InsertedID}).Decode(&bid)
+            if err != nil {
+                return nil, err
+            }
+            err = addToBsonArray(timeout, listingObjID, *listingsCollection, "bids", res.InsertedID)
+            if err != nil {
+                log.Println(err)
+            }
+
+            auction := before["auction"].(primitive.M)
+            if outbid, ok := auction["highBidder"].(primitive.ObjectID); ok && outbid != userObjID {
+                message := fmt.Sprintf("You were outbid, the high bid is now %d", amount)
+                if err = notify(timeout, db, outbid, NotificationOutbid, message, bson.M{"listing": listingObjID}); err != nil {
+                    log.Println(err)
+                }
+            }
+
+            return bid, nil
+        },
+    }
+}
+
+// bidRejection works out why a bid didn't go through, for the error returned to the bidder.
+func bidRejection(ctx context.Context, db mongo.Database, listingObjID primitive.ObjectID, userObjID primitive.ObjectID) error {
+    var listing bson.M
+    err := db.Collection("listings").FindOne(ctx, bson.M{"_id": listingObjID}).Decode(&listing)
+    if err != nil {
+        return err
+    }
+    auction, ok := listing["auction"].(primitive.M)
+    switch {
+    case listing["mode"] != ListingModeAuction || !ok:
+        return errors.New("Listing is not an auction")
+    case listing["seller"] == userObjID:
+        return errors.New("User cannot bid on their own auction")
+    case listing["deleted"] == true || auction["closed"] == true:
+        return errors.New("Auction is closed")
+    case auction["endsAt"].(primitive.DateTime).Time().Before(time.Now()):
+        return errors.New("Auction has ended")
+    }
+    if highBid, ok := toInt(auction["highBid"]); ok {
+        increment, _ := toInt(auction["minIncrement"])
+        return errors.New(fmt.Sprintf("Bid must be at least %d", highBid + increment))
+    }
+    startPrice, _ := toInt(auction["startPrice"])
+    return errors.New(fmt.Sprintf("Bid must be at least the start price of %d", startPrice))
+}
+
+// closeAuctions closes the auctions that have ended. An auction that fails to close is
+// logged and left open to be closed on the next run, without holding up the others.
+func closeAuctions(ctx context.Context, db mongo.Database) error {
+    cursor, err := db.Collection("listings").Find(ctx, bson.M{
+        "mode": ListingModeAuction,
+        "auction.closed": false,
+        "auction.endsAt": bson.M{"$lte": primitive.NewDateTimeFromTime(time.Now())},
+    })
+    if err != nil {
+        return err
+    }
+    defer cursor.Close(ctx)
+    for cursor.Next(ctx) {
+        var listing bson.M
+        if err = cursor.Decode(&listing); err != nil {
+            return err
+        }
+        if err = closeAuction(ctx, db, listing); err != nil {
+            log.Printf("Closing auction %s: %s", listing["_id"].(primitive.ObjectID).Hex(), err)
+        }
+    }
+    if err := cursor.Err(); err != nil {
+        return err
+    }
+    return nil
+}
+
+// closeAuction closes an auction that has ended. If the high bid meets the reserve, the
+// listing is accepted for the high bidder and a transaction is created for them. If that
+// fails, the auction is reopened so that closing it can be tried again. The bidders on an
+// auction that was deleted are told that it ended without a winner.
+func closeAuction(ctx context.Context, db mongo.Database, listing bson.M) error {
+    listingsCollection := db.Collection("listings")
+    listingObjID := listing["_id"].(primitive.ObjectID)
+    sellerObjID := listing["seller"].(primitive.ObjectID)
+    refs := bson.M{"listing": listingObjID}
+
+    // claim the auction so that it is only ever closed once
+    opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+    err := listingsCollection.FindOneAndUpdate(ctx,
+        bson.M{"_id": listingObjID, "auction.closed": false},
+        bson.M{"$set": bson.M{"auction.closed": true}},
+        opts).Decode(&listing)
+    if err == mongo.ErrNoDocuments {
+        return nil
+    } else if err != nil {
+        return err
+    }
+
+    auction := listing["auction"].(primitive.M)
+    highBid, hasBid := toInt(auction["highBid"])
+    reservePrice, hasReserve := toInt(auction["reservePrice"])
+    if listing["deleted"] == true {
+        bidders, err := db.Collection("bids").Distinct(ctx, "bidder", bson.M{"listing": listingObjID})
+        if err != nil {
+            return err
+        }
+        for _, bidder := range bidders {
+            message := "An auction you bid on was taken down before it ended"
+            if err = notify(ctx, db, bidder.(primitive.ObjectID), NotificationAuctionEnded, message, refs); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+    if !hasBid || (hasReserve && highBid < reservePrice) {
+        message := "Your auction ended without a bid meeting the reserve price"
+        if !hasBid {
+            message = "Your auction ended without any bids"
+        }
+        return notify(ctx, db, sellerObjID, NotificationAuctionEnded, message, refs)
+    }
+
+    winnerObjID := auction["highBidder"].(primitive.ObjectID)
+    now := primitive.NewDateTimeFromTime(time.Now())
+    sold := bson.M{"accepted": now, "buyer": winnerObjID}
+    reopen := bson.M{"auction.closed": false, "accepted": nil, "buyer": nil}
+    if lineItems, ok := listing["lineItems"].(primitive.A); ok {
+        sold["lineItems.$[].remaining"] = 0
+        reopen["lineItems"] = lineItems
+    }
+    _, err = listingsCollection.UpdateOne(ctx, bson.M{"_id": listingObjID}, bson.M{"$set": sold})
+    if err != nil {
+        listingsCollection.UpdateOne(ctx, bson.M{"_id": listingObjID}, bson.M{"$set": reopen})
+        return err
+    }
+    transaction, err := createTransaction(ctx, db, listing, winnerObjID, highBid, listingLineItems(listing))
+    if err != nil {
+        listingsCollection.UpdateOne(ctx, bson.M{"_id": listingObjID}, bson.M{"$set": reopen})
+        return err
+    }
+    if err = closeOpenInquiries(ctx, db, listingObjID, InquiryClosedListingSold); err != nil {
+        return err
+    }
+    refs["transaction"] = transaction["_id"]
+    message := fmt.Sprintf("You won the auction with a bid of %d", highBid)
+    if err = notify(ctx, db, winnerObjID, NotificationAuctionWon, message, refs); err != nil {
+        return err
+    }
+    message = fmt.Sprintf("Your auction ended with a winning bid of %d", highBid)
+    return notify(ctx, db, sellerObjID, NotificationAuctionEnded, message, refs)
+}
@@ -0,0 +1,30 @@
+package types
+
+import (
+    "context"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// Values of the action field of an audit log entry
+const (
+    AuditDodoCodeShared = "DODO_CODE_SHARED"
+    AuditDodoCodeRevealed = "DODO_CODE_REVEALED"
+    AuditReviewRemoved = "REVIEW_REMOVED"
+)
+
+// audit records that a user did something sensitive in the "auditlog" collection. Like
+// notify, refs holds the ObjectIDs of the documents the action was on.
+func audit(ctx context.Context, db mongo.Database, action string, userObjID primitive.ObjectID, refs bson.M) error {
+    entry := bson.M{
+        "action": action,
+        "user": userObjID,
+    }
+    for key, val := range refs {
+        entry[key] = val
+    }
+    _, err := db.Collection("auditlog").InsertOne(ctx, entry)
+    return err
+}
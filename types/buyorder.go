@@ -0,0 +1,498 @@
+package types
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "github.com/graphql-go/graphql"
+)
+
+// Values of BuyOrderStatusEnum
+const (
+    BuyOrderOpen = "OPEN"
+    BuyOrderMatched = "MATCHED"
+    BuyOrderCancelled = "CANCELLED"
+)
+
+// BuyOrderStatusEnum is the status of a buy order
+var BuyOrderStatusEnum = graphql.NewEnum(
+    graphql.EnumConfig {
+        Name: "BuyOrderStatus",
+        Values: graphql.EnumValueConfigMap {
+            BuyOrderOpen: &graphql.EnumValueConfig {
+                Value: BuyOrderOpen,
+            },
+            BuyOrderMatched: &graphql.EnumValueConfig {
+                Value: BuyOrderMatched,
+                Description: "A listing at or below the max price was found and an inquiry was made for it",
+            },
+            BuyOrderCancelled: &graphql.EnumValueConfig {
+                Value: BuyOrderCancelled,
+            },
+        },
+    },
+)
+
+// BuyOrderType corresponds to the "buyorders" collection
+var BuyOrderType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "BuyOrder",
+        Fields: graphql.Fields {
+            "id": &graphql.Field {
+                Type: graphql.ID,
+                Resolve: idResolver,
+            },
+            "created": &graphql.Field {
+                Type: graphql.String,
+                Resolve: timestampResolver,
+            },
+            "variation": &graphql.Field {
+                Type: graphql.String,
+                Description: "The variation wanted, or null if any variation will do",
+            },
+            "maxPrice": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "status": &graphql.Field {
+                Type: BuyOrderStatusEnum,
+            },
+            "matched": &graphql.Field {
+                Type: graphql.String, // TODO Date scalar
+            },
+        },
+    },
+)
+
+// DepthLevelType is a price level of a market depth
+var DepthLevelType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "DepthLevel",
+        Fields: graphql.Fields {
+            "price": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "count": &graphql.Field {
+                Type: graphql.Int,
+            },
+        },
+    },
+)
+
+// MarketDepthType is the order book of an item. It is not stored in the database.
+var MarketDepthType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "MarketDepth",
+        Fields: graphql.Fields {
+            "bids": &graphql.Field {
+                Type: graphql.NewList(DepthLevelType),
+                Description: "Open buy orders by max price, highest first",
+            },
+            "asks": &graphql.Field {
+                Type: graphql.NewList(DepthLevelType),
+                Description: "Open fixed price listings by price, lowest first",
+            },
+        },
+    },
+)
+
+func InitBuyOrderType(ctx context.Context, db mongo.Database) {
+    BuyOrderType.AddFieldConfig("item", &graphql.Field {
+        Type: ItemType,
+        Resolve: resolverGenerator(ctx, "item", *db.Collection("items")),
+    })
+    BuyOrderType.AddFieldConfig("buyer", &graphql.Field {
+        Type: UserType,
+        Resolve: resolverGenerator(ctx, "buyer", *db.Collection("users")),
+    })
+    BuyOrderType.AddFieldConfig("matchedListing", &graphql.Field {
+        Type: ListingType,
+        Resolve: resolverGenerator(ctx, "matchedListing", *db.Collection("listings")),
+    })
+    BuyOrderType.AddFieldConfig("inquiry", &graphql.Field {
+        Type: ListingInquiryType,
+        Resolve: resolverGenerator(ctx, "inquiry", *db.Collection("inquiries")),
+    })
+}
+
+// openAsksFilter matches the listings that can fill buy orders for an item: open, fixed
+// price listings of a single unit in bells, of the variation if one is given.
+func openAsksFilter(itemObjID primitive.ObjectID, variation interface{}) bson.M {
+    filter := bson.M{
+        "item": itemObjID,
+        "mode": bson.M{"$ne": ListingModeAuction},
+        "price": bson.M{"$ne": nil},
+        "bundle": bson.M{"$ne": true},
+        "accepted": nil,
+        "deleted": bson.M{"$ne": true},
+        "expired": bson.M{"$ne": true},
+    }
+    if variation != nil {
+        filter["variation"] = variation
+    }
+    return filter
+}
+
+// fillBuyOrder claims an open buy order for a listing, makes an inquiry offering the
+// listing's price on behalf of the buyer and lets both sides know. It returns false if
+// the order was no longer open, or the buyer already had an open inquiry on the listing.
+func fillBuyOrder(ctx context.Context, db mongo.Database, order bson.M, listing bson.M) (bool, error) {
+    ordersCollection := db.Collection("buyorders")
+    orderObjID := order["_id"].(primitive.ObjectID)
+    listingObjID := listing["_id"].(primitive.ObjectID)
+    buyerObjID := order["buyer"].(primitive.ObjectID)
+
+    count, err := db.Collection("inquiries").CountDocuments(ctx, bson.M{"listing": listingObjID, "buyer": buyerObjID, "open": true})
+    if err != nil || count > 0 {
+        return false, err
+    }
+
+    filter := bson.M{"_id": orderObjID, "status": BuyOrderOpen}
+    update := bson.M{"$set": bson.M{
+        "status": BuyOrderMatched,
+        "matched": primitive.NewDateTimeFromTime(time.Now()),
+        "matchedListing": listingObjID,
+    }}
+    res, err := ordersCollection.UpdateOne(ctx, filter, update)
+    if err != nil || res.ModifiedCount == 0 {
+        return false, err
+    }
+
+    price, _ := toInt(listing["price"])
+    maxPrice, _ := toInt(order["maxPrice"])
+    note := fmt.Sprintf("Made automatically from a buy order for up to %d", maxPrice)
+    inquiry, err := insertInquiry(ctx, db, listingObjID, buyerObjID, note, nil, price)
+    if err != nil {
+        ordersCollection.UpdateOne(ctx, bson.M{"_id": orderObjID}, bson.M{"$set": bson.M{
+            "status": BuyOrderOpen,
+            "matched": nil,
+            "matchedListing": nil,
+        }})
+        return false, err
+    }
+    _, err = ordersCollection.UpdateOne(ctx, bson.M{"_id": orderObjID}, bson.M{"$set": bson.M{"inquiry": inquiry["_id"]}})
+    if err != nil {
+        return false, err
+    }
+
+    refs := bson.M{"listing": listingObjID, "inquiry": inquiry["_id"]}
+    message := fmt.Sprintf("Your buy order was matched with a listing for %d", price)
+    if err = notify(ctx, db, buyerObjID, NotificationOrderMatched, message, refs); err != nil {
+        log.Println(err)
+    }
+    message = fmt.Sprintf("A buy order for up to %d was matched with your listing", maxPrice)
+    if err = notify(ctx, db, listing["seller"].(primitive.ObjectID), NotificationOrderMatched, message, refs); err != nil {
+        log.Println(err)
+    }
+    return true, nil
+}
+
+// matchListing looks for an open buy order that a new fixed price listing crosses, i.e.
+// one with a max price at or above the listing's price. The highest bid wins, and the
+// oldest one among equal bids.
+func matchListing(ctx context.Context, db mongo.Database, listing bson.M) error {
+    filter := bson.M{
+        "item": listing["item"],
+        "variation": bson.M{"$in": bson.A{nil, listing["variation"]}},
+        "maxPrice": bson.M{"$gte": listing["price"]},
+        "buyer": bson.M{"$ne": listing["seller"]},
+        "status": BuyOrderOpen,
+    }
+    opts := options.Find().SetSort(bson.D{{Key: "maxPrice", Value: -1}, {Key: "_id", Value: 1}})
+    cursor, err := db.Collection("buyorders").Find(ctx, filter, opts)
+    if err != nil {
+        return err
+    }
+    defer cursor.Close(ctx)
+    for cursor.Next(ctx) {
+        var order bson.M
+        if err = cursor.Decode(&order); err != nil {
+            return err
+        }
+        filled, err := fillBuyOrder(ctx, db, order, listing)
+        if err != nil || filled {
+            return err
+        }
+    }
+    if err := cursor.Err(); err != nil {
+        return err
+    }
+    return nil
+}
+
+// matchBuyOrder looks for an open listing that a new buy order crosses, i.e. one priced
+// at or below the order's max price. The cheapest listing wins, and the oldest one among
+// equal prices.
+func matchBuyOrder(ctx context.Context, db mongo.Database, order bson.M) error {
+    filter := openAsksFilter(order["item"].(primitive.ObjectID), order["variation"])
+    filter["price"] = bson.M{"$lte": order["maxPrice"]}
+    filter["seller"] = bson.M{"$ne": order["buyer"]}
+    opts := options.Find().SetSort(bson.D{{Key: "price", Value: 1}, {Key: "_id", Value: 1}})
+    cursor, err := db.Collection("listings").Find(ctx, filter, opts)
+    if err != nil {
+        return err
+    }
+    defer cursor.Close(ctx)
+    for cursor.Next(ctx) {
+        var listing bson.M
+        if err = cursor.Decode(&listing); err != nil {
+            return err
+        }
+        filled, err := fillBuyOrder(ctx, db, order, listing)
+        if err != nil || filled {
+            return err
+        }
+    }
+    if err := cursor.Err(); err != nil {
+        return err
+    }
+    return nil
+}
+
+// CreateBuyOrder creates an order to buy an item for up to a max price. If an open
+// listing already crosses the order, it is matched straight away. Orders are only matched
+// with fixed price listings of a single unit priced in bells; bundles and listings asking
+// for Nook Miles Tickets or items never fill an order.
+func CreateBuyOrder(ctx context.Context, db mongo.Database) graphql.Field {
+    itemsCollection := db.Collection("items")
+    ordersCollection := db.Collection("buyorders")
+    usersCollection := db.Collection("users")
+
+    return graphql.Field {
+        Type: BuyOrderType,
+        Description: "Create a buy order",
+        Args: graphql.FieldConfigArgument {
+            "itemID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "variation": &graphql.ArgumentConfig {
+                Type: graphql.String,
+                DefaultValue: nil,
+            },
+            "maxPrice": &graphql.ArgumentConfig {
+                Type: graphql.Int,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            itemID, prs := p.Args["itemID"]
+            if !prs {
+                return nil, errors.New("Item ID not given for buy order creation")
+            }
+            itemObjID, err := primitive.ObjectIDFromHex(itemID.(string))
+            if err != nil {
+                return nil, err
+            }
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for buy order creation")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
+            maxPrice, prs := p.Args["maxPrice"].(int)
+            if !prs {
+                return nil, errors.New("Max price not given for buy order creation")
+            }
+            if maxPrice < 0 || maxPrice > 100000000 {
+                return nil, errors.New("Max price must be between 0 and 100 mil")
+            }
+            variation := p.Args["variation"]
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second * 3)
+            defer cancel()
+
+            var item bson.M
+            err = itemsCollection.FindOne(timeout, bson.M{"_id": itemObjID}).Decode(&item)
+            if err != nil {
+                return nil, err
+            }
+            if variation != nil {
+                if err = validateVariation(item, variation); err != nil {
+                    return nil, err
+                }
+            }
+
+            var user bson.M
+            err = usersCollection.FindOne(timeout, bson.M{"_id": userObjID}).Decode(&user)
+            if err != nil {
+                return nil, err
+            }
+            if user["banned"] != nil {
+                return nil, errors.New("Banned users cannot create buy orders")
+            }
+
+            res, err := ordersCollection.InsertOne(timeout, bson.M{
+                "item": itemObjID,
+                "variation": variation,
+                "maxPrice": maxPrice,
+                "buyer": userObjID,
+                "status": BuyOrderOpen,
+                "matched": nil,
+                "matchedListing": nil,
+                "inquiry": nil,
+            })
+            if err != nil {
+                return nil, err
+            }
+            err = addToBsonArray(timeout, userObjID, *usersCollection, "buyOrders", res.InsertedID)
+            if err != nil {
+                ordersCollection.DeleteOne(timeout, bson.M{"_id": res.InsertedID})
+                return nil, err
+            }
+
+            var order bson.M
+            err = ordersCollection.FindOne(timeout, bson.M{"_id": res.InsertedID}).Decode(&order)
+            if err != nil {
+                return nil, err
+            }
+            if err = matchBuyOrder(timeout, db, order); err != nil {
+                log.Println(err)
+            }
+            err = ordersCollection.FindOne(timeout, bson.M{"_id": res.InsertedID}).Decode(&order)
+            if err != nil {
+                return nil, err
+            }
+            return order, nil
+        },
+    }
+}
+
+// CancelBuyOrder cancels an open buy order. Only the buyer can cancel their order.
+func CancelBuyOrder(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: BuyOrderType,
+        Description: "Cancel a buy order",
+        Args: graphql.FieldConfigArgument {
+            "buyOrderID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            orderID, prs := p.Args["buyOrderID"]
+            if !prs {
+                return nil, errors.New("Buy order ID not given for cancellation")
+            }
+            orderObjID, err := primitive.ObjectIDFromHex(orderID.(string))
+            if err != nil {
+                return nil, err
+            }
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for buy order cancellation")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            filter := bson.M{"_id": orderObjID, "buyer": userObjID, "status": BuyOrderOpen}
+            update := bson.M{"$set": bson.M{"status": BuyOrderCancelled}}
+            opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+            var order bson.M
+            err = db.Collection("buyorders").FindOneAndUpdate(timeout, filter, update, opts).Decode(&order)
+            if err == mongo.ErrNoDocuments {
+                return nil, errors.New("No open buy order by the user found")
+            } else if err != nil {
+                return nil, err
+            }
+            return order, nil
+        },
+    }
+}
+
+// depthLevels runs a pipeline and groups the prices it ends with into levels, sorted in
+// the given direction.
+func depthLevels(ctx context.Context, coll mongo.Collection, pipeline []bson.M, direction int) ([]bson.M, error) {
+    pipeline = append(pipeline,
+        bson.M{"$group": bson.M{"_id": "$price", "count": bson.M{"$sum": 1}}},
+        bson.M{"$sort": bson.M{"_id": direction}},
+        bson.M{"$project": bson.M{"_id": 0, "price": "$_id", "count": 1}},
+    )
+    cursor, err := coll.Aggregate(ctx, pipeline)
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+    levels := make([]bson.M, 0)
+    for cursor.Next(ctx) {
+        var level bson.M
+        if err = cursor.Decode(&level); err != nil {
+            return nil, err
+        }
+        levels = append(levels, level)
+    }
+    if err := cursor.Err(); err != nil {
+        return nil, err
+    }
+    return levels, nil
+}
+
+// MarketDepth is a query for the order book of an item: the open buy orders and the
+// open fixed price listings, grouped by price. If a variation is given, buy orders that
+// accept any variation are included in its bids.
+func MarketDepth(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: MarketDepthType,
+        Description: "Get the order book of an item",
+        Args: graphql.FieldConfigArgument {
+            "itemID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "variation": &graphql.ArgumentConfig {
+                Type: graphql.String,
+                DefaultValue: nil,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            itemID, prs := p.Args["itemID"]
+            if !prs {
+                return nil, errors.New("Item ID not given for market depth")
+            }
+            itemObjID, err := primitive.ObjectIDFromHex(itemID.(string))
+            if err != nil {
+                return nil, err
+            }
+            variation := p.Args["variation"]
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second * 3)
+            defer cancel()
+
+            ordersMatch := bson.M{"item": itemObjID, "status": BuyOrderOpen}
+            if variation != nil {
+                ordersMatch["variation"] = bson.M{"$in": bson.A{nil, variation}}
+            }
+            bids, err := depthLevels(timeout, *db.Collection("buyorders"), []bson.M{
+                {"$match": ordersMatch},
+                {"$project": bson.M{"price": "$maxPrice"}},
+            }, -1)
+            if err != nil {
+                return nil, err
+            }
+
+            asks, err := depthLevels(timeout, *db.Collection("listings"), []bson.M{
+                {"$match": openAsksFilter(itemObjID, variation)},
+            }, 1)
+            if err != nil {
+                return nil, err
+            }
+
+            return bson.M{"bids": bids, "asks": asks}, nil
+        },
+    }
+}
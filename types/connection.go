@@ -0,0 +1,124 @@
+package types
+
+import (
+    "encoding/base64"
+    "errors"
+    "strconv"
+    "strings"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "github.com/graphql-go/graphql"
+)
+
+// maxPageSize is the most nodes a single page of a connection can hold.
+const maxPageSize = 100
+
+// PageInfoType is the pagination info of every connection
+var PageInfoType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "PageInfo",
+        Fields: graphql.Fields {
+            "hasNextPage": &graphql.Field {
+                Type: graphql.Boolean,
+            },
+            "endCursor": &graphql.Field {
+                Type: graphql.String,
+            },
+        },
+    },
+)
+
+// connectionType makes the type of a paginated list of nodes, in the shape of a Relay
+// connection. Values of the type are made by newConnection.
+func connectionType(name string, nodeType graphql.Output) *graphql.Object {
+    edgeType := graphql.NewObject(
+        graphql.ObjectConfig {
+            Name: name + "Edge",
+            Fields: graphql.Fields {
+                "cursor": &graphql.Field {
+                    Type: graphql.String,
+                },
+                "node": &graphql.Field {
+                    Type: nodeType,
+                },
+            },
+        },
+    )
+    return graphql.NewObject(
+        graphql.ObjectConfig {
+            Name: name + "Connection",
+            Fields: graphql.Fields {
+                "edges": &graphql.Field {
+                    Type: graphql.NewList(edgeType),
+                },
+                "pageInfo": &graphql.Field {
+                    Type: PageInfoType,
+                },
+                "totalCount": &graphql.Field {
+                    Type: graphql.Int,
+                },
+            },
+        },
+    )
+}
+
+// connectionArgs adds the pagination arguments of a connection to a field's arguments.
+func connectionArgs(args graphql.FieldConfigArgument) graphql.FieldConfigArgument {
+    args["first"] = &graphql.ArgumentConfig {
+        Type: graphql.Int,
+        DefaultValue: 20,
+    }
+    args["after"] = &graphql.ArgumentConfig {
+        Type: graphql.String,
+        DefaultValue: nil,
+    }
+    return args
+}
+
+// encodeCursor turns an offset into the list into an opaque cursor.
+func encodeCursor(offset int) string {
+    return base64.StdEncoding.EncodeToString([]byte("offset:" + strconv.Itoa(offset)))
+}
+
+// pageArgs reads the pagination arguments of a connection, returning how many nodes
+// to skip and how many to return.
+func pageArgs(p graphql.ResolveParams) (int, int, error) {
+    first, _ := p.Args["first"].(int)
+    if first < 1 || first > maxPageSize {
+        return 0, 0, errors.New("'first' must be between 1 and 100")
+    }
+    after, _ := p.Args["after"].(string)
+    if after == "" {
+        return 0, first, nil
+    }
+    decoded, err := base64.StdEncoding.DecodeString(after)
+    if err != nil || !strings.HasPrefix(string(decoded), "offset:") {
+        return 0, 0, errors.New("Invalid cursor")
+    }
+    offset, err := strconv.Atoi(strings.TrimPrefix(string(decoded), "offset:"))
+    if err != nil || offset < 0 {
+        return 0, 0, errors.New("Invalid cursor")
+    }
+    return offset + 1, first, nil
+}
+
+// newConnection builds a connection value from a page of nodes starting at skip, out of
+// total nodes in the whole list.
+func newConnection(nodes []bson.M, skip int, total int) bson.M {
+    edges := make([]bson.M, len(nodes))
+    for i, node := range nodes {
+        edges[i] = bson.M{"cursor": encodeCursor(skip + i), "node": node}
+    }
+    var endCursor interface{}
+    if len(edges) > 0 {
+        endCursor = edges[len(edges) - 1]["cursor"]
+    }
+    return bson.M{
+        "edges": edges,
+        "pageInfo": bson.M{
+            "hasNextPage": skip + len(nodes) < total,
+            "endCursor": endCursor,
+        },
+        "totalCount": total,
+    }
+}
@@ -0,0 +1,460 @@
+package types
+
+import (
+    "context"
+    "errors"
+    "log"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "github.com/graphql-go/graphql"
+)
+
+// DisputeLossPenalty is how much reputation the losing side of a dispute loses.
+var DisputeLossPenalty = 10
+
+// maxDisputeTextLength is the longest the reason and evidence of a dispute can be.
+const maxDisputeTextLength = 2000
+
+// Values of the status field of a dispute
+const (
+    DisputeStatusOpen = "OPEN"
+    DisputeStatusResolved = "RESOLVED"
+)
+
+// Values of the outcome field of a dispute
+const (
+    DisputeOutcomeFavorBuyer = "FAVOR_BUYER"
+    DisputeOutcomeFavorSeller = "FAVOR_SELLER"
+    DisputeOutcomeMutual = "MUTUAL"
+)
+
+var DisputeStatusEnum = graphql.NewEnum(
+    graphql.EnumConfig {
+        Name: "DisputeStatus",
+        Values: graphql.EnumValueConfigMap {
+            DisputeStatusOpen: &graphql.EnumValueConfig {
+                Value: DisputeStatusOpen,
+            },
+            DisputeStatusResolved: &graphql.EnumValueConfig {
+                Value: DisputeStatusResolved,
+            },
+        },
+    },
+)
+
+var DisputeOutcomeEnum = graphql.NewEnum(
+    graphql.EnumConfig {
+        Name: "DisputeOutcome",
+        Values: graphql.EnumValueConfigMap {
+            DisputeOutcomeFavorBuyer: &graphql.EnumValueConfig {
+                Value: DisputeOutcomeFavorBuyer,
+                Description: "The buyer was wronged, and the transaction fails",
+            },
+            DisputeOutcomeFavorSeller: &graphql.EnumValueConfig {
+                Value: DisputeOutcomeFavorSeller,
+                Description: "The seller was wronged, and the transaction completes",
+            },
+            DisputeOutcomeMutual: &graphql.EnumValueConfig {
+                Value: DisputeOutcomeMutual,
+                Description: "Neither side is at fault, and the transaction fails",
+            },
+        },
+    },
+)
+
+// DisputeType corresponds to the "disputes" collection
+var DisputeType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "Dispute",
+        Fields: graphql.Fields {
+            "id": &graphql.Field {
+                Type: graphql.ID,
+                Resolve: idResolver,
+            },
+            "created": &graphql.Field {
+                Type: graphql.String,
+                Resolve: timestampResolver,
+            },
+            "reason": &graphql.Field {
+                Type: graphql.String,
+            },
+            "evidence": &graphql.Field {
+                Type: graphql.String,
+            },
+            "status": &graphql.Field {
+                Type: DisputeStatusEnum,
+            },
+            "outcome": &graphql.Field {
+                Type: DisputeOutcomeEnum,
+            },
+            "adminNote": &graphql.Field {
+                Type: graphql.String,
+            },
+            "resolved": &graphql.Field {
+                Type: graphql.String, // TODO Date scalar
+            },
+            "bannedLoser": &graphql.Field {
+                Type: graphql.Boolean,
+            },
+        },
+    },
+)
+
+var DisputeConnectionType = connectionType("Dispute", DisputeType)
+
+func InitDisputeType(ctx context.Context, db mongo.Database) {
+    DisputeType.AddFieldConfig("transaction", &graphql.Field {
+        Type: TransactionType,
+        Resolve: resolverGenerator(ctx, "transaction", *db.Collection("transactions")),
+    })
+    DisputeType.AddFieldConfig("openedBy", &graphql.Field {
+        Type: UserType,
+        Description: "Who opened the dispute, or null if it was opened because of a deadline",
+        Resolve: resolverGenerator(ctx, "openedBy", *db.Collection("users")),
+    })
+    DisputeType.AddFieldConfig("loser", &graphql.Field {
+        Type: UserType,
+        Description: "The side the dispute was decided against, null for a mutual outcome",
+        Resolve: resolverGenerator(ctx, "loser", *db.Collection("users")),
+    })
+    DisputeType.AddFieldConfig("resolvedBy", &graphql.Field {
+        Type: UserType,
+        Resolve: resolverGenerator(ctx, "resolvedBy", *db.Collection("users")),
+    })
+    TransactionType.AddFieldConfig("dispute", &graphql.Field {
+        Type: DisputeType,
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+            var dispute bson.M
+            err := db.Collection("disputes").FindOne(timeout, bson.M{"transaction": p.Source.(primitive.M)["_id"]}).Decode(&dispute)
+            if err == mongo.ErrNoDocuments {
+                return nil, nil
+            } else if err != nil {
+                return nil, err
+            }
+            return dispute, nil
+        },
+    })
+}
+
+// insertDispute opens a dispute on a transaction. There can only be one dispute per
+// transaction, which the unique index made by EnsureIndexes enforces.
+func insertDispute(ctx context.Context, db mongo.Database, transactionObjID primitive.ObjectID, openedBy interface{}, reason string, evidence interface{}) (bson.M, error) {
+    dispute := bson.M{
+        "transaction": transactionObjID,
+        "openedBy": openedBy,
+        "reason": reason,
+        "evidence": evidence,
+        "status": DisputeStatusOpen,
+        "outcome": nil,
+        "adminNote": nil,
+        "resolvedBy": nil,
+        "resolved": nil,
+        "bannedLoser": false,
+        "loser": nil,
+    }
+    res, err := db.Collection("disputes").InsertOne(ctx, dispute)
+    if isDuplicateKey(err) {
+        return nil, errors.New("Transaction is already disputed")
+    } else if err != nil {
+        return nil, err
+    }
+    dispute["_id"] = res.InsertedID
+    return dispute, nil
+}
+
+// OpenDispute disputes a transaction that is in progress or failed, for an admin to
+// decide on.
+func OpenDispute(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: DisputeType,
+        Description: "Dispute a transaction",
+        Args: graphql.FieldConfigArgument {
+            "transactionID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "reason": &graphql.ArgumentConfig {
+                Type: graphql.String,
+            },
+            "evidence": &graphql.ArgumentConfig {
+                Type: graphql.String,
+                DefaultValue: nil,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            transactionID, prs := p.Args["transactionID"]
+            if !prs {
+                return nil, errors.New("Transaction ID not given for dispute")
+            }
+            transactionObjID, err := primitive.ObjectIDFromHex(transactionID.(string))
+            if err != nil {
+                return nil, err
+            }
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for dispute")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
+            reason, _ := p.Args["reason"].(string)
+            if reason == "" {
+                return nil, errors.New("Reason not given for dispute")
+            }
+            evidence := p.Args["evidence"]
+            if len(reason) > maxDisputeTextLength {
+                return nil, errors.New("Reason is too long")
+            }
+            if e, ok := evidence.(string); ok && len(e) > maxDisputeTextLength {
+                return nil, errors.New("Evidence is too long")
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            transactionsCollection := db.Collection("transactions")
+            var transaction bson.M
+            err = transactionsCollection.FindOne(timeout, bson.M{"_id": transactionObjID}).Decode(&transaction)
+            if err != nil {
+                return nil, err
+            }
+            var other primitive.ObjectID
+            switch userObjID {
+            case transaction["buyer"]:
+                other = transaction["seller"].(primitive.ObjectID)
+            case transaction["seller"]:
+                other = transaction["buyer"].(primitive.ObjectID)
+            default:
+                return nil, errors.New("Only the buyer and seller can dispute a transaction")
+            }
+
+            dispute, err := insertDispute(timeout, db, transactionObjID, userObjID, reason, evidence)
+            if err != nil {
+                return nil, err
+            }
+            filter := bson.M{
+                "_id": transactionObjID,
+                "state": bson.M{"$in": bson.A{TransactionStateInProgress, TransactionStateFailed}},
+            }
+            update := bson.M{"$set": bson.M{
+                "state": TransactionStateDisputed,
+                "unhappyUser": userObjID,
+                "settled": primitive.NewDateTimeFromTime(time.Now()),
+            }}
+            res, err := transactionsCollection.UpdateOne(timeout, filter, update)
+            if err == nil && res.MatchedCount == 0 {
+                err = errors.New("Only transactions in progress or failed can be disputed")
+            }
+            if err != nil {
+                db.Collection("disputes").DeleteOne(timeout, bson.M{"_id": dispute["_id"]})
+                return nil, err
+            }
+
+            refs := bson.M{"transaction": transactionObjID}
+            if err = notify(timeout, db, other, NotificationTransactionDisputed, "Your trade was disputed and will be looked at by an admin", refs); err != nil {
+                log.Println(err)
+            }
+
+            return dispute, nil
+        },
+    }
+}
+
+// Disputes gets disputes for admins to look at, oldest first.
+func Disputes(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: DisputeConnectionType,
+        Description: "Get disputes, for admins",
+        Args: connectionArgs(graphql.FieldConfigArgument {
+            "adminID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "status": &graphql.ArgumentConfig {
+                Type: DisputeStatusEnum,
+                DefaultValue: DisputeStatusOpen,
+            },
+        }),
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            skip, limit, err := pageArgs(p)
+            if err != nil {
+                return nil, err
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second * 3)
+            defer cancel()
+
+            if err := requireAdmin(timeout, db, p.Args["adminID"]); err != nil {
+                return nil, err
+            }
+
+            disputesCollection := db.Collection("disputes")
+            filter := bson.M{}
+            if status, ok := p.Args["status"].(string); ok {
+                filter["status"] = status
+            }
+            total, err := disputesCollection.CountDocuments(timeout, filter)
+            if err != nil {
+                return nil, err
+            }
+            opts := options.Find().SetSort(bson.M{"_id": 1}).SetSkip(int64(skip)).SetLimit(int64(limit))
+            cursor, err := disputesCollection.Find(timeout, filter, opts)
+            if err != nil {
+                return nil, err
+            }
+            defer cursor.Close(timeout)
+            disputes := make([]bson.M, 0)
+            for cursor.Next(timeout) {
+                var dispute bson.M
+                if err = cursor.Decode(&dispute); err != nil {
+                    return nil, err
+                }
+                disputes = append(disputes, dispute)
+            }
+            if err := cursor.Err(); err != nil {
+                return nil, err
+            }
+            return newConnection(disputes, skip, int(total)), nil
+        },
+    }
+}
+
+// ResolveDispute records an admin's decision on an open dispute. Deciding for the seller
+// completes the transaction and any other outcome fails it. The losing side loses
+// reputation, and can be banned straight away.
+func ResolveDispute(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: DisputeType,
+        Description: "Resolve a dispute, for admins",
+        Args: graphql.FieldConfigArgument {
+            "disputeID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "adminID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "outcome": &graphql.ArgumentConfig {
+                Type: DisputeOutcomeEnum,
+            },
+            "note": &graphql.ArgumentConfig {
+                Type: graphql.String,
+                DefaultValue: nil,
+            },
+            "banLoser": &graphql.ArgumentConfig {
+                Type: graphql.Boolean,
+                DefaultValue: false,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            disputeID, prs := p.Args["disputeID"]
+            if !prs {
+                return nil, errors.New("Dispute ID not given for resolving a dispute")
+            }
+            disputeObjID, err := primitive.ObjectIDFromHex(disputeID.(string))
+            if err != nil {
+                return nil, err
+            }
+            outcome, ok := p.Args["outcome"].(string)
+            if !ok {
+                return nil, errors.New("Outcome not given for resolving a dispute")
+            }
+            banLoser, _ := p.Args["banLoser"].(bool)
+            if banLoser && outcome == DisputeOutcomeMutual {
+                return nil, errors.New("There is no losing side to ban in a mutual outcome")
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second * 3)
+            defer cancel()
+
+            if err = requireAdmin(timeout, db, p.Args["adminID"]); err != nil {
+                return nil, err
+            }
+            adminObjID, _ := primitive.ObjectIDFromHex(p.Args["adminID"].(string))
+
+            filter := bson.M{"_id": disputeObjID, "status": DisputeStatusOpen}
+            var open bson.M
+            err = db.Collection("disputes").FindOne(timeout, filter).Decode(&open)
+            if err == mongo.ErrNoDocuments {
+                return nil, errors.New("Dispute not found or already resolved")
+            } else if err != nil {
+                return nil, err
+            }
+            var transaction bson.M
+            err = db.Collection("transactions").FindOne(timeout, bson.M{"_id": open["transaction"]}).Decode(&transaction)
+            if err != nil {
+                return nil, err
+            }
+            state := TransactionStateFailed
+            var loser interface{}
+            switch outcome {
+            case DisputeOutcomeFavorBuyer:
+                loser = transaction["seller"]
+            case DisputeOutcomeFavorSeller:
+                state = TransactionStateCompleted
+                loser = transaction["buyer"]
+            }
+
+            // ban before resolving, so a failed ban leaves the dispute open to try again
+            if loserObjID, ok := loser.(primitive.ObjectID); ok && banLoser {
+                _, err = banUser(timeout, *db.Collection("users"), loserObjID, p.Args["note"])
+                if err != nil {
+                    return nil, err
+                }
+            }
+
+            update := bson.M{"$set": bson.M{
+                "status": DisputeStatusResolved,
+                "outcome": outcome,
+                "adminNote": p.Args["note"],
+                "resolvedBy": adminObjID,
+                "resolved": primitive.NewDateTimeFromTime(time.Now()),
+                "bannedLoser": banLoser,
+                "loser": loser,
+            }}
+            opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+            var dispute bson.M
+            err = db.Collection("disputes").FindOneAndUpdate(timeout, filter, update, opts).Decode(&dispute)
+            if err == mongo.ErrNoDocuments {
+                return nil, errors.New("Dispute not found or already resolved")
+            } else if err != nil {
+                return nil, err
+            }
+
+            _, err = db.Collection("transactions").UpdateOne(timeout, bson.M{"_id": transaction["_id"]}, bson.M{"$set": bson.M{"state": state, "settled": primitive.NewDateTimeFromTime(time.Now())}})
+            if err != nil {
+                return nil, err
+            }
+            if state == TransactionStateFailed {
+                if err = releaseTransaction(timeout, db, transaction); err != nil {
+                    log.Println(err)
+                }
+            }
+            if err = recomputeTransactionReputations(timeout, db, transaction); err != nil {
+                log.Println(err)
+            }
+            if state == TransactionStateCompleted {
+                if err = publishReviews(timeout, db, transaction["_id"].(primitive.ObjectID)); err != nil {
+                    log.Println(err)
+                }
+            }
+
+            refs := bson.M{"transaction": transaction["_id"]}
+            for _, key := range []string{"buyer", "seller"} {
+                err = notify(timeout, db, transaction[key].(primitive.ObjectID), NotificationDisputeResolved, "The dispute on your trade was resolved", refs)
+                if err != nil {
+                    log.Println(err)
+                }
+            }
+
+            return dispute, nil
+        },
+    }
+}
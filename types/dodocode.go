@@ -0,0 +1,314 @@
+package types
+
+import (
+    "context"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/hex"
+    "errors"
+    "log"
+    "regexp"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "github.com/graphql-go/graphql"
+)
+
+// DodoCodeExpiry is how long a shared Dodo code can be seen for.
+var DodoCodeExpiry = 2 * time.Hour
+
+// DodoCodeSweepInterval is how often expired Dodo codes are removed.
+var DodoCodeSweepInterval = 5 * time.Minute
+
+var dodoCodePattern = regexp.MustCompile(`^[A-Z0-9]{5}$`)
+
+// dodoCodeAEAD encrypts Dodo codes at rest. It is set up by InitDodoCodeKey.
+var dodoCodeAEAD cipher.AEAD
+
+// InitDodoCodeKey sets the key Dodo codes are encrypted with, given as 64 hex digits. A
+// key has to be given unless dev is set, in which case a random one is made and codes
+// shared before a restart can no longer be read afterwards.
+func InitDodoCodeKey(hexKey string, dev bool) error {
+    var key []byte
+    if hexKey == "" {
+        if !dev {
+            return errors.New("No Dodo code key given")
+        }
+        log.Print("No Dodo code key given, using a random one")
+        key = make([]byte, 32)
+        if _, err := rand.Read(key); err != nil {
+            return err
+        }
+    } else {
+        var err error
+        key, err = hex.DecodeString(hexKey)
+        if err != nil {
+            return err
+        }
+        if len(key) != 32 {
+            return errors.New("Dodo code key must be 32 bytes")
+        }
+    }
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return err
+    }
+    dodoCodeAEAD, err = cipher.NewGCM(block)
+    return err
+}
+
+// sealDodoCode encrypts a Dodo code for a transaction. The transaction's ID is bound into
+// the ciphertext, so it can't be copied onto another transaction.
+func sealDodoCode(transactionObjID primitive.ObjectID, code string) (bson.M, error) {
+    if dodoCodeAEAD == nil {
+        return nil, errors.New("Dodo codes are not set up on this server")
+    }
+    nonce := make([]byte, dodoCodeAEAD.NonceSize())
+    if _, err := rand.Read(nonce); err != nil {
+        return nil, err
+    }
+    ciphertext := dodoCodeAEAD.Seal(nil, nonce, []byte(code), transactionObjID[:])
+    return bson.M{
+        "nonce": primitive.Binary{Data: nonce},
+        "ciphertext": primitive.Binary{Data: ciphertext},
+    }, nil
+}
+
+// openDodoCode decrypts the Dodo code stored on a transaction.
+func openDodoCode(transactionObjID primitive.ObjectID, sealed bson.M) (string, error) {
+    if dodoCodeAEAD == nil {
+        return "", errors.New("Dodo codes are not set up on this server")
+    }
+    nonce, _ := sealed["nonce"].(primitive.Binary)
+    ciphertext, _ := sealed["ciphertext"].(primitive.Binary)
+    code, err := dodoCodeAEAD.Open(nil, nonce.Data, ciphertext.Data, transactionObjID[:])
+    if err != nil {
+        return "", errors.New("Dodo code could not be decrypted")
+    }
+    return string(code), nil
+}
+
+// dodoCodeResolver reveals the Dodo code of an in-progress transaction to the other side
+// of whoever shared it. Since user IDs are public, the viewer also has to give the secret
+// of the transaction, which only its participants can get from TransactionSecret. Every
+// reveal is recorded in the audit log. Nothing is returned if no code is shared or it has
+// expired.
+func dodoCodeResolver(ctx context.Context, db mongo.Database) graphql.FieldResolveFn {
+    return func (p graphql.ResolveParams) (interface{}, error) {
+        transaction := p.Source.(primitive.M)
+        viewerID, ok := p.Args["viewerID"].(string)
+        if !ok {
+            return nil, errors.New("Viewer ID not given for reading a Dodo code")
+        }
+        viewerObjID, err := primitive.ObjectIDFromHex(viewerID)
+        if err != nil {
+            return nil, err
+        }
+        secret, ok := p.Args["secret"].(string)
+        if !ok {
+            return nil, errors.New("Transaction secret not given for reading a Dodo code")
+        }
+
+        dodoCode, ok := transaction["dodoCode"].(primitive.M)
+        if !ok || transaction["state"] != TransactionStateInProgress {
+            return nil, nil
+        }
+        if expiresAt, _ := dodoCode["expiresAt"].(primitive.DateTime); time.Now().After(expiresAt.Time()) {
+            return nil, nil
+        }
+        sharedBy := dodoCode["sharedBy"]
+        if sharedBy == viewerObjID {
+            return nil, nil
+        }
+        if viewerObjID != transaction["buyer"] && viewerObjID != transaction["seller"] {
+            return nil, errors.New("Only the other side of the transaction can see its Dodo code")
+        }
+        stored, _ := transaction["secret"].(string)
+        if stored == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(stored)) != 1 {
+            return nil, errors.New("Wrong transaction secret for reading a Dodo code")
+        }
+
+        transactionObjID := transaction["_id"].(primitive.ObjectID)
+        code, err := openDodoCode(transactionObjID, dodoCode)
+        if err != nil {
+            return nil, err
+        }
+
+        timeout, cancel := context.WithTimeout(ctx, time.Second)
+        defer cancel()
+        // a code that can't be audited isn't revealed
+        err = audit(timeout, db, AuditDodoCodeRevealed, viewerObjID, bson.M{"transaction": transactionObjID})
+        if err != nil {
+            return nil, err
+        }
+        return code, nil
+    }
+}
+
+// TransactionSecret gives one of the participants of a transaction its secret, which
+// they need to see the Dodo code shared for it. The secret is made the first time it is
+// asked for.
+func TransactionSecret(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: graphql.String,
+        Description: "Get the secret of a transaction, needed to see its Dodo code",
+        Args: graphql.FieldConfigArgument {
+            "transactionID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            transactionID, prs := p.Args["transactionID"]
+            if !prs {
+                return nil, errors.New("Transaction ID not given for getting its secret")
+            }
+            transactionObjID, err := primitive.ObjectIDFromHex(transactionID.(string))
+            if err != nil {
+                return nil, err
+            }
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for getting a transaction secret")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            transactionsCollection := db.Collection("transactions")
+            var transaction bson.M
+            err = transactionsCollection.FindOne(timeout, bson.M{"_id": transactionObjID}).Decode(&transaction)
+            if err != nil {
+                return nil, err
+            }
+            if userObjID != transaction["buyer"] && userObjID != transaction["seller"] {
+                return nil, errors.New("Only the buyer and seller can get the secret of a transaction")
+            }
+            if secret, ok := transaction["secret"].(string); ok && secret != "" {
+                return secret, nil
+            }
+
+            secret, err := randomToken()
+            if err != nil {
+                return nil, err
+            }
+            // the other side may have asked at the same time, in which case theirs is kept
+            filter := bson.M{"_id": transactionObjID, "secret": nil}
+            if _, err = transactionsCollection.UpdateOne(timeout, filter, bson.M{"$set": bson.M{"secret": secret}}); err != nil {
+                return nil, err
+            }
+            err = transactionsCollection.FindOne(timeout, bson.M{"_id": transactionObjID}).Decode(&transaction)
+            if err != nil {
+                return nil, err
+            }
+            return transaction["secret"], nil
+        },
+    }
+}
+
+// ShareDodoCode stores a Dodo code on an in-progress transaction for the other side to
+// see, replacing any code shared before. The code is encrypted at rest and expires after
+// DodoCodeExpiry.
+func ShareDodoCode(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: TransactionType,
+        Description: "Share a Dodo code with the other side of a transaction",
+        Args: graphql.FieldConfigArgument {
+            "transactionID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "code": &graphql.ArgumentConfig {
+                Type: graphql.String,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            transactionID, prs := p.Args["transactionID"]
+            if !prs {
+                return nil, errors.New("Transaction ID not given for sharing a Dodo code")
+            }
+            transactionObjID, err := primitive.ObjectIDFromHex(transactionID.(string))
+            if err != nil {
+                return nil, err
+            }
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for sharing a Dodo code")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
+            code, _ := p.Args["code"].(string)
+            code = strings.ToUpper(strings.TrimSpace(code))
+            if !dodoCodePattern.MatchString(code) {
+                return nil, errors.New("Dodo code must be 5 letters or digits")
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            var transaction bson.M
+            err = db.Collection("transactions").FindOne(timeout, bson.M{"_id": transactionObjID}).Decode(&transaction)
+            if err != nil {
+                return nil, err
+            }
+            var other primitive.ObjectID
+            switch userObjID {
+            case transaction["buyer"]:
+                other = transaction["seller"].(primitive.ObjectID)
+            case transaction["seller"]:
+                other = transaction["buyer"].(primitive.ObjectID)
+            default:
+                return nil, errors.New("Only the buyer and seller can share a Dodo code")
+            }
+
+            dodoCode, err := sealDodoCode(transactionObjID, code)
+            if err != nil {
+                return nil, err
+            }
+            dodoCode["sharedBy"] = userObjID
+            dodoCode["expiresAt"] = primitive.NewDateTimeFromTime(time.Now().Add(DodoCodeExpiry))
+            filter := bson.M{"_id": transactionObjID, "state": TransactionStateInProgress}
+            res, err := db.Collection("transactions").UpdateOne(timeout, filter, bson.M{"$set": bson.M{"dodoCode": dodoCode}})
+            if err != nil {
+                return nil, err
+            }
+            if res.MatchedCount == 0 {
+                return nil, errors.New("Dodo codes can only be shared on transactions in progress")
+            }
+            transaction["dodoCode"] = dodoCode
+
+            refs := bson.M{"transaction": transactionObjID}
+            if err = audit(timeout, db, AuditDodoCodeShared, userObjID, refs); err != nil {
+                log.Println(err)
+            }
+            if err = notify(timeout, db, other, NotificationDodoCodeShared, "A Dodo code was shared for your trade", refs); err != nil {
+                log.Println(err)
+            }
+
+            return transaction, nil
+        },
+    }
+}
+
+// clearExpiredDodoCodes removes Dodo codes past their expiry from transactions, so they
+// aren't kept around any longer than they are needed.
+func clearExpiredDodoCodes(ctx context.Context, db mongo.Database) error {
+    filter := bson.M{"dodoCode.expiresAt": bson.M{"$lte": primitive.NewDateTimeFromTime(time.Now())}}
+    _, err := db.Collection("transactions").UpdateMany(ctx, filter, bson.M{"$set": bson.M{"dodoCode": nil}})
+    return err
+}
@@ -0,0 +1,179 @@
+package types
+
+import (
+    "context"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// duplicateKeyCode is the MongoDB error code for a write that breaks a unique index.
+const duplicateKeyCode = 11000
+
+// isDuplicateKey reports whether an error is from a write that broke a unique index.
+func isDuplicateKey(err error) bool {
+    if we, ok := err.(mongo.WriteException); ok {
+        for _, e := range we.WriteErrors {
+            if e.Code == duplicateKeyCode {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// EnsureIndexes creates the indexes that the database relies on to enforce its rules,
+// first filling in the fields they need on documents from before they existed. It is
+// safe to call every time the server starts.
+func EnsureIndexes(ctx context.Context, db mongo.Database) error {
+    inquiriesCollection := db.Collection("inquiries")
+
+    // an inquiry is open until it is accepted, declined or withdrawn
+    missing := bson.M{"open": bson.M{"$exists": false}}
+    closed := bson.M{"open": bson.M{"$exists": false}, "$or": bson.A{
+        bson.M{"accepted": bson.M{"$ne": nil}},
+        bson.M{"declined": bson.M{"$ne": nil}},
+    }}
+    _, err := inquiriesCollection.UpdateMany(ctx, closed, bson.M{"$set": bson.M{"open": false}})
+    if err != nil {
+        return err
+    }
+    _, err = inquiriesCollection.UpdateMany(ctx, missing, bson.M{"$set": bson.M{"open": true}})
+    if err != nil {
+        return err
+    }
+
+    _, err = inquiriesCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+        Keys: bson.D{{Key: "listing", Value: 1}, {Key: "buyer", Value: 1}},
+        Options: options.Index().
+            SetName("one_open_inquiry_per_buyer").
+            SetUnique(true).
+            SetPartialFilterExpression(bson.M{"open": true}),
+    })
+    if err != nil {
+        return err
+    }
+
+    // listings from before expiry expire ListingExpiry after they were created
+    listingsCollection := db.Collection("listings")
+    cursor, err := listingsCollection.Find(ctx, bson.M{"expiresAt": bson.M{"$exists": false}})
+    if err != nil {
+        return err
+    }
+    defer cursor.Close(ctx)
+    for cursor.Next(ctx) {
+        var listing bson.M
+        if err = cursor.Decode(&listing); err != nil {
+            return err
+        }
+        listingObjID := listing["_id"].(primitive.ObjectID)
+        expiresAt := primitive.NewDateTimeFromTime(listingObjID.Timestamp().Add(ListingExpiry))
+        _, err = listingsCollection.UpdateOne(ctx, bson.M{"_id": listingObjID}, bson.M{"$set": bson.M{"expiresAt": expiresAt}})
+        if err != nil {
+            return err
+        }
+    }
+    if err := cursor.Err(); err != nil {
+        return err
+    }
+
+    // listings from before bellPrice are worth their price, or what their asking price
+    // is worth now
+    normalizer, err := newPriceNormalizer(ctx, db)
+    if err != nil {
+        return err
+    }
+    cursor, err = listingsCollection.Find(ctx, bson.M{"bellPrice": bson.M{"$exists": false}})
+    if err != nil {
+        return err
+    }
+    defer cursor.Close(ctx)
+    for cursor.Next(ctx) {
+        var listing bson.M
+        if err = cursor.Decode(&listing); err != nil {
+            return err
+        }
+        var bellPrice interface{}
+        bells, ok, err := normalizer.toBells(ctx, listing)
+        if err != nil {
+            return err
+        }
+        if ok {
+            bellPrice = bells
+        }
+        _, err = listingsCollection.UpdateOne(ctx, bson.M{"_id": listing["_id"]}, bson.M{"$set": bson.M{"bellPrice": bellPrice}})
+        if err != nil {
+            return err
+        }
+    }
+    if err := cursor.Err(); err != nil {
+        return err
+    }
+
+    // users from before buy orders haven't made any
+    _, err = db.Collection("users").UpdateMany(ctx, bson.M{"buyOrders": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"buyOrders": bson.A{}}})
+    if err != nil {
+        return err
+    }
+
+    // reports from before moderation are waiting to be looked at
+    reportsCollection := db.Collection("reports")
+    _, err = reportsCollection.UpdateMany(ctx, bson.M{"status": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"status": ReportStatusOpen}})
+    if err != nil {
+        return err
+    }
+
+    _, err = reportsCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+        Keys: bson.D{{Key: "reporter", Value: 1}, {Key: "scumbag", Value: 1}},
+        Options: options.Index().
+            SetName("one_open_report_per_pair").
+            SetUnique(true).
+            SetPartialFilterExpression(bson.M{"status": ReportStatusOpen}),
+    })
+    if err != nil {
+        return err
+    }
+
+    _, err = db.Collection("disputes").Indexes().CreateOne(ctx, mongo.IndexModel{
+        Keys: bson.D{{Key: "transaction", Value: 1}},
+        Options: options.Index().SetName("one_dispute_per_transaction").SetUnique(true),
+    })
+    if err != nil {
+        return err
+    }
+
+    _, err = db.Collection("ratings").Indexes().CreateOne(ctx, mongo.IndexModel{
+        Keys: bson.D{{Key: "transaction", Value: 1}, {Key: "from", Value: 1}},
+        Options: options.Index().SetName("one_rating_per_side").SetUnique(true),
+    })
+    if err != nil {
+        return err
+    }
+
+    _, err = db.Collection("reviews").Indexes().CreateOne(ctx, mongo.IndexModel{
+        Keys: bson.D{{Key: "rating", Value: 1}},
+        Options: options.Index().SetName("one_review_per_rating").SetUnique(true),
+    })
+    if err != nil {
+        return err
+    }
+
+    _, err = db.Collection("users").Indexes().CreateOne(ctx, mongo.IndexModel{
+        Keys: bson.D{{Key: "calendarToken", Value: 1}},
+        Options: options.Index().
+            SetName("one_user_per_calendar_token").
+            SetUnique(true).
+            SetPartialFilterExpression(bson.M{"calendarToken": bson.M{"$type": "string"}}),
+    })
+    if err != nil {
+        return err
+    }
+
+    _, err = db.Collection("records").Indexes().CreateOne(ctx, mongo.IndexModel{
+        Keys: bson.D{{Key: "item", Value: 1}, {Key: "date", Value: 1}, {Key: "variation", Value: 1}},
+        Options: options.Index().SetName("one_record_per_item_day_variation").SetUnique(true),
+    })
+    return err
+}
@@ -3,6 +3,8 @@ package types
 import (
     "context"
     "errors"
+    "fmt"
+    "sort"
     "time"
 
     "go.mongodb.org/mongo-driver/bson"
@@ -57,14 +59,62 @@ var ItemType = graphql.NewObject(
 func InitItemType(ctx context.Context, db mongo.Database) {
     ItemType.AddFieldConfig("records", &graphql.Field {
         Type: graphql.NewList(ItemMarketRecordType),
-        Resolve: resolverGenerator(ctx, "records", *db.Collection("records")),
+        Args: graphql.FieldConfigArgument {
+            "variation": &graphql.ArgumentConfig {
+                Type: graphql.String,
+            },
+        },
+        Resolve: sortedByDate(withArgFilters(resolverGenerator(ctx, "records", *db.Collection("records")), "variation")),
     })
     ItemType.AddFieldConfig("listings", &graphql.Field {
         Type: graphql.NewList(ListingType),
-        Resolve: resolverGenerator(ctx, "listings", *db.Collection("listings")),
+        Args: graphql.FieldConfigArgument {
+            "variation": &graphql.ArgumentConfig {
+                Type: graphql.String,
+            },
+        },
+        Resolve: hiding(withArgFilters(resolverGenerator(ctx, "listings", *db.Collection("listings")), "variation"), "deleted", "expired"),
     })
 }
 
+// sortedByDate wraps a resolver returning market records so that they come back in date
+// order, since the order of an item's records array is just the order they were added in.
+func sortedByDate(resolve graphql.FieldResolveFn) graphql.FieldResolveFn {
+    return func (p graphql.ResolveParams) (interface{}, error) {
+        res, err := resolve(p)
+        if err != nil {
+            return nil, err
+        }
+        if records, ok := res.([]bson.M); ok {
+            sort.SliceStable(records, func(i, j int) bool {
+                a, _ := records[i]["date"].(string)
+                b, _ := records[j]["date"].(string)
+                return a < b
+            })
+        }
+        return res, nil
+    }
+}
+
+// validateVariation makes sure a variation given for an item is one of the item's
+// variations. Items that come in variations need one to be picked, and items that
+// don't can't be given one.
+func validateVariation(item bson.M, variation interface{}) error {
+    variations, _ := item["variations"].(primitive.A)
+    if variation == nil {
+        if len(variations) > 0 {
+            return errors.New(fmt.Sprintf("Variation required for %s", item["name"]))
+        }
+        return nil
+    }
+    for _, v := range variations {
+        if v == variation {
+            return nil
+        }
+    }
+    return errors.New(fmt.Sprintf("Invalid variation for %s: %s", item["name"], variation))
+}
+
 // GetItem is a query for getting an item by either ID or name.
 func GetItem(ctx context.Context, itemsCollection mongo.Collection) graphql.Field {
     return graphql.Field {
@@ -116,6 +166,7 @@ func Items(ctx context.Context, itemsCollection mongo.Collection) graphql.Field
             if err != nil {
                 return nil, err
             }
+            defer cursor.Close(timeout)
             items := make([]bson.M, 0)
             for cursor.Next(timeout) {
                 var item bson.M
@@ -124,6 +175,9 @@ func Items(ctx context.Context, itemsCollection mongo.Collection) graphql.Field
                 }
                 items = append(items, item)
             }
+            if err := cursor.Err(); err != nil {
+                return nil, err
+            }
             return items, nil
         },
     }
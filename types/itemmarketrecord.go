@@ -10,6 +10,7 @@ import (
 type ItemMarketRecordStruct struct {
     id string
     date string
+    variation string
     avg int
     median int
     high int
@@ -17,7 +18,9 @@ type ItemMarketRecordStruct struct {
     numListings int
 }
 
-// ItemMarketRecordType corresponds to the "records" collection
+// ItemMarketRecordType corresponds to the "records" collection. There is one record per
+// item per day (YYYY-MM-DD, UTC), plus one per variation sold that day. Records with a
+// null variation cover every variation of the item.
 var ItemMarketRecordType = graphql.NewObject(
     graphql.ObjectConfig {
         Name: "ItemMarketRecord",
@@ -28,7 +31,9 @@ var ItemMarketRecordType = graphql.NewObject(
             },
             "date": &graphql.Field {
                 Type: graphql.String, // TODO Date scalar
-                Resolve: timestampResolver,
+            },
+            "variation": &graphql.Field {
+                Type: graphql.String,
             },
             "avg": &graphql.Field {
                 Type: graphql.Int,
@@ -0,0 +1,74 @@
+package types
+
+import (
+    "context"
+    "errors"
+    "log"
+    "time"
+
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// job is a background job, run every interval.
+type job struct {
+    name string
+    interval time.Duration
+    run func(context.Context, mongo.Database) error
+}
+
+// jobs returns the background jobs, with their intervals as currently configured.
+func jobs() []job {
+    return []job{
+        {"market aggregation", MarketAggregationInterval, aggregateRecentMarketRecords},
+        {"trending items", TrendingRefreshInterval, refreshTrending},
+        {"listing expiry", ListingExpirySweepInterval, expireListings},
+        {"auction closer", AuctionCloseInterval, closeAuctions},
+        {"Dodo code expiry", DodoCodeSweepInterval, clearExpiredDodoCodes},
+        {"stale transactions", TransactionSweepInterval, settleStaleTransactions},
+        {"reputation", ReputationRecomputeInterval, func (ctx context.Context, db mongo.Database) error {
+            _, err := recomputeAllReputations(ctx, db)
+            return err
+        }},
+    }
+}
+
+// StartJobs starts the background jobs that keep derived data in the database up to
+// date. The jobs run until ctx is cancelled.
+func StartJobs(ctx context.Context, db mongo.Database) {
+    for _, j := range jobs() {
+        run := j.run
+        go runEvery(ctx, j.interval, j.name, func (ctx context.Context) error {
+            return run(ctx, db)
+        })
+    }
+}
+
+// RunJob runs the background job with the given name once, e.g. to test it without
+// waiting for it to come around.
+func RunJob(ctx context.Context, db mongo.Database, name string) error {
+    for _, j := range jobs() {
+        if j.name == name {
+            return j.run(ctx, db)
+        }
+    }
+    return errors.New("No job named " + name)
+}
+
+// runEvery runs a job straight away and then once every interval until ctx is cancelled.
+// Errors are logged rather than stopping the job, since the next run may well succeed.
+func runEvery(ctx context.Context, interval time.Duration, name string, job func(context.Context) error) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        timeout, cancel := context.WithTimeout(ctx, interval)
+        if err := job(timeout); err != nil {
+            log.Printf("%s job: %s", name, err)
+        }
+        cancel()
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
@@ -0,0 +1,354 @@
+package types
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "github.com/graphql-go/graphql"
+)
+
+// Limits on the line items of a listing
+const (
+    maxLineItems = 20
+    maxLineItemQuantity = 999
+)
+
+// LineItemInput is an item, variation and quantity being sold or inquired about
+var LineItemInput = graphql.NewInputObject(
+    graphql.InputObjectConfig {
+        Name: "LineItemInput",
+        Fields: graphql.InputObjectConfigFieldMap {
+            "itemID": &graphql.InputObjectFieldConfig {
+                Type: graphql.NewNonNull(graphql.ID),
+            },
+            "variation": &graphql.InputObjectFieldConfig {
+                Type: graphql.String,
+            },
+            "quantity": &graphql.InputObjectFieldConfig {
+                Type: graphql.Int,
+                DefaultValue: 1,
+            },
+        },
+    },
+)
+
+// LineItemType is an entry of the lineItems array of a listing or inquiry
+var LineItemType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "LineItem",
+        Fields: graphql.Fields {
+            "variation": &graphql.Field {
+                Type: graphql.String,
+            },
+            "quantity": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "remaining": &graphql.Field {
+                Type: graphql.Int,
+                Description: "How many of the quantity are still for sale, only set on listings",
+            },
+        },
+    },
+)
+
+func InitLineItemType(ctx context.Context, db mongo.Database) {
+    LineItemType.AddFieldConfig("item", &graphql.Field {
+        Type: ItemType,
+        Resolve: resolverGenerator(ctx, "item", *db.Collection("items")),
+    })
+}
+
+// listingLineItems returns the line items of a listing. Listings made before listings
+// could have line items sold a single unit of their item.
+func listingLineItems(listing bson.M) primitive.A {
+    if lineItems, ok := listing["lineItems"].(primitive.A); ok {
+        return lineItems
+    }
+    remaining := 1
+    if listing["accepted"] != nil {
+        remaining = 0
+    }
+    return primitive.A{bson.M{
+        "item": listing["item"],
+        "variation": listing["variation"],
+        "quantity": 1,
+        "remaining": remaining,
+    }}
+}
+
+func lineItemsResolver(p graphql.ResolveParams) (interface{}, error) {
+    return listingLineItems(p.Source.(primitive.M)), nil
+}
+
+// isBundle reports whether line items are for more than a single unit of one item.
+func isBundle(lineItems primitive.A) bool {
+    if len(lineItems) != 1 {
+        return true
+    }
+    quantity, _ := toInt(lineItems[0].(bson.M)["quantity"])
+    return quantity != 1
+}
+
+// lineItemsFromInput validates the line items of a new listing. Every item has to exist,
+// variations have to be valid for their item, and the same item and variation can't be
+// on more than one line.
+func lineItemsFromInput(ctx context.Context, db mongo.Database, input []interface{}) (primitive.A, error) {
+    if len(input) < 1 || len(input) > maxLineItems {
+        return nil, errors.New(fmt.Sprintf("Listing must have between 1 and %d line items", maxLineItems))
+    }
+    lineItems := make(primitive.A, 0, len(input))
+    seen := make(map[string]bool)
+    for _, l := range input {
+        line := l.(map[string]interface{})
+        itemObjID, err := primitive.ObjectIDFromHex(line["itemID"].(string))
+        if err != nil {
+            return nil, err
+        }
+        variation := line["variation"]
+        key := fmt.Sprintf("%s/%v", itemObjID.Hex(), variation)
+        if seen[key] {
+            return nil, errors.New("Listing cannot have the same item on more than one line")
+        }
+        seen[key] = true
+        quantity, _ := line["quantity"].(int)
+        if quantity < 1 || quantity > maxLineItemQuantity {
+            return nil, errors.New(fmt.Sprintf("Quantity must be between 1 and %d", maxLineItemQuantity))
+        }
+
+        var item bson.M
+        err = db.Collection("items").FindOne(ctx, bson.M{"_id": itemObjID}).Decode(&item)
+        if err == mongo.ErrNoDocuments {
+            return nil, errors.New(fmt.Sprintf("Item not found: %s", itemObjID.Hex()))
+        } else if err != nil {
+            return nil, err
+        }
+        if err = validateVariation(item, variation); err != nil {
+            return nil, err
+        }
+        lineItems = append(lineItems, bson.M{
+            "item": itemObjID,
+            "variation": variation,
+            "quantity": quantity,
+            "remaining": quantity,
+        })
+    }
+    return lineItems, nil
+}
+
+// inquiryLineItemsFromInput validates the line items of an inquiry against the listing
+// it is for. Each line has to be on the listing, for no more than what remains of it.
+func inquiryLineItemsFromInput(listing bson.M, input []interface{}) (primitive.A, error) {
+    available := listingLineItems(listing)
+    lineItems := make(primitive.A, 0, len(input))
+    seen := make(map[string]bool)
+    for _, l := range input {
+        line := l.(map[string]interface{})
+        itemObjID, err := primitive.ObjectIDFromHex(line["itemID"].(string))
+        if err != nil {
+            return nil, err
+        }
+        variation := line["variation"]
+        key := fmt.Sprintf("%s/%v", itemObjID.Hex(), variation)
+        if seen[key] {
+            return nil, errors.New("Inquiry cannot have the same item on more than one line")
+        }
+        seen[key] = true
+        quantity, _ := line["quantity"].(int)
+        if quantity < 1 {
+            return nil, errors.New("Quantity must be at least 1")
+        }
+
+        var match bson.M
+        for _, a := range available {
+            entry := a.(primitive.M)
+            if entry["item"] == itemObjID && entry["variation"] == variation {
+                match = entry
+                break
+            }
+        }
+        if match == nil {
+            return nil, errors.New(fmt.Sprintf("Listing does not have item %s in that variation", itemObjID.Hex()))
+        }
+        if remaining, _ := toInt(match["remaining"]); quantity > remaining {
+            return nil, errors.New(fmt.Sprintf("Only %d of item %s remain on the listing", remaining, itemObjID.Hex()))
+        }
+        lineItems = append(lineItems, bson.M{"item": itemObjID, "variation": variation, "quantity": quantity})
+    }
+    return lineItems, nil
+}
+
+// unitPrice is the price in bells of one unit of an item in a sale
+type unitPrice struct {
+    item primitive.ObjectID
+    variation interface{}
+    price int
+}
+
+// unitPrices splits the price of a sale between its line items, giving the price of one
+// unit of each. The price is split in proportion to the bell value of each line, or by
+// quantity if any of the items has no value yet.
+func (n *priceNormalizer) unitPrices(ctx context.Context, lineItems primitive.A, total int) ([]unitPrice, error) {
+    weights := make([]int, len(lineItems))
+    totalWeight := 0
+    byQuantity := false
+    for i, l := range lineItems {
+        line := l.(primitive.M)
+        itemObjID, ok := line["item"].(primitive.ObjectID)
+        if !ok {
+            return nil, nil
+        }
+        quantity, _ := toInt(line["quantity"])
+        value, err := n.itemValue(ctx, itemObjID)
+        if err != nil {
+            return nil, err
+        }
+        if value == 0 {
+            byQuantity = true
+        }
+        weights[i] = value * quantity
+        totalWeight += weights[i]
+    }
+
+    totalQuantity := 0
+    for _, l := range lineItems {
+        quantity, _ := toInt(l.(primitive.M)["quantity"])
+        totalQuantity += quantity
+    }
+    if totalQuantity == 0 {
+        return nil, nil
+    }
+    prices := make([]unitPrice, 0, len(lineItems))
+    for i, l := range lineItems {
+        line := l.(primitive.M)
+        quantity, _ := toInt(line["quantity"])
+        if quantity < 1 {
+            continue
+        }
+        share := total * quantity / totalQuantity
+        if !byQuantity && totalWeight > 0 {
+            share = total * weights[i] / totalWeight
+        }
+        prices = append(prices, unitPrice{line["item"].(primitive.ObjectID), line["variation"], share / quantity})
+    }
+    return prices, nil
+}
+
+// claimLineItems takes line items off a listing for a buyer, so they can't be sold twice.
+// lineItems is nil to take everything that remains. Once nothing remains the listing is
+// marked as accepted by the buyer. It returns the line items taken and whether that sold
+// out the listing, or an error if the listing is no longer open or doesn't have enough
+// left.
+func claimLineItems(ctx context.Context, db mongo.Database, listing bson.M, lineItems primitive.A, buyerObjID primitive.ObjectID) (primitive.A, bool, error) {
+    listingsCollection := db.Collection("listings")
+    listingObjID := listing["_id"].(primitive.ObjectID)
+    open := bson.M{
+        "_id": listingObjID,
+        "accepted": nil,
+        "deleted": bson.M{"$ne": true},
+        "expired": bson.M{"$ne": true},
+    }
+    soldOut := bson.M{"$set": bson.M{"accepted": primitive.NewDateTimeFromTime(time.Now()), "buyer": buyerObjID}}
+
+    // listings without line items only ever had the one unit
+    if _, ok := listing["lineItems"].(primitive.A); !ok {
+        res, err := listingsCollection.UpdateOne(ctx, open, soldOut)
+        if err != nil {
+            return nil, false, err
+        }
+        if res.ModifiedCount == 0 {
+            return nil, false, errors.New("Listing is no longer open")
+        }
+        return listingLineItems(listing), true, nil
+    }
+
+    if lineItems == nil {
+        lineItems = make(primitive.A, 0)
+        for _, l := range listingLineItems(listing) {
+            line := l.(primitive.M)
+            if remaining, _ := toInt(line["remaining"]); remaining > 0 {
+                lineItems = append(lineItems, bson.M{"item": line["item"], "variation": line["variation"], "quantity": remaining})
+            }
+        }
+        if len(lineItems) == 0 {
+            return nil, false, errors.New("Nothing remains on the listing")
+        }
+    }
+
+    filter := bson.M{}
+    for key, val := range open {
+        filter[key] = val
+    }
+    all := bson.A{}
+    inc := bson.M{}
+    arrayFilters := make([]interface{}, 0, len(lineItems))
+    for i, l := range lineItems {
+        line := l.(primitive.M)
+        quantity, _ := toInt(line["quantity"])
+        all = append(all, bson.M{"$elemMatch": bson.M{
+            "item": line["item"],
+            "variation": line["variation"],
+            "remaining": bson.M{"$gte": quantity},
+        }})
+        name := fmt.Sprintf("l%d", i)
+        inc[fmt.Sprintf("lineItems.$[%s].remaining", name)] = -quantity
+        arrayFilters = append(arrayFilters, bson.M{name + ".item": line["item"], name + ".variation": line["variation"]})
+    }
+    filter["lineItems"] = bson.M{"$all": all}
+    opts := options.FindOneAndUpdate().
+        SetArrayFilters(options.ArrayFilters{Filters: arrayFilters}).
+        SetReturnDocument(options.After)
+    var updated bson.M
+    err := listingsCollection.FindOneAndUpdate(ctx, filter, bson.M{"$inc": inc}, opts).Decode(&updated)
+    if err == mongo.ErrNoDocuments {
+        return nil, false, errors.New("Listing is no longer open or doesn't have enough left")
+    } else if err != nil {
+        return nil, false, err
+    }
+
+    for _, l := range listingLineItems(updated) {
+        if remaining, _ := toInt(l.(primitive.M)["remaining"]); remaining > 0 {
+            return lineItems, false, nil
+        }
+    }
+    _, err = listingsCollection.UpdateOne(ctx, open, soldOut)
+    if err != nil {
+        return nil, false, err
+    }
+    return lineItems, true, nil
+}
+
+// releaseLineItems puts line items taken by claimLineItems back on a listing, e.g. when
+// the sale they were taken for falls through. If the claim sold out the listing, it is
+// reopened.
+func releaseLineItems(ctx context.Context, db mongo.Database, listing bson.M, lineItems primitive.A, buyerObjID primitive.ObjectID) error {
+    listingsCollection := db.Collection("listings")
+    listingObjID := listing["_id"].(primitive.ObjectID)
+
+    if _, ok := listing["lineItems"].(primitive.A); ok {
+        inc := bson.M{}
+        arrayFilters := make([]interface{}, 0, len(lineItems))
+        for i, l := range lineItems {
+            line := l.(primitive.M)
+            quantity, _ := toInt(line["quantity"])
+            name := fmt.Sprintf("l%d", i)
+            inc[fmt.Sprintf("lineItems.$[%s].remaining", name)] = quantity
+            arrayFilters = append(arrayFilters, bson.M{name + ".item": line["item"], name + ".variation": line["variation"]})
+        }
+        opts := options.Update().SetArrayFilters(options.ArrayFilters{Filters: arrayFilters})
+        _, err := listingsCollection.UpdateOne(ctx, bson.M{"_id": listingObjID}, bson.M{"$inc": inc}, opts)
+        if err != nil {
+            return err
+        }
+    }
+
+    _, err := listingsCollection.UpdateOne(ctx,
+        bson.M{"_id": listingObjID, "buyer": buyerObjID},
+        bson.M{"$set": bson.M{"accepted": nil, "buyer": nil}})
+    return err
+}
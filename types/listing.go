@@ -3,19 +3,61 @@ package types
 import (
     "context"
     "errors"
+    "fmt"
     "log"
     "time"
 
     "go.mongodb.org/mongo-driver/bson"
     "go.mongodb.org/mongo-driver/bson/primitive"
     "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
     "github.com/graphql-go/graphql"
 )
 
+// ListingRestoreGracePeriod is how long after deleting a listing its seller can restore it.
+var ListingRestoreGracePeriod = 72 * time.Hour
+
+// ListingExpiry is how long a listing stays up after it is created or renewed.
+var ListingExpiry = 14 * 24 * time.Hour
+
+// ListingRenewalCap is how many times a user can renew listings within
+// ListingRenewalWindow.
+var ListingRenewalCap = 10
+
+// ListingRenewalWindow is the period ListingRenewalCap applies to.
+var ListingRenewalWindow = 7 * 24 * time.Hour
+
+// ListingExpirySweepInterval is how often expired listings are looked for.
+var ListingExpirySweepInterval = 10 * time.Minute
+
+// ListingPriceChangeType is an entry of the priceHistory array of a listing
+var ListingPriceChangeType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "ListingPriceChange",
+        Fields: graphql.Fields {
+            "previous": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "price": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "changed": &graphql.Field {
+                Type: graphql.String, // TODO Date scalar
+            },
+        },
+    },
+)
+
 type ListingStruct struct {
     id string
     price int
+    variation string
+    mode string
     deleted bool
+    deletedAt string
+    expiresAt string
+    expired bool
+    renewals int
     accepted string
     seller *UserStruct
     buyer *UserStruct
@@ -36,12 +78,58 @@ var ListingType = graphql.NewObject(
                 Type: graphql.String,
                 Resolve: timestampResolver,
             },
+            "mode": &graphql.Field {
+                Type: ListingModeEnum,
+            },
             "price": &graphql.Field {
                 Type: graphql.Int,
+                Description: "The asking price in bells, or the current high bid of an auction. Null for listings priced in something else",
+            },
+            "bellPrice": &graphql.Field {
+                Type: graphql.Int,
+                Description: "The price in bells, or what the asking price is worth in bells if it is in something else. Null if that can't be worked out yet",
+            },
+            "askingPrice": &graphql.Field {
+                Type: PriceType,
+                Description: "The asking price, in whatever it is being sold for",
+                Resolve: askingPriceResolver,
+            },
+            "auction": &graphql.Field {
+                Type: AuctionType,
+                Resolve: auctionResolver,
+            },
+            "variation": &graphql.Field {
+                Type: graphql.String,
+            },
+            "lineItems": &graphql.Field {
+                Type: graphql.NewList(LineItemType),
+                Resolve: lineItemsResolver,
+            },
+            "bundle": &graphql.Field {
+                Type: graphql.Boolean,
+                Description: "Whether the listing is for more than a single unit of one item",
             },
             "accepted": &graphql.Field {
                 Type: graphql.String, //TODO change this to a custom Date scalar
             },
+            "priceHistory": &graphql.Field {
+                Type: graphql.NewList(ListingPriceChangeType),
+            },
+            "deleted": &graphql.Field {
+                Type: graphql.Boolean,
+            },
+            "deletedAt": &graphql.Field {
+                Type: graphql.String, // TODO Date scalar
+            },
+            "expiresAt": &graphql.Field {
+                Type: graphql.String, // TODO Date scalar
+            },
+            "expired": &graphql.Field {
+                Type: graphql.Boolean,
+            },
+            "renewals": &graphql.Field {
+                Type: graphql.Int,
+            },
         },
     },
 )
@@ -63,10 +151,28 @@ func InitListingType(ctx context.Context, db mongo.Database) {
         Type: graphql.NewList(ListingInquiryType),
         Resolve: resolverGenerator(ctx, "inquiries", *db.Collection("inquiries")),
     })
+    ListingType.AddFieldConfig("bids", &graphql.Field {
+        Type: graphql.NewList(BidType),
+        Resolve: resolverGenerator(ctx, "bids", *db.Collection("bids")),
+    })
+}
+
+// listingIsOpen reports whether a listing can still be inquired about, changed or sold.
+func listingIsOpen(listing bson.M) bool {
+    return listing["accepted"] == nil && listing["deleted"] != true && listing["expired"] != true
 }
 
 // CreateListing creates a new listing in the database, and also updates the listings
-// field of the associated item and user.
+// field of the associated items and user. A listing sells a quantity of one item, or
+// several items given as lineItems; the price is for everything on the listing. If an
+// item comes in variations, the listing has to say which one is being sold. A price far
+// from the suggested price for the item doesn't stop the listing from being created, but
+// adds a warning to the result. Prices that look like typos or abuse are also flagged for
+// admins. Listings in AUCTION mode take a start price, an optional reserve, a minimum
+// increment and an end time instead of a price; they expire when the auction ends. Fixed
+// price listings can ask for bells with price, or for bells, Nook Miles Tickets or other
+// items with askingPrice. Listings of a single unit priced in bells are matched against
+// open buy orders for the item.
 func CreateListing(ctx context.Context, db mongo.Database) graphql.Field {
     itemsCollection := db.Collection("items")
     listingsCollection := db.Collection("listings")
@@ -78,6 +184,15 @@ func CreateListing(ctx context.Context, db mongo.Database) graphql.Field {
         Args: graphql.FieldConfigArgument {
             "itemID": &graphql.ArgumentConfig {
                 Type: graphql.ID,
+                DefaultValue: nil,
+            },
+            "quantity": &graphql.ArgumentConfig {
+                Type: graphql.Int,
+                DefaultValue: 1,
+            },
+            "lineItems": &graphql.ArgumentConfig {
+                Type: graphql.NewList(LineItemInput),
+                DefaultValue: nil,
             },
             "userID": &graphql.ArgumentConfig {
                 Type: graphql.ID,
@@ -85,15 +200,50 @@ func CreateListing(ctx context.Context, db mongo.Database) graphql.Field {
             "price": &graphql.ArgumentConfig {
                 Type: graphql.Int,
             },
+            "askingPrice": &graphql.ArgumentConfig {
+                Type: PriceInput,
+                DefaultValue: nil,
+            },
+            "variation": &graphql.ArgumentConfig {
+                Type: graphql.String,
+                DefaultValue: nil,
+            },
+            "mode": &graphql.ArgumentConfig {
+                Type: ListingModeEnum,
+                DefaultValue: ListingModeFixed,
+            },
+            "startPrice": &graphql.ArgumentConfig {
+                Type: graphql.Int,
+                DefaultValue: nil,
+            },
+            "reservePrice": &graphql.ArgumentConfig {
+                Type: graphql.Int,
+                DefaultValue: nil,
+            },
+            "minIncrement": &graphql.ArgumentConfig {
+                Type: graphql.Int,
+                DefaultValue: 1,
+            },
+            "endsAt": &graphql.ArgumentConfig {
+                Type: graphql.String,
+                DefaultValue: nil,
+            },
         },
         Resolve: func (p graphql.ResolveParams) (interface{}, error) {
-            itemID, prs := p.Args["itemID"]
-            if !prs {
-                return nil, errors.New("Item ID not given for listing creation")
+            lineItemsInput, hasLineItems := p.Args["lineItems"].([]interface{})
+            itemID, hasItem := p.Args["itemID"].(string)
+            if hasLineItems && hasItem {
+                return nil, errors.New("Only one of itemID and lineItems can be given")
             }
-            itemObjID, err := primitive.ObjectIDFromHex(itemID.(string))
-            if err != nil {
-                return nil, err
+            if !hasLineItems {
+                if !hasItem {
+                    return nil, errors.New("Item ID not given for listing creation")
+                }
+                lineItemsInput = []interface{}{map[string]interface{}{
+                    "itemID": itemID,
+                    "variation": p.Args["variation"],
+                    "quantity": p.Args["quantity"],
+                }}
             }
             userID, prs := p.Args["userID"]
             if !prs {
@@ -103,22 +253,58 @@ func CreateListing(ctx context.Context, db mongo.Database) graphql.Field {
             if err != nil {
                 return nil, err
             }
-            price, prs := p.Args["price"].(int)
-            if !prs {
-                return nil, errors.New("Price not given for listing creation")
-            }
-            if price < 0 || price > 100000000 {
-                return nil, errors.New("Price must be between 0 and 100 mil")
-            }
+            mode, _ := p.Args["mode"].(string)
 
             timeout, cancel := context.WithTimeout(ctx, time.Second)
             defer cancel()
 
-            var item bson.M
-            err = itemsCollection.FindOne(timeout, bson.M{"_id": itemObjID}).Decode(&item)
+            lineItems, err := lineItemsFromInput(timeout, db, lineItemsInput)
             if err != nil {
                 return nil, err
             }
+            // the first line is also stored as the item and variation of the listing, so
+            // that it shows up wherever single item listings do
+            first := lineItems[0].(bson.M)
+            itemObjID := first["item"].(primitive.ObjectID)
+            variation := first["variation"]
+            bundle := isBundle(lineItems)
+
+            // price is only set for listings priced in bells; askingPrice is only stored
+            // for the ones that aren't
+            var price interface{}
+            var askingPrice bson.M
+            var auction bson.M
+            if mode == ListingModeAuction {
+                auction, err = auctionFromArgs(p.Args)
+                if err != nil {
+                    return nil, err
+                }
+                price = auction["startPrice"]
+            } else {
+                mode = ListingModeFixed
+                input, hasAskingPrice := p.Args["askingPrice"].(map[string]interface{})
+                bells, hasPrice := p.Args["price"].(int)
+                switch {
+                case hasAskingPrice && hasPrice:
+                    return nil, errors.New("Only one of price and askingPrice can be given")
+                case hasAskingPrice:
+                    askingPrice, err = priceFromInput(timeout, db, input)
+                    if err != nil {
+                        return nil, err
+                    }
+                    if askingPrice["currency"] == CurrencyBells {
+                        price = askingPrice["bells"]
+                        askingPrice = nil
+                    }
+                case hasPrice:
+                    if bells < 0 || bells > 100000000 {
+                        return nil, errors.New("Price must be between 0 and 100 mil")
+                    }
+                    price = bells
+                default:
+                    return nil, errors.New("Price not given for listing creation")
+                }
+            }
 
             var user bson.M
             err = usersCollection.FindOne(timeout, bson.M{"_id": userObjID}).Decode(&user)
@@ -126,14 +312,35 @@ func CreateListing(ctx context.Context, db mongo.Database) graphql.Field {
                 return nil, err
             }
 
+            bellPrice, err := listingBellPrice(timeout, db, bson.M{"price": price, "askingPrice": askingPrice})
+            if err != nil {
+                return nil, err
+            }
+
+            expiresAt := primitive.NewDateTimeFromTime(time.Now().Add(ListingExpiry))
+            if auction != nil {
+                expiresAt = auction["endsAt"].(primitive.DateTime)
+            }
             res, err := listingsCollection.InsertOne(timeout, bson.M{
+                "mode": mode,
                 "price": price,
+                "askingPrice": askingPrice,
+                "bellPrice": bellPrice,
+                "auction": auction,
+                "variation": variation,
+                "lineItems": lineItems,
+                "bundle": bundle,
                 "deleted": false,
+                "expiresAt": expiresAt,
+                "expired": false,
+                "renewals": 0,
                 "accepted": nil,
                 "seller": userObjID,
                 "buyer": nil,
                 "item": itemObjID,
                 "inquiries": bson.A{},
+                "bids": bson.A{},
+                "priceHistory": bson.A{},
             })
             if err != nil {
                 return nil, err
@@ -144,30 +351,192 @@ func CreateListing(ctx context.Context, db mongo.Database) graphql.Field {
                 return nil, err
             }
 
-            err = addToBsonArray(timeout, itemObjID, *itemsCollection, "listings", res.InsertedID)
-            if err != nil {
+            added := make(map[primitive.ObjectID]bool)
+            undo := func() {
                 listingsCollection.DeleteOne(timeout, bson.M{"_id": res.InsertedID})
-                return nil, err
+                for lineItemObjID := range added {
+                    pullFromBsonArray(timeout, lineItemObjID, *itemsCollection, "listings", res.InsertedID)
+                }
+            }
+            for _, l := range lineItems {
+                lineItemObjID := l.(bson.M)["item"].(primitive.ObjectID)
+                if added[lineItemObjID] {
+                    continue
+                }
+                err = addToBsonArray(timeout, lineItemObjID, *itemsCollection, "listings", res.InsertedID)
+                if err != nil {
+                    undo()
+                    return nil, err
+                }
+                added[lineItemObjID] = true
             }
 
             err = addToBsonArray(timeout, userObjID, *usersCollection, "listings", res.InsertedID)
             if err != nil {
-                listingsCollection.DeleteOne(timeout, bson.M{"_id": res.InsertedID})
-                pullFromBsonArray(ctx, itemObjID, *itemsCollection, "listings", res.InsertedID)
+                undo()
                 return nil, err
             }
 
+            // bundles don't compare to the price of a single item
+            if bells, ok := price.(int); ok && mode == ListingModeFixed && !bundle {
+                warnIfUnusualPrice(timeout, p.Context, db, itemObjID, variation, bells)
+                if err = flagListing(timeout, db, listing); err != nil {
+                    log.Println(err)
+                }
+                // matching gets its own time, so that the checks above can't use it up
+                matchTimeout, cancelMatch := context.WithTimeout(ctx, time.Second * 3)
+                defer cancelMatch()
+                if err = matchListing(matchTimeout, db, listing); err != nil {
+                    log.Println(err)
+                }
+            }
+
             return listing, nil
         },
     }
 }
 
-// DeleteListing deletes a listing from the database, and updates the associated
-// item and user.
+// UpdateListing changes the price of a listing that is still open. Each change is
+// recorded in the listing's priceHistory, and buyers with open inquiries on the listing
+// are notified when the price drops. Only listings priced in bells can be updated.
+func UpdateListing(ctx context.Context, db mongo.Database) graphql.Field {
+    listingsCollection := db.Collection("listings")
+    inquiriesCollection := db.Collection("inquiries")
+
+    return graphql.Field {
+        Type: ListingType,
+        Description: "Change the price of a listing",
+        Args: graphql.FieldConfigArgument {
+            "listingID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "price": &graphql.ArgumentConfig {
+                Type: graphql.Int,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            listingID, prs := p.Args["listingID"]
+            if !prs {
+                return nil, errors.New("Listing ID not given for listing update")
+            }
+            listingObjID, err := primitive.ObjectIDFromHex(listingID.(string))
+            if err != nil {
+                return nil, err
+            }
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for listing update")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
+            price, prs := p.Args["price"].(int)
+            if !prs {
+                return nil, errors.New("Price not given for listing update")
+            }
+            if price < 0 || price > 100000000 {
+                return nil, errors.New("Price must be between 0 and 100 mil")
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            var listing bson.M
+            err = listingsCollection.FindOne(timeout, bson.M{"_id": listingObjID}).Decode(&listing)
+            if err != nil {
+                return nil, err
+            }
+            if listing["seller"] != userObjID {
+                return nil, errors.New("Only the seller can update a listing")
+            }
+            if !listingIsOpen(listing) {
+                return nil, errors.New("Only open listings can be updated")
+            }
+            if listing["mode"] == ListingModeAuction {
+                return nil, errors.New("The price of an auction is set by its bids")
+            }
+            previous, ok := toInt(listing["price"])
+            if !ok {
+                return nil, errors.New("Only listings priced in bells can have their price updated")
+            }
+            if previous == price {
+                return listing, nil
+            }
+
+            // the filter makes sure nothing changed since the listing was read
+            filter := bson.M{
+                "_id": listingObjID,
+                "price": listing["price"],
+                "accepted": nil,
+                "deleted": bson.M{"$ne": true},
+                "expired": bson.M{"$ne": true},
+            }
+            update := bson.M{
+                "$set": bson.M{"price": price, "bellPrice": price},
+                "$push": bson.M{"priceHistory": bson.M{
+                    "previous": previous,
+                    "price": price,
+                    "changed": primitive.NewDateTimeFromTime(time.Now()),
+                }},
+            }
+            opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+            err = listingsCollection.FindOneAndUpdate(timeout, filter, update, opts).Decode(&listing)
+            if err == mongo.ErrNoDocuments {
+                return nil, errors.New("Listing changed while it was being updated, try again")
+            } else if err != nil {
+                return nil, err
+            }
+
+            if listing["bundle"] != true {
+                itemObjID := listing["item"].(primitive.ObjectID)
+                warnIfUnusualPrice(timeout, p.Context, db, itemObjID, listing["variation"], price)
+                if err = flagListing(timeout, db, listing); err != nil {
+                    log.Println(err)
+                }
+                if err = recheckPriceFixing(timeout, db, listing, previous); err != nil {
+                    log.Println(err)
+                }
+            }
+
+            if price < previous {
+                cursor, err := inquiriesCollection.Find(timeout, bson.M{"listing": listingObjID, "open": true})
+                if err != nil {
+                    log.Println(err)
+                    return listing, nil
+                }
+                defer cursor.Close(timeout)
+                for cursor.Next(timeout) {
+                    var inquiry bson.M
+                    if err = cursor.Decode(&inquiry); err != nil {
+                        log.Println(err)
+                        continue
+                    }
+                    message := fmt.Sprintf("The price of a listing you inquired about dropped from %d to %d", previous, price)
+                    refs := bson.M{"listing": listingObjID, "inquiry": inquiry["_id"]}
+                    if err = notify(timeout, db, inquiry["buyer"].(primitive.ObjectID), NotificationPriceDrop, message, refs); err != nil {
+                        log.Println(err)
+                    }
+                }
+                if err := cursor.Err(); err != nil {
+                    return listing, nil
+                }
+            }
+
+            return listing, nil
+        },
+    }
+}
+
+// DeleteListing soft-deletes a listing, hiding it from public queries while keeping it
+// around for the inquiries and transactions that refer to it. Open inquiries on the
+// listing are closed. The listing can be brought back with RestoreListing within
+// ListingRestoreGracePeriod. Only the seller and admins can delete a listing.
 func DeleteListing(ctx context.Context, db mongo.Database) graphql.Field {
-    itemsCollection := db.Collection("items")
     listingsCollection := db.Collection("listings")
-    usersCollection := db.Collection("users")
 
     return graphql.Field {
         Type: ListingType,
@@ -176,6 +545,9 @@ func DeleteListing(ctx context.Context, db mongo.Database) graphql.Field {
             "listingID": &graphql.ArgumentConfig {
                 Type: graphql.ID,
             },
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
         },
         Resolve: func (p graphql.ResolveParams) (interface{}, error) {
             listingID, prs := p.Args["listingID"]
@@ -186,24 +558,115 @@ func DeleteListing(ctx context.Context, db mongo.Database) graphql.Field {
             if err != nil {
                 return nil, err
             }
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for listing deletion")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
 
             timeout, cancel := context.WithTimeout(ctx, time.Second)
             defer cancel()
 
             var listing bson.M
-            err = listingsCollection.FindOneAndDelete(timeout, bson.M{"_id": listingObjID}, nil).Decode(&listing)
+            err = listingsCollection.FindOne(timeout, bson.M{"_id": listingObjID}).Decode(&listing)
             if err != nil {
                 return nil, err
             }
+            if listing["seller"] != userObjID {
+                if err = requireAdmin(timeout, db, userID); err != nil {
+                    return nil, errors.New("Only the seller and admins can delete a listing")
+                }
+            }
 
-            itemObjID := listing["item"].(primitive.ObjectID)
-            err = pullFromBsonArray(timeout, itemObjID, *itemsCollection, "listings", listingObjID)
+            filter := bson.M{"_id": listingObjID, "deleted": bson.M{"$ne": true}}
+            update := bson.M{"$set": bson.M{"deleted": true, "deletedAt": primitive.NewDateTimeFromTime(time.Now())}}
+            opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+            err = listingsCollection.FindOneAndUpdate(timeout, filter, update, opts).Decode(&listing)
+            if err == mongo.ErrNoDocuments {
+                return nil, errors.New("Listing already deleted")
+            } else if err != nil {
+                return nil, err
+            }
+
+            err = closeOpenInquiries(timeout, db, listingObjID, InquiryClosedListingDeleted)
             if err != nil {
                 log.Println(err)
             }
+            if err = recheckPriceFixing(timeout, db, listing, listing["price"]); err != nil {
+                log.Println(err)
+            }
+
+            return listing, nil
+        },
+    }
+}
+
+// RestoreListing undoes the deletion of a listing, as long as it was deleted less than
+// ListingRestoreGracePeriod ago. Only the seller can restore their listing. Inquiries
+// that were closed because of the deletion are opened again.
+func RestoreListing(ctx context.Context, db mongo.Database) graphql.Field {
+    listingsCollection := db.Collection("listings")
+
+    return graphql.Field {
+        Type: ListingType,
+        Description: "Restore a deleted listing",
+        Args: graphql.FieldConfigArgument {
+            "listingID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            listingID, prs := p.Args["listingID"]
+            if !prs {
+                return nil, errors.New("Listing ID not given for listing restoration")
+            }
+            listingObjID, err := primitive.ObjectIDFromHex(listingID.(string))
+            if err != nil {
+                return nil, err
+            }
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for listing restoration")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
 
-            userObjID := listing["seller"].(primitive.ObjectID)
-            err = pullFromBsonArray(timeout, userObjID, *usersCollection, "listings", listingObjID)
+            var listing bson.M
+            err = listingsCollection.FindOne(timeout, bson.M{"_id": listingObjID}).Decode(&listing)
+            if err != nil {
+                return nil, err
+            }
+            if listing["seller"] != userObjID {
+                return nil, errors.New("Only the seller can restore a listing")
+            }
+            if listing["deleted"] != true {
+                return nil, errors.New("Listing is not deleted")
+            }
+            deletedAt, _ := listing["deletedAt"].(primitive.DateTime)
+            if time.Since(deletedAt.Time()) > ListingRestoreGracePeriod {
+                return nil, errors.New("Listing was deleted too long ago to be restored")
+            }
+
+            filter := bson.M{"_id": listingObjID, "deleted": true}
+            update := bson.M{"$set": bson.M{"deleted": false, "deletedAt": nil}}
+            opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+            err = listingsCollection.FindOneAndUpdate(timeout, filter, update, opts).Decode(&listing)
+            if err != nil {
+                return nil, err
+            }
+
+            err = reopenInquiries(timeout, db, listingObjID, InquiryClosedListingDeleted)
             if err != nil {
                 log.Println(err)
             }
@@ -213,3 +676,163 @@ func DeleteListing(ctx context.Context, db mongo.Database) graphql.Field {
     }
 }
 
+// expireListings marks the open listings that are past their expiresAt as expired,
+// declines their pending inquiries and lets their sellers know. Auctions are left to
+// closeAuctions. A listing that fails to expire is logged and left for the next run,
+// without holding up the others.
+func expireListings(ctx context.Context, db mongo.Database) error {
+    filter := bson.M{
+        "expiresAt": bson.M{"$lte": primitive.NewDateTimeFromTime(time.Now())},
+        "expired": bson.M{"$ne": true},
+        "mode": bson.M{"$ne": ListingModeAuction},
+        "accepted": nil,
+        "deleted": bson.M{"$ne": true},
+    }
+    cursor, err := db.Collection("listings").Find(ctx, filter)
+    if err != nil {
+        return err
+    }
+    defer cursor.Close(ctx)
+    for cursor.Next(ctx) {
+        var listing bson.M
+        if err = cursor.Decode(&listing); err != nil {
+            return err
+        }
+        if err = expireListing(ctx, db, listing, filter); err != nil {
+            log.Printf("Expiring listing %s: %s", listing["_id"].(primitive.ObjectID).Hex(), err)
+        }
+    }
+    if err := cursor.Err(); err != nil {
+        return err
+    }
+    return nil
+}
+
+// expireListing expires a listing found by expireListings, as long as it still matches
+// the filter it was found with. If its inquiries can't be declined, the listing is put
+// back up so that expiring it can be tried again. Once they are, the listing stays
+// expired even if its seller can't be notified.
+func expireListing(ctx context.Context, db mongo.Database, listing bson.M, filter bson.M) error {
+    listingsCollection := db.Collection("listings")
+    listingObjID := listing["_id"].(primitive.ObjectID)
+    expire := bson.M{"_id": listingObjID}
+    for key, val := range filter {
+        expire[key] = val
+    }
+    res, err := listingsCollection.UpdateOne(ctx, expire, bson.M{"$set": bson.M{"expired": true}})
+    if err != nil {
+        return err
+    }
+    if res.ModifiedCount == 0 { // renewed or closed since it was found
+        return nil
+    }
+    if err = closeOpenInquiries(ctx, db, listingObjID, InquiryClosedListingExpired); err != nil {
+        listingsCollection.UpdateOne(ctx, bson.M{"_id": listingObjID}, bson.M{"$set": bson.M{"expired": false}})
+        return err
+    }
+    if err = recheckPriceFixing(ctx, db, listing, listing["price"]); err != nil {
+        log.Println(err)
+    }
+    sellerObjID := listing["seller"].(primitive.ObjectID)
+    err = notify(ctx, db, sellerObjID, NotificationListingExpired, "Your listing expired, renew it to put it back up", bson.M{"listing": listingObjID})
+    if err != nil {
+        log.Println(err)
+    }
+    return nil
+}
+
+// RenewListing puts a listing back up for another ListingExpiry, whether or not it has
+// expired yet. Inquiries declined because the listing expired are opened again. Each user
+// can only renew ListingRenewalCap times per ListingRenewalWindow.
+func RenewListing(ctx context.Context, db mongo.Database) graphql.Field {
+    listingsCollection := db.Collection("listings")
+    usersCollection := db.Collection("users")
+
+    return graphql.Field {
+        Type: ListingType,
+        Description: "Renew a listing",
+        Args: graphql.FieldConfigArgument {
+            "listingID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            listingID, prs := p.Args["listingID"]
+            if !prs {
+                return nil, errors.New("Listing ID not given for listing renewal")
+            }
+            listingObjID, err := primitive.ObjectIDFromHex(listingID.(string))
+            if err != nil {
+                return nil, err
+            }
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for listing renewal")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            var listing bson.M
+            err = listingsCollection.FindOne(timeout, bson.M{"_id": listingObjID}).Decode(&listing)
+            if err != nil {
+                return nil, err
+            }
+            if listing["seller"] != userObjID {
+                return nil, errors.New("Only the seller can renew a listing")
+            }
+            if listing["accepted"] != nil || listing["deleted"] == true {
+                return nil, errors.New("Only open or expired listings can be renewed")
+            }
+            if listing["mode"] == ListingModeAuction {
+                return nil, errors.New("Auctions cannot be renewed")
+            }
+
+            // drop renewals that fell out of the window, then only add this one if there
+            // is room left under the cap
+            now := primitive.NewDateTimeFromTime(time.Now())
+            since := primitive.NewDateTimeFromTime(time.Now().Add(-ListingRenewalWindow))
+            _, err = usersCollection.UpdateOne(timeout, bson.M{"_id": userObjID}, bson.M{"$pull": bson.M{"listingRenewals": bson.M{"$lt": since}}})
+            if err != nil {
+                return nil, err
+            }
+            capFilter := bson.M{"_id": userObjID, fmt.Sprintf("listingRenewals.%d", ListingRenewalCap - 1): bson.M{"$exists": false}}
+            res, err := usersCollection.UpdateOne(timeout, capFilter, bson.M{"$push": bson.M{"listingRenewals": now}})
+            if err != nil {
+                return nil, err
+            }
+            if res.ModifiedCount == 0 {
+                return nil, errors.New(fmt.Sprintf("Cannot renew more than %d listings per %s", ListingRenewalCap, ListingRenewalWindow))
+            }
+
+            wasExpired := listing["expired"] == true
+            filter := bson.M{"_id": listingObjID, "accepted": nil, "deleted": bson.M{"$ne": true}}
+            update := bson.M{
+                "$set": bson.M{"expiresAt": primitive.NewDateTimeFromTime(time.Now().Add(ListingExpiry)), "expired": false},
+                "$inc": bson.M{"renewals": 1},
+            }
+            opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+            err = listingsCollection.FindOneAndUpdate(timeout, filter, update, opts).Decode(&listing)
+            if err != nil {
+                pullFromBsonArray(timeout, userObjID, *usersCollection, "listingRenewals", now)
+                return nil, err
+            }
+
+            if wasExpired {
+                err = reopenInquiries(timeout, db, listingObjID, InquiryClosedListingExpired)
+                if err != nil {
+                    log.Println(err)
+                }
+            }
+
+            return listing, nil
+        },
+    }
+}
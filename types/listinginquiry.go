@@ -3,20 +3,33 @@ package types
 import (
     "context"
     "errors"
+    "log"
     "time"
 
     "go.mongodb.org/mongo-driver/bson"
     "go.mongodb.org/mongo-driver/bson/primitive"
     "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
     "github.com/graphql-go/graphql"
 )
 
+// Values of the closedReason field of an inquiry, for inquiries declined by the system
+// rather than by the seller
+const (
+    InquiryClosedListingDeleted = "LISTING_DELETED"
+    InquiryClosedListingExpired = "LISTING_EXPIRED"
+    InquiryClosedListingSold = "LISTING_SOLD"
+)
+
 type ListingInquiryStruct struct {
     id string
     note string
     deleted bool
     accepted string
     declined string
+    closedReason string
+    open bool
+    withdrawn string
     buyer *UserStruct
     listing *ListingStruct
 }
@@ -37,6 +50,14 @@ var ListingInquiryType = graphql.NewObject(
             "note": &graphql.Field {
                 Type: graphql.String,
             },
+            "lineItems": &graphql.Field {
+                Type: graphql.NewList(LineItemType),
+                Description: "The part of the listing inquired about, or null for all of it",
+            },
+            "offers": &graphql.Field {
+                Type: graphql.NewList(OfferType),
+                Description: "Every offer made on the inquiry, oldest first",
+            },
             "deleted": &graphql.Field {
                 Type: graphql.Boolean,
             },
@@ -46,6 +67,16 @@ var ListingInquiryType = graphql.NewObject(
             "declined": &graphql.Field {
                 Type: graphql.String, // TODO Date scalar
             },
+            "closedReason": &graphql.Field {
+                Type: graphql.String,
+            },
+            "open": &graphql.Field {
+                Type: graphql.Boolean,
+                Description: "Whether the inquiry is still waiting to be accepted, declined or withdrawn",
+            },
+            "withdrawn": &graphql.Field {
+                Type: graphql.String, // TODO Date scalar
+            },
         },
     },
 )
@@ -59,12 +90,73 @@ func InitListingInquiry(ctx context.Context, db mongo.Database) {
         Type: ListingType,
         Resolve: resolverGenerator(ctx, "listing", *db.Collection("listings")),
     })
+    ListingInquiryType.AddFieldConfig("transaction", &graphql.Field {
+        Type: TransactionType,
+        Resolve: resolverGenerator(ctx, "transaction", *db.Collection("transactions")),
+    })
+    ListingInquiryType.AddFieldConfig("messages", messagesField(ctx, db, "inquiry"))
+}
+
+// insertInquiry is a helper function used to add an inquiry to the database, updating the
+// relevant user and listing. Checking that the inquiry is allowed is up to the caller,
+// except that a buyer can only have one open inquiry per listing, which the database
+// enforces.
+// lineItems is nil for inquiries about the whole listing. If offer is an int, it is
+// added as the buyer's first offer.
+func insertInquiry(ctx context.Context, db mongo.Database, listingObjID primitive.ObjectID, buyerObjID primitive.ObjectID, note interface{}, lineItems primitive.A, offer interface{}) (bson.M, error) {
+    inquiriesCollection := db.Collection("inquiries")
+    listingsCollection := db.Collection("listings")
+    usersCollection := db.Collection("users")
+
+    offers := bson.A{}
+    if price, ok := offer.(int); ok {
+        offers = append(offers, newOffer(buyerObjID, price))
+    }
+    res, err := inquiriesCollection.InsertOne(ctx, bson.M{
+        "note": note,
+        "lineItems": lineItems,
+        "offers": offers,
+        "transaction": nil,
+        "open": true,
+        "accepted": nil,
+        "declined": nil,
+        "withdrawn": nil,
+        "closedReason": nil,
+        "buyer": buyerObjID,
+        "listing": listingObjID,
+    })
+    if isDuplicateKey(err) {
+        return nil, errors.New("User already has an open inquiry on this listing")
+    } else if err != nil {
+        return nil, err
+    }
+    var inquiry bson.M
+    err = inquiriesCollection.FindOne(ctx, bson.M{"_id": res.InsertedID}).Decode(&inquiry)
+    if err != nil {
+        return nil, err
+    }
+
+    err = addToBsonArray(ctx, listingObjID, *listingsCollection, "inquiries", res.InsertedID)
+    if err != nil {
+        inquiriesCollection.DeleteOne(ctx, bson.M{"_id": res.InsertedID})
+        return nil, err
+    }
+
+    err = addToBsonArray(ctx, buyerObjID, *usersCollection, "inquiries", res.InsertedID)
+    if err != nil {
+        inquiriesCollection.DeleteOne(ctx, bson.M{"_id": res.InsertedID})
+        pullFromBsonArray(ctx, listingObjID, *listingsCollection, "inquiries", res.InsertedID)
+        return nil, err
+    }
+
+    return inquiry, nil
 }
 
 // CreateInquiry creates an inquiry within the database, updating the relevant
-// user and listing.
+// user and listing. Buyers can inquire about part of a listing by giving the line items
+// and quantities they want, and can open the negotiation with an offer. A buyer can
+// only have one open inquiry per listing, but can inquire again once it is closed.
 func CreateInquiry(ctx context.Context, db mongo.Database) graphql.Field {
-    inquiriesCollection := db.Collection("inquiries")
     listingsCollection := db.Collection("listings")
     usersCollection := db.Collection("users")
 
@@ -82,6 +174,14 @@ func CreateInquiry(ctx context.Context, db mongo.Database) graphql.Field {
                 Type: graphql.String,
                 DefaultValue: nil,
             },
+            "lineItems": &graphql.ArgumentConfig {
+                Type: graphql.NewList(LineItemInput),
+                DefaultValue: nil,
+            },
+            "offer": &graphql.ArgumentConfig {
+                Type: graphql.Int,
+                DefaultValue: nil,
+            },
         },
         Resolve: func (p graphql.ResolveParams) (interface{}, error) {
             listingID, prs := p.Args["listingID"]
@@ -101,6 +201,10 @@ func CreateInquiry(ctx context.Context, db mongo.Database) graphql.Field {
                 return nil, err
             }
             note := p.Args["note"]
+            offer := p.Args["offer"]
+            if price, ok := offer.(int); ok && (price < 0 || price > 100000000) {
+                return nil, errors.New("Offer must be between 0 and 100 mil")
+            }
 
             timeout, cancel := context.WithTimeout(ctx, time.Second)
             defer cancel()
@@ -117,56 +221,156 @@ func CreateInquiry(ctx context.Context, db mongo.Database) graphql.Field {
                 return nil, err
             }
 
+            if !listingIsOpen(listing) {
+                return nil, errors.New("Cannot create inquiry towards a listing that isn't open")
+            }
             // check if user is trying to make an inquiry to themself
             if listing["seller"] == userObjID {
                 return nil, errors.New("User cannot create inquiry towards their own listing")
             }
-            // check if user is trying to make multipe inquiries
-            for _, iID := range user["inquiries"].(bson.A) {
-                var i bson.M
-                err = inquiriesCollection.FindOne(timeout, bson.M{"_id": iID}).Decode(&i)
+
+            var lineItems primitive.A
+            if input, ok := p.Args["lineItems"].([]interface{}); ok {
+                lineItems, err = inquiryLineItemsFromInput(listing, input)
                 if err != nil {
                     return nil, err
                 }
-                if i["buyer"] == userObjID {
-                    return nil, errors.New("User cannot make multiple inquiries towards same listing")
-                }
             }
 
-            res, err := inquiriesCollection.InsertOne(timeout, bson.M{
-                "note": note,
-                "accepted": nil,
-                "declined": nil,
-                "buyer": userObjID,
-                "listing": listingObjID,
-            })
-            if err != nil {
-                return nil, err
-            }
-            var inquiry bson.M
-            err = inquiriesCollection.FindOne(timeout, bson.M{"_id": res.InsertedID}).Decode(&inquiry)
-            if err != nil {
-                return nil, err
+            if offer != nil && listing["mode"] == ListingModeAuction {
+                return nil, errors.New("The price of an auction is set by its bids")
             }
 
-            err = addToBsonArray(timeout, listingObjID, *listingsCollection, "inquiries", res.InsertedID)
+            return insertInquiry(timeout, db, listingObjID, userObjID, note, lineItems, offer)
+        },
+    }
+}
+
+// closeOpenInquiries declines every open inquiry on a listing, recording why they were
+// closed.
+func closeOpenInquiries(ctx context.Context, db mongo.Database, listingObjID primitive.ObjectID, reason string) error {
+    filter := bson.M{"listing": listingObjID, "open": true}
+    update := bson.M{"$set": bson.M{
+        "open": false,
+        "declined": primitive.NewDateTimeFromTime(time.Now()),
+        "closedReason": reason,
+    }}
+    _, err := db.Collection("inquiries").UpdateMany(ctx, filter, update)
+    return err
+}
+
+// reopenInquiries undoes closeOpenInquiries for the inquiries on a listing that were
+// closed for the given reason.
+func reopenInquiries(ctx context.Context, db mongo.Database, listingObjID primitive.ObjectID, reason string) error {
+    filter := bson.M{"listing": listingObjID, "accepted": nil, "closedReason": reason}
+    update := bson.M{"$set": bson.M{"open": true, "declined": nil, "closedReason": nil}}
+    _, err := db.Collection("inquiries").UpdateMany(ctx, filter, update)
+    return err
+}
+
+// closeInquiry closes an open inquiry for one of its participants. The seller declines
+// inquiries and the buyer withdraws them; key is the field holding when that happened.
+func closeInquiry(ctx context.Context, db mongo.Database, args map[string]interface{}, key string) (bson.M, error) {
+    inquiryID, prs := args["inquiryID"]
+    if !prs {
+        return nil, errors.New("No inquiry ID given for closing an inquiry")
+    }
+    inquiryObjID, err := primitive.ObjectIDFromHex(inquiryID.(string))
+    if err != nil {
+        return nil, err
+    }
+    userID, prs := args["userID"]
+    if !prs {
+        return nil, errors.New("No user ID given for closing an inquiry")
+    }
+    userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+    if err != nil {
+        return nil, err
+    }
+
+    var inquiry bson.M
+    err = db.Collection("inquiries").FindOne(ctx, bson.M{"_id": inquiryObjID}).Decode(&inquiry)
+    if err != nil {
+        return nil, err
+    }
+    if key == "withdrawn" && inquiry["buyer"] != userObjID {
+        return nil, errors.New("Only the buyer can withdraw an inquiry")
+    }
+    if key == "declined" {
+        var listing bson.M
+        err = db.Collection("listings").FindOne(ctx, bson.M{"_id": inquiry["listing"]}).Decode(&listing)
+        if err != nil {
+            return nil, err
+        }
+        if listing["seller"] != userObjID {
+            return nil, errors.New("Only the seller can decline an inquiry")
+        }
+    }
+
+    filter := bson.M{"_id": inquiryObjID, "open": true}
+    update := bson.M{"$set": bson.M{"open": false, key: primitive.NewDateTimeFromTime(time.Now())}}
+    opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+    err = db.Collection("inquiries").FindOneAndUpdate(ctx, filter, update, opts).Decode(&inquiry)
+    if err == mongo.ErrNoDocuments {
+        return nil, errors.New("Inquiry is no longer open")
+    }
+    return inquiry, err
+}
+
+// DeclineInquiry lets the seller of a listing decline an open inquiry on it. The buyer is
+// notified and can inquire again.
+func DeclineInquiry(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: ListingInquiryType,
+        Description: "Decline a listing inquiry",
+        Args: graphql.FieldConfigArgument {
+            "inquiryID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            inquiry, err := closeInquiry(timeout, db, p.Args, "declined")
             if err != nil {
-                inquiriesCollection.DeleteOne(timeout, bson.M{"_id": res.InsertedID})
                 return nil, err
             }
-
-            err = addToBsonArray(timeout, userObjID, *usersCollection, "inquiries", res.InsertedID)
+            refs := bson.M{"listing": inquiry["listing"], "inquiry": inquiry["_id"]}
+            err = notify(timeout, db, inquiry["buyer"].(primitive.ObjectID), NotificationInquiryDeclined, "Your inquiry was declined", refs)
             if err != nil {
-                inquiriesCollection.DeleteOne(timeout, bson.M{"_id": res.InsertedID})
-                pullFromBsonArray(timeout, listingObjID, *listingsCollection, "inquiries", res.InsertedID)
-                return nil, err
+                log.Println(err)
             }
-
             return inquiry, nil
         },
     }
 }
 
+// WithdrawInquiry lets a buyer withdraw their open inquiry.
+func WithdrawInquiry(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: ListingInquiryType,
+        Description: "Withdraw a listing inquiry",
+        Args: graphql.FieldConfigArgument {
+            "inquiryID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            return closeInquiry(timeout, db, p.Args, "withdrawn")
+        },
+    }
+}
+
 // deleteInquiry is a helper function used by mutations to delete inquiries from the database,
 // updating the relevant user and listing.
 func deleteInquiry(ctx context.Context, id primitive.ObjectID, db mongo.Database) (bson.M, error) {
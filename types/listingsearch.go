@@ -0,0 +1,247 @@
+package types
+
+import (
+    "context"
+    "errors"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "github.com/graphql-go/graphql"
+)
+
+// Values of ListingSortEnum
+const (
+    ListingSortPrice = "PRICE"
+    ListingSortAge = "AGE"
+    ListingSortSellerReputation = "SELLER_REPUTATION"
+)
+
+// ListingSortEnum is what the listings query can be sorted by
+var ListingSortEnum = graphql.NewEnum(
+    graphql.EnumConfig {
+        Name: "ListingSort",
+        Values: graphql.EnumValueConfigMap {
+            ListingSortPrice: &graphql.EnumValueConfig {
+                Value: ListingSortPrice,
+            },
+            ListingSortAge: &graphql.EnumValueConfig {
+                Value: ListingSortAge,
+                Description: "Ascending is oldest first",
+            },
+            ListingSortSellerReputation: &graphql.EnumValueConfig {
+                Value: ListingSortSellerReputation,
+            },
+        },
+    },
+)
+
+// SortDirectionEnum is the direction of a sort
+var SortDirectionEnum = graphql.NewEnum(
+    graphql.EnumConfig {
+        Name: "SortDirection",
+        Values: graphql.EnumValueConfigMap {
+            "ASC": &graphql.EnumValueConfig {
+                Value: 1,
+            },
+            "DESC": &graphql.EnumValueConfig {
+                Value: -1,
+            },
+        },
+    },
+)
+
+// listingSortKeys are the fields of the search pipeline each ListingSort sorts on.
+var listingSortKeys = map[string]string {
+    ListingSortPrice: "bellPrice",
+    ListingSortAge: "_id",
+    ListingSortSellerReputation: "sellerDoc.reputation",
+}
+
+// ListingConnectionType is a page of the listings query
+var ListingConnectionType = connectionType("Listing", ListingType)
+
+// listingSearchFilter builds the $match stage of a listing search from the arguments of
+// the listings query. Deleted listings are never included. Filters on items match any
+// line item of a bundle, and so does the variation, on the line item of the searched item
+// if there is one. Filters on price use the bellPrice of the listing, so they cover
+// listings priced in something other than bells too. Filters on the seller are applied
+// after the seller is looked up.
+func listingSearchFilter(ctx context.Context, db mongo.Database, args map[string]interface{}) (bson.M, error) {
+    filter := bson.M{"deleted": bson.M{"$ne": true}}
+    items := bson.A{}
+    // a variation has to be on the line item of the item searched for, if there is one
+    lineItem := bson.M{}
+    if itemID, prs := args["itemID"]; prs && itemID != nil {
+        itemObjID, err := primitive.ObjectIDFromHex(itemID.(string))
+        if err != nil {
+            return nil, err
+        }
+        items = append(items, itemObjID)
+        lineItem["item"] = itemObjID
+    }
+    if category, prs := args["category"]; prs && category != nil {
+        itemObjIDs, err := db.Collection("items").Distinct(ctx, "_id", bson.M{"category": category})
+        if err != nil {
+            return nil, err
+        }
+        items = append(items, bson.M{"$in": itemObjIDs})
+    }
+    and := bson.A{}
+    for _, item := range items {
+        and = append(and, bson.M{"$or": bson.A{bson.M{"item": item}, bson.M{"lineItems.item": item}}})
+    }
+    if variation, prs := args["variation"]; prs && variation != nil {
+        lineItem["variation"] = variation
+        and = append(and, bson.M{"$or": bson.A{bson.M{"variation": variation}, bson.M{"lineItems": bson.M{"$elemMatch": lineItem}}}})
+    }
+    if len(and) > 0 {
+        filter["$and"] = and
+    }
+    price := bson.M{}
+    if minPrice, prs := args["minPrice"]; prs && minPrice != nil {
+        price["$gte"] = minPrice
+    }
+    if maxPrice, prs := args["maxPrice"]; prs && maxPrice != nil {
+        price["$lte"] = maxPrice
+    }
+    if len(price) > 0 {
+        filter["bellPrice"] = price
+    }
+    if createdAfter, prs := args["createdAfter"]; prs && createdAfter != nil {
+        after, err := parseDate(createdAfter.(string))
+        if err != nil {
+            return nil, err
+        }
+        filter["_id"] = bson.M{"$gte": primitive.NewObjectIDFromTimestamp(after)}
+    }
+    if openOnly, _ := args["openOnly"].(bool); openOnly {
+        filter["accepted"] = nil
+        filter["expired"] = bson.M{"$ne": true}
+    }
+    return filter, nil
+}
+
+// Listings is a query for searching listings across the whole market. Results are
+// returned as a connection, sorted by the given key and then by age.
+func Listings(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: ListingConnectionType,
+        Description: "Search listings",
+        Args: connectionArgs(graphql.FieldConfigArgument {
+            "itemID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+                DefaultValue: nil,
+            },
+            "category": &graphql.ArgumentConfig {
+                Type: graphql.String,
+                DefaultValue: nil,
+            },
+            "variation": &graphql.ArgumentConfig {
+                Type: graphql.String,
+                DefaultValue: nil,
+            },
+            "minPrice": &graphql.ArgumentConfig {
+                Type: graphql.Int,
+                DefaultValue: nil,
+            },
+            "maxPrice": &graphql.ArgumentConfig {
+                Type: graphql.Int,
+                DefaultValue: nil,
+            },
+            "minSellerReputation": &graphql.ArgumentConfig {
+                Type: graphql.Int,
+                DefaultValue: nil,
+            },
+            "createdAfter": &graphql.ArgumentConfig {
+                Type: graphql.String,
+                DefaultValue: nil,
+            },
+            "openOnly": &graphql.ArgumentConfig {
+                Type: graphql.Boolean,
+                DefaultValue: false,
+            },
+            "sort": &graphql.ArgumentConfig {
+                Type: ListingSortEnum,
+                DefaultValue: ListingSortAge,
+            },
+            "direction": &graphql.ArgumentConfig {
+                Type: SortDirectionEnum,
+                DefaultValue: -1,
+            },
+        }),
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            skip, limit, err := pageArgs(p)
+            if err != nil {
+                return nil, err
+            }
+            sortKey, prs := listingSortKeys[p.Args["sort"].(string)]
+            if !prs {
+                return nil, errors.New("Invalid sort for listings")
+            }
+            direction, _ := p.Args["direction"].(int)
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second * 3)
+            defer cancel()
+
+            filter, err := listingSearchFilter(timeout, db, p.Args)
+            if err != nil {
+                return nil, err
+            }
+            pipeline := []bson.M{
+                {"$match": filter},
+                {"$lookup": bson.M{"from": "users", "localField": "seller", "foreignField": "_id", "as": "sellerDoc"}},
+                {"$unwind": bson.M{"path": "$sellerDoc", "preserveNullAndEmptyArrays": true}},
+            }
+            if minReputation, prs := p.Args["minSellerReputation"]; prs && minReputation != nil {
+                pipeline = append(pipeline, bson.M{"$match": bson.M{"sellerDoc.reputation": bson.M{"$gte": minReputation}}})
+            }
+            sort := bson.D{{Key: sortKey, Value: direction}}
+            if sortKey == "bellPrice" {
+                // listings with no value in bells yet go last whichever way prices are sorted
+                pipeline = append(pipeline, bson.M{"$addFields": bson.M{
+                    "priced": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{bson.M{"$ifNull": bson.A{"$bellPrice", nil}}, nil}}, 0, 1}},
+                }})
+                sort = append(bson.D{{Key: "priced", Value: -1}}, sort...)
+            }
+            if sortKey != "_id" {
+                sort = append(sort, bson.E{Key: "_id", Value: -1})
+            }
+            pipeline = append(pipeline, bson.M{"$facet": bson.M{
+                "total": bson.A{bson.M{"$count": "count"}},
+                "page": bson.A{
+                    bson.M{"$sort": sort},
+                    bson.M{"$skip": skip},
+                    bson.M{"$limit": limit},
+                    bson.M{"$project": bson.M{"sellerDoc": 0, "priced": 0}},
+                },
+            }})
+
+            cursor, err := db.Collection("listings").Aggregate(timeout, pipeline)
+            if err != nil {
+                return nil, err
+            }
+            defer cursor.Close(timeout)
+            var result struct {
+                Total []struct {
+                    Count int `bson:"count"`
+                } `bson:"total"`
+                Page []bson.M `bson:"page"`
+            }
+            if cursor.Next(timeout) {
+                if err = cursor.Decode(&result); err != nil {
+                    return nil, err
+                }
+            }
+            if err := cursor.Err(); err != nil {
+                return nil, err
+            }
+            total := 0
+            if len(result.Total) > 0 {
+                total = result.Total[0].Count
+            }
+            return newConnection(result.Page, skip, total), nil
+        },
+    }
+}
@@ -0,0 +1,407 @@
+package types
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "github.com/graphql-go/graphql"
+)
+
+// maxMessageLength is the longest a message body can be, in bytes.
+const maxMessageLength = 2000
+
+// messageBroker passes new messages on to the open subscriptions of this server.
+type messageBroker struct {
+    mu sync.Mutex
+    subscribers map[chan bson.M]bool
+}
+
+var messages = &messageBroker{subscribers: make(map[chan bson.M]bool)}
+
+// SubscribeMessages returns a channel that receives every message sent from now on, and
+// a function to call once the channel is no longer being read.
+func SubscribeMessages() (<-chan bson.M, func()) {
+    ch := make(chan bson.M, 16)
+    messages.mu.Lock()
+    messages.subscribers[ch] = true
+    messages.mu.Unlock()
+    return ch, func() {
+        messages.mu.Lock()
+        delete(messages.subscribers, ch)
+        messages.mu.Unlock()
+    }
+}
+
+// publish sends a message to every subscriber. Subscribers that have fallen behind miss
+// the message rather than holding up the sender.
+func (b *messageBroker) publish(message bson.M) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    for ch := range b.subscribers {
+        select {
+        case ch <- message:
+        default:
+        }
+    }
+}
+
+// MessageType corresponds to the "messages" collection
+var MessageType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "Message",
+        Fields: graphql.Fields {
+            "id": &graphql.Field {
+                Type: graphql.ID,
+                Resolve: idResolver,
+            },
+            "created": &graphql.Field {
+                Type: graphql.String,
+                Resolve: timestampResolver,
+            },
+            "body": &graphql.Field {
+                Type: graphql.String,
+            },
+            "read": &graphql.Field {
+                Type: graphql.Boolean,
+            },
+        },
+    },
+)
+
+// MessageConnectionType is a page of the messages of an inquiry or transaction
+var MessageConnectionType = connectionType("Message", MessageType)
+
+func InitMessageType(ctx context.Context, db mongo.Database) {
+    MessageType.AddFieldConfig("sender", &graphql.Field {
+        Type: UserType,
+        Resolve: resolverGenerator(ctx, "sender", *db.Collection("users")),
+    })
+    MessageType.AddFieldConfig("recipient", &graphql.Field {
+        Type: UserType,
+        Resolve: resolverGenerator(ctx, "recipient", *db.Collection("users")),
+    })
+    MessageType.AddFieldConfig("inquiry", &graphql.Field {
+        Type: ListingInquiryType,
+        Resolve: resolverGenerator(ctx, "inquiry", *db.Collection("inquiries")),
+    })
+    MessageType.AddFieldConfig("transaction", &graphql.Field {
+        Type: TransactionType,
+        Resolve: resolverGenerator(ctx, "transaction", *db.Collection("transactions")),
+    })
+}
+
+// threadParticipants returns the buyer and seller of the inquiry or transaction a thread
+// of messages belongs to. key is "inquiry" or "transaction".
+func threadParticipants(ctx context.Context, db mongo.Database, key string, doc bson.M) (primitive.ObjectID, primitive.ObjectID, error) {
+    buyerObjID, _ := doc["buyer"].(primitive.ObjectID)
+    if key == "transaction" {
+        sellerObjID, _ := doc["seller"].(primitive.ObjectID)
+        return buyerObjID, sellerObjID, nil
+    }
+    var listing bson.M
+    err := db.Collection("listings").FindOne(ctx, bson.M{"_id": doc["listing"]}).Decode(&listing)
+    if err != nil {
+        return primitive.NilObjectID, primitive.NilObjectID, err
+    }
+    sellerObjID, _ := listing["seller"].(primitive.ObjectID)
+    return buyerObjID, sellerObjID, nil
+}
+
+// threadMessagesResolver gets the messages of an inquiry or transaction, oldest first, as
+// a connection. Only the buyer, the seller and admins can read them.
+func threadMessagesResolver(ctx context.Context, db mongo.Database, key string) graphql.FieldResolveFn {
+    return func (p graphql.ResolveParams) (interface{}, error) {
+        doc := p.Source.(primitive.M)
+        viewerID, ok := p.Args["viewerID"].(string)
+        if !ok {
+            return nil, errors.New("Viewer ID not given for reading messages")
+        }
+        viewerObjID, err := primitive.ObjectIDFromHex(viewerID)
+        if err != nil {
+            return nil, err
+        }
+        skip, limit, err := pageArgs(p)
+        if err != nil {
+            return nil, err
+        }
+
+        timeout, cancel := context.WithTimeout(ctx, time.Second)
+        defer cancel()
+
+        buyerObjID, sellerObjID, err := threadParticipants(timeout, db, key, doc)
+        if err != nil {
+            return nil, err
+        }
+        if viewerObjID != buyerObjID && viewerObjID != sellerObjID {
+            if err = requireAdmin(timeout, db, viewerID); err != nil {
+                return nil, errors.New("Only the buyer, the seller and admins can read these messages")
+            }
+        }
+
+        filter := bson.M{key: doc["_id"]}
+        total, err := db.Collection("messages").CountDocuments(timeout, filter)
+        if err != nil {
+            return nil, err
+        }
+        opts := options.Find().SetSort(bson.M{"_id": 1}).SetSkip(int64(skip)).SetLimit(int64(limit))
+        cursor, err := db.Collection("messages").Find(timeout, filter, opts)
+        if err != nil {
+            return nil, err
+        }
+        defer cursor.Close(timeout)
+        nodes := make([]bson.M, 0, limit)
+        for cursor.Next(timeout) {
+            var message bson.M
+            if err = cursor.Decode(&message); err != nil {
+                return nil, err
+            }
+            nodes = append(nodes, message)
+        }
+        if err := cursor.Err(); err != nil {
+            return nil, err
+        }
+        return newConnection(nodes, skip, int(total)), nil
+    }
+}
+
+// messagesField is the messages field of ListingInquiryType and TransactionType.
+func messagesField(ctx context.Context, db mongo.Database, key string) *graphql.Field {
+    return &graphql.Field {
+        Type: MessageConnectionType,
+        Args: connectionArgs(graphql.FieldConfigArgument {
+            "viewerID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+        }),
+        Resolve: threadMessagesResolver(ctx, db, key),
+    }
+}
+
+// unreadMessagesResolver counts the messages sent to a user that they haven't read. Only
+// the user and admins can see the count.
+func unreadMessagesResolver(ctx context.Context, db mongo.Database) graphql.FieldResolveFn {
+    return func (p graphql.ResolveParams) (interface{}, error) {
+        timeout, cancel := context.WithTimeout(ctx, time.Second)
+        defer cancel()
+        filter := bson.M{"recipient": p.Source.(primitive.M)["_id"], "read": false}
+        if err := requireSelfOrAdmin(timeout, db, p.Args["viewerID"], filter["recipient"]); err != nil {
+            return nil, err
+        }
+        return db.Collection("messages").CountDocuments(timeout, filter)
+    }
+}
+
+// threadFromArgs reads the inquiryID or transactionID argument of a messaging mutation,
+// exactly one of which has to be given, and returns its key and ObjectID.
+func threadFromArgs(args map[string]interface{}) (string, primitive.ObjectID, error) {
+    inquiryID, hasInquiry := args["inquiryID"].(string)
+    transactionID, hasTransaction := args["transactionID"].(string)
+    if hasInquiry == hasTransaction {
+        return "", primitive.NilObjectID, errors.New("Exactly one of inquiryID and transactionID must be given")
+    }
+    if hasInquiry {
+        objID, err := primitive.ObjectIDFromHex(inquiryID)
+        return "inquiry", objID, err
+    }
+    objID, err := primitive.ObjectIDFromHex(transactionID)
+    return "transaction", objID, err
+}
+
+// SendMessage sends a message from the buyer to the seller of an inquiry or transaction,
+// or the other way around. The message is also pushed to subscriptions.
+func SendMessage(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: MessageType,
+        Description: "Send a message about an inquiry or transaction",
+        Args: graphql.FieldConfigArgument {
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "inquiryID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+                DefaultValue: nil,
+            },
+            "transactionID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+                DefaultValue: nil,
+            },
+            "body": &graphql.ArgumentConfig {
+                Type: graphql.String,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for sending a message")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
+            key, threadObjID, err := threadFromArgs(p.Args)
+            if err != nil {
+                return nil, err
+            }
+            body, _ := p.Args["body"].(string)
+            if len(body) < 1 || len(body) > maxMessageLength {
+                return nil, errors.New(fmt.Sprintf("Message must be between 1 and %d characters", maxMessageLength))
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            collection := "inquiries"
+            if key == "transaction" {
+                collection = "transactions"
+            }
+            var doc bson.M
+            err = db.Collection(collection).FindOne(timeout, bson.M{"_id": threadObjID}).Decode(&doc)
+            if err != nil {
+                return nil, err
+            }
+            buyerObjID, sellerObjID, err := threadParticipants(timeout, db, key, doc)
+            if err != nil {
+                return nil, err
+            }
+            var recipient primitive.ObjectID
+            switch userObjID {
+            case buyerObjID:
+                recipient = sellerObjID
+            case sellerObjID:
+                recipient = buyerObjID
+            default:
+                return nil, errors.New("Only the buyer and seller can send messages here")
+            }
+
+            message := bson.M{
+                "inquiry": nil,
+                "transaction": nil,
+                "sender": userObjID,
+                "recipient": recipient,
+                "body": body,
+                "read": false,
+            }
+            message[key] = threadObjID
+            res, err := db.Collection("messages").InsertOne(timeout, message)
+            if err != nil {
+                return nil, err
+            }
+            message["_id"] = res.InsertedID
+            messages.publish(message)
+
+            return message, nil
+        },
+    }
+}
+
+// MarkMessagesRead marks the messages sent to a user as read. The messages can be limited
+// to an inquiry or transaction, or to a list of message IDs; otherwise all of them are
+// marked.
+func MarkMessagesRead(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: graphql.Int,
+        Description: "Mark messages as read, returning how many were marked",
+        Args: graphql.FieldConfigArgument {
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "inquiryID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+                DefaultValue: nil,
+            },
+            "transactionID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+                DefaultValue: nil,
+            },
+            "messageIDs": &graphql.ArgumentConfig {
+                Type: graphql.NewList(graphql.ID),
+                DefaultValue: nil,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for marking messages read")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
+            filter := bson.M{"recipient": userObjID, "read": false}
+            if p.Args["inquiryID"] != nil || p.Args["transactionID"] != nil {
+                key, threadObjID, err := threadFromArgs(p.Args)
+                if err != nil {
+                    return nil, err
+                }
+                filter[key] = threadObjID
+            }
+            if ids, ok := p.Args["messageIDs"].([]interface{}); ok {
+                objIDs := make(bson.A, len(ids))
+                for i, id := range ids {
+                    objIDs[i], err = primitive.ObjectIDFromHex(id.(string))
+                    if err != nil {
+                        return nil, err
+                    }
+                }
+                filter["_id"] = bson.M{"$in": objIDs}
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            res, err := db.Collection("messages").UpdateMany(timeout, filter, bson.M{"$set": bson.M{"read": true}})
+            if err != nil {
+                return nil, err
+            }
+            return res.ModifiedCount, nil
+        },
+    }
+}
+
+// MessageReceived is a subscription to the messages sent to a user. Each event is run
+// with the new message under "message" in the root object. Only the user and admins can
+// subscribe to their messages.
+func MessageReceived(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: MessageType,
+        Description: "Messages sent to a user",
+        Args: graphql.FieldConfigArgument {
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "viewerID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for message subscription")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
+            root, _ := p.Info.RootValue.(map[string]interface{})
+            message, ok := root["message"].(bson.M)
+            if !ok || message["recipient"] != userObjID {
+                return nil, nil
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            if err = requireSelfOrAdmin(timeout, db, p.Args["viewerID"], userObjID); err != nil {
+                return nil, err
+            }
+            return message, nil
+        },
+    }
+}
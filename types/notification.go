@@ -0,0 +1,181 @@
+package types
+
+import (
+    "context"
+    "errors"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "github.com/graphql-go/graphql"
+)
+
+// Values of the kind field of a notification
+const (
+    NotificationPriceDrop = "PRICE_DROP"
+    NotificationListingExpired = "LISTING_EXPIRED"
+    NotificationOutbid = "OUTBID"
+    NotificationAuctionWon = "AUCTION_WON"
+    NotificationAuctionEnded = "AUCTION_ENDED"
+    NotificationOrderMatched = "ORDER_MATCHED"
+    NotificationOfferMade = "OFFER_MADE"
+    NotificationOfferAccepted = "OFFER_ACCEPTED"
+    NotificationInquiryDeclined = "INQUIRY_DECLINED"
+    NotificationDodoCodeShared = "DODO_CODE_SHARED"
+    NotificationTradeTimeProposed = "TRADE_TIME_PROPOSED"
+    NotificationTradeTimeConfirmed = "TRADE_TIME_CONFIRMED"
+    NotificationTransactionCompleted = "TRANSACTION_COMPLETED"
+    NotificationTransactionFailed = "TRANSACTION_FAILED"
+    NotificationTransactionDisputed = "TRANSACTION_DISPUTED"
+    NotificationDisputeResolved = "DISPUTE_RESOLVED"
+    NotificationReportClosed = "REPORT_CLOSED"
+)
+
+// NotificationType corresponds to the "notifications" collection
+var NotificationType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "Notification",
+        Fields: graphql.Fields {
+            "id": &graphql.Field {
+                Type: graphql.ID,
+                Resolve: idResolver,
+            },
+            "created": &graphql.Field {
+                Type: graphql.String,
+                Resolve: timestampResolver,
+            },
+            "kind": &graphql.Field {
+                Type: graphql.String,
+            },
+            "message": &graphql.Field {
+                Type: graphql.String,
+            },
+            "read": &graphql.Field {
+                Type: graphql.Boolean,
+            },
+        },
+    },
+)
+
+func InitNotificationType(ctx context.Context, db mongo.Database) {
+    NotificationType.AddFieldConfig("user", &graphql.Field {
+        Type: UserType,
+        Resolve: resolverGenerator(ctx, "user", *db.Collection("users")),
+    })
+    NotificationType.AddFieldConfig("listing", &graphql.Field {
+        Type: ListingType,
+        Resolve: resolverGenerator(ctx, "listing", *db.Collection("listings")),
+    })
+    NotificationType.AddFieldConfig("inquiry", &graphql.Field {
+        Type: ListingInquiryType,
+        Resolve: resolverGenerator(ctx, "inquiry", *db.Collection("inquiries")),
+    })
+    NotificationType.AddFieldConfig("transaction", &graphql.Field {
+        Type: TransactionType,
+        Resolve: resolverGenerator(ctx, "transaction", *db.Collection("transactions")),
+    })
+}
+
+// notify sends a notification to a user. The notification can point at the listing,
+// inquiry or transaction it is about, by passing their ObjectIDs in refs under those
+// keys; the ones not given are stored as null.
+func notify(ctx context.Context, db mongo.Database, userObjID primitive.ObjectID, kind string, message string, refs bson.M) error {
+    notification := bson.M{
+        "user": userObjID,
+        "kind": kind,
+        "message": message,
+        "read": false,
+        "listing": nil,
+        "inquiry": nil,
+        "transaction": nil,
+    }
+    for key, val := range refs {
+        notification[key] = val
+    }
+    _, err := db.Collection("notifications").InsertOne(ctx, notification)
+    return err
+}
+
+// userNotificationsResolver gets the notifications of a user, newest first. Only the user
+// and admins can read them.
+func userNotificationsResolver(ctx context.Context, db mongo.Database) graphql.FieldResolveFn {
+    return func (p graphql.ResolveParams) (interface{}, error) {
+        filter := bson.M{"user": p.Source.(primitive.M)["_id"]}
+        if unreadOnly, _ := p.Args["unreadOnly"].(bool); unreadOnly {
+            filter["read"] = false
+        }
+        timeout, cancel := context.WithTimeout(ctx, time.Second)
+        defer cancel()
+        if err := requireSelfOrAdmin(timeout, db, p.Args["viewerID"], filter["user"]); err != nil {
+            return nil, err
+        }
+        opts := options.Find().SetSort(bson.M{"_id": -1})
+        cursor, err := db.Collection("notifications").Find(timeout, filter, opts)
+        if err != nil {
+            return nil, err
+        }
+        defer cursor.Close(timeout)
+        notifications := make([]bson.M, 0)
+        for cursor.Next(timeout) {
+            var notification bson.M
+            if err = cursor.Decode(&notification); err != nil {
+                return nil, err
+            }
+            notifications = append(notifications, notification)
+        }
+        if err := cursor.Err(); err != nil {
+            return nil, err
+        }
+        return notifications, nil
+    }
+}
+
+// MarkNotificationsRead marks a user's notifications as read. If no notification IDs
+// are given, all of the user's notifications are marked.
+func MarkNotificationsRead(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: graphql.Int,
+        Description: "Mark notifications as read, returning how many were marked",
+        Args: graphql.FieldConfigArgument {
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "notificationIDs": &graphql.ArgumentConfig {
+                Type: graphql.NewList(graphql.ID),
+                DefaultValue: nil,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for marking notifications read")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
+            filter := bson.M{"user": userObjID, "read": false}
+            if ids, ok := p.Args["notificationIDs"].([]interface{}); ok {
+                objIDs := make(bson.A, len(ids))
+                for i, id := range ids {
+                    objIDs[i], err = primitive.ObjectIDFromHex(id.(string))
+                    if err != nil {
+                        return nil, err
+                    }
+                }
+                filter["_id"] = bson.M{"$in": objIDs}
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            res, err := db.Collection("notifications").UpdateMany(timeout, filter, bson.M{"$set": bson.M{"read": true}})
+            if err != nil {
+                return nil, err
+            }
+            return res.ModifiedCount, nil
+        },
+    }
+}
@@ -0,0 +1,257 @@
+package types
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "github.com/graphql-go/graphql"
+)
+
+// OfferType is an entry of the offers array of an inquiry
+var OfferType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "Offer",
+        Fields: graphql.Fields {
+            "price": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "created": &graphql.Field {
+                Type: graphql.String, // TODO Date scalar
+            },
+        },
+    },
+)
+
+func InitOfferType(ctx context.Context, db mongo.Database) {
+    OfferType.AddFieldConfig("from", &graphql.Field {
+        Type: UserType,
+        Resolve: resolverGenerator(ctx, "from", *db.Collection("users")),
+    })
+}
+
+// newOffer makes an entry for the offers array of an inquiry.
+func newOffer(fromObjID primitive.ObjectID, price int) bson.M {
+    return bson.M{
+        "from": fromObjID,
+        "price": price,
+        "created": primitive.NewDateTimeFromTime(time.Now()),
+    }
+}
+
+// loadNegotiation gets an open inquiry and its listing for a user taking part in the
+// negotiation, and returns the ObjectID of the other side.
+func loadNegotiation(ctx context.Context, db mongo.Database, inquiryObjID primitive.ObjectID, userObjID primitive.ObjectID) (bson.M, bson.M, primitive.ObjectID, error) {
+    var inquiry bson.M
+    err := db.Collection("inquiries").FindOne(ctx, bson.M{"_id": inquiryObjID}).Decode(&inquiry)
+    if err != nil {
+        return nil, nil, primitive.NilObjectID, err
+    }
+    var listing bson.M
+    err = db.Collection("listings").FindOne(ctx, bson.M{"_id": inquiry["listing"]}).Decode(&listing)
+    if err != nil {
+        return nil, nil, primitive.NilObjectID, err
+    }
+
+    buyerObjID := inquiry["buyer"].(primitive.ObjectID)
+    sellerObjID := listing["seller"].(primitive.ObjectID)
+    var other primitive.ObjectID
+    switch userObjID {
+    case buyerObjID:
+        other = sellerObjID
+    case sellerObjID:
+        other = buyerObjID
+    default:
+        return nil, nil, primitive.NilObjectID, errors.New("Only the buyer and seller can negotiate on an inquiry")
+    }
+    if inquiry["open"] != true {
+        return nil, nil, primitive.NilObjectID, errors.New("Inquiry is no longer open")
+    }
+    if !listingIsOpen(listing) {
+        return nil, nil, primitive.NilObjectID, errors.New("Listing is no longer open")
+    }
+    if listing["mode"] == ListingModeAuction {
+        return nil, nil, primitive.NilObjectID, errors.New("The price of an auction is set by its bids")
+    }
+    return inquiry, listing, other, nil
+}
+
+// MakeOffer adds an offer to an inquiry. The buyer makes offers and the seller counters
+// them; the latest offer is the one the other side can accept.
+func MakeOffer(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: ListingInquiryType,
+        Description: "Make or counter an offer on an inquiry",
+        Args: graphql.FieldConfigArgument {
+            "inquiryID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "price": &graphql.ArgumentConfig {
+                Type: graphql.Int,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            inquiryID, prs := p.Args["inquiryID"]
+            if !prs {
+                return nil, errors.New("Inquiry ID not given for offer")
+            }
+            inquiryObjID, err := primitive.ObjectIDFromHex(inquiryID.(string))
+            if err != nil {
+                return nil, err
+            }
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for offer")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
+            price, prs := p.Args["price"].(int)
+            if !prs {
+                return nil, errors.New("Price not given for offer")
+            }
+            if price < 0 || price > 100000000 {
+                return nil, errors.New("Price must be between 0 and 100 mil")
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            inquiry, _, other, err := loadNegotiation(timeout, db, inquiryObjID, userObjID)
+            if err != nil {
+                return nil, err
+            }
+
+            filter := bson.M{"_id": inquiryObjID, "open": true}
+            update := bson.M{"$push": bson.M{"offers": newOffer(userObjID, price)}}
+            opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+            err = db.Collection("inquiries").FindOneAndUpdate(timeout, filter, update, opts).Decode(&inquiry)
+            if err == mongo.ErrNoDocuments {
+                return nil, errors.New("Inquiry is no longer open")
+            } else if err != nil {
+                return nil, err
+            }
+
+            message := fmt.Sprintf("You received an offer of %d", price)
+            refs := bson.M{"listing": inquiry["listing"], "inquiry": inquiryObjID}
+            if err = notify(timeout, db, other, NotificationOfferMade, message, refs); err != nil {
+                log.Println(err)
+            }
+
+            return inquiry, nil
+        },
+    }
+}
+
+// AcceptOffer accepts the latest offer on an inquiry, which has to have been made by the
+// other side. What the inquiry is for is taken off the listing, and a transaction is
+// started at the offered price. Once nothing remains on the listing, its other open
+// inquiries are closed.
+func AcceptOffer(ctx context.Context, db mongo.Database) graphql.Field {
+    inquiriesCollection := db.Collection("inquiries")
+
+    return graphql.Field {
+        Type: TransactionType,
+        Description: "Accept the latest offer on an inquiry",
+        Args: graphql.FieldConfigArgument {
+            "inquiryID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            inquiryID, prs := p.Args["inquiryID"]
+            if !prs {
+                return nil, errors.New("Inquiry ID not given for accepting an offer")
+            }
+            inquiryObjID, err := primitive.ObjectIDFromHex(inquiryID.(string))
+            if err != nil {
+                return nil, err
+            }
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for accepting an offer")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            inquiry, listing, other, err := loadNegotiation(timeout, db, inquiryObjID, userObjID)
+            if err != nil {
+                return nil, err
+            }
+            offers, _ := inquiry["offers"].(primitive.A)
+            if len(offers) == 0 {
+                return nil, errors.New("There is no offer to accept")
+            }
+            offer := offers[len(offers) - 1].(primitive.M)
+            if offer["from"] == userObjID {
+                return nil, errors.New("Cannot accept your own offer")
+            }
+            price, _ := toInt(offer["price"])
+
+            // the size check makes sure the offer being accepted is still the latest
+            filter := bson.M{"_id": inquiryObjID, "open": true, "offers": bson.M{"$size": len(offers)}}
+            accepted := bson.M{"$set": bson.M{"open": false, "accepted": primitive.NewDateTimeFromTime(time.Now())}}
+            res, err := inquiriesCollection.UpdateOne(timeout, filter, accepted)
+            if err != nil {
+                return nil, err
+            }
+            if res.ModifiedCount == 0 {
+                return nil, errors.New("Inquiry changed while the offer was being accepted, try again")
+            }
+            undo := func() {
+                inquiriesCollection.UpdateOne(timeout, bson.M{"_id": inquiryObjID}, bson.M{"$set": bson.M{"open": true, "accepted": nil}})
+            }
+
+            buyerObjID := inquiry["buyer"].(primitive.ObjectID)
+            lineItems, _ := inquiry["lineItems"].(primitive.A)
+            sold, soldOut, err := claimLineItems(timeout, db, listing, lineItems, buyerObjID)
+            if err != nil {
+                undo()
+                return nil, err
+            }
+            transaction, err := createTransaction(timeout, db, listing, buyerObjID, price, sold)
+            if err != nil {
+                if err := releaseLineItems(timeout, db, listing, sold, buyerObjID); err != nil {
+                    log.Println(err)
+                }
+                undo()
+                return nil, err
+            }
+            _, err = inquiriesCollection.UpdateOne(timeout, bson.M{"_id": inquiryObjID}, bson.M{"$set": bson.M{"transaction": transaction["_id"]}})
+            if err != nil {
+                log.Println(err)
+            }
+            if soldOut {
+                if err = closeOpenInquiries(timeout, db, listing["_id"].(primitive.ObjectID), InquiryClosedListingSold); err != nil {
+                    log.Println(err)
+                }
+            }
+
+            message := fmt.Sprintf("Your offer of %d was accepted", price)
+            refs := bson.M{"listing": listing["_id"], "inquiry": inquiryObjID, "transaction": transaction["_id"]}
+            if err = notify(timeout, db, other, NotificationOfferAccepted, message, refs); err != nil {
+                log.Println(err)
+            }
+
+            return transaction, nil
+        },
+    }
+}
@@ -0,0 +1,374 @@
+package types
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "github.com/graphql-go/graphql"
+)
+
+// NookMilesTicketItemName is the name of the catalog item whose bell prices set the
+// exchange rate between Nook Miles Tickets and bells.
+var NookMilesTicketItemName = "Nook Miles Ticket"
+
+// Limits on the size of a price that isn't in bells.
+const (
+    maxNookMilesTickets = 10000
+    maxPriceItems = 10
+    maxPriceItemQuantity = 1000
+)
+
+// Values of CurrencyEnum
+const (
+    CurrencyBells = "BELLS"
+    CurrencyNookMilesTickets = "NMT"
+    CurrencyItems = "ITEMS"
+)
+
+// CurrencyEnum is what a price is paid in
+var CurrencyEnum = graphql.NewEnum(
+    graphql.EnumConfig {
+        Name: "Currency",
+        Values: graphql.EnumValueConfigMap {
+            CurrencyBells: &graphql.EnumValueConfig {
+                Value: CurrencyBells,
+            },
+            CurrencyNookMilesTickets: &graphql.EnumValueConfig {
+                Value: CurrencyNookMilesTickets,
+                Description: "Nook Miles Tickets",
+            },
+            CurrencyItems: &graphql.EnumValueConfig {
+                Value: CurrencyItems,
+                Description: "A basket of catalog items",
+            },
+        },
+    },
+)
+
+// PriceItemInput is an item in the basket of a PriceInput
+var PriceItemInput = graphql.NewInputObject(
+    graphql.InputObjectConfig {
+        Name: "PriceItemInput",
+        Fields: graphql.InputObjectConfigFieldMap {
+            "itemID": &graphql.InputObjectFieldConfig {
+                Type: graphql.NewNonNull(graphql.ID),
+            },
+            "variation": &graphql.InputObjectFieldConfig {
+                Type: graphql.String,
+            },
+            "quantity": &graphql.InputObjectFieldConfig {
+                Type: graphql.NewNonNull(graphql.Int),
+            },
+        },
+    },
+)
+
+// PriceInput is a price in exactly one of bells, Nook Miles Tickets or a basket of items
+var PriceInput = graphql.NewInputObject(
+    graphql.InputObjectConfig {
+        Name: "PriceInput",
+        Fields: graphql.InputObjectConfigFieldMap {
+            "bells": &graphql.InputObjectFieldConfig {
+                Type: graphql.Int,
+            },
+            "nookMilesTickets": &graphql.InputObjectFieldConfig {
+                Type: graphql.Int,
+            },
+            "items": &graphql.InputObjectFieldConfig {
+                Type: graphql.NewList(PriceItemInput),
+            },
+        },
+    },
+)
+
+// PriceItemType is an item in the basket of a price
+var PriceItemType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "PriceItem",
+        Fields: graphql.Fields {
+            "variation": &graphql.Field {
+                Type: graphql.String,
+            },
+            "quantity": &graphql.Field {
+                Type: graphql.Int,
+            },
+        },
+    },
+)
+
+// PriceType is the askingPrice of a listing
+var PriceType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "Price",
+        Fields: graphql.Fields {
+            "currency": &graphql.Field {
+                Type: CurrencyEnum,
+            },
+            "bells": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "nookMilesTickets": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "items": &graphql.Field {
+                Type: graphql.NewList(PriceItemType),
+            },
+        },
+    },
+)
+
+func InitPriceType(ctx context.Context, db mongo.Database) {
+    PriceItemType.AddFieldConfig("item", &graphql.Field {
+        Type: ItemType,
+        Resolve: resolverGenerator(ctx, "item", *db.Collection("items")),
+    })
+}
+
+// askingPriceResolver gets the askingPrice of a listing. Listings made before prices
+// could be in other currencies only have a price in bells, so one is made up for them.
+func askingPriceResolver(p graphql.ResolveParams) (interface{}, error) {
+    listing := p.Source.(primitive.M)
+    if askingPrice, ok := listing["askingPrice"].(primitive.M); ok {
+        return askingPrice, nil
+    }
+    return bson.M{"currency": CurrencyBells, "bells": listing["price"]}, nil
+}
+
+// priceFromInput validates a PriceInput and turns it into the document stored as the
+// askingPrice of a listing. Every item in a basket has to exist, and if a variation is
+// given it has to be one of the item's variations.
+func priceFromInput(ctx context.Context, db mongo.Database, input map[string]interface{}) (bson.M, error) {
+    bells, hasBells := input["bells"].(int)
+    tickets, hasTickets := input["nookMilesTickets"].(int)
+    items, hasItems := input["items"].([]interface{})
+    given := 0
+    for _, has := range []bool{hasBells, hasTickets, hasItems} {
+        if has {
+            given++
+        }
+    }
+    if given != 1 {
+        return nil, errors.New("Price must be in exactly one of bells, Nook Miles Tickets or items")
+    }
+
+    switch {
+    case hasBells:
+        if bells < 0 || bells > 100000000 {
+            return nil, errors.New("Price must be between 0 and 100 mil")
+        }
+        return bson.M{"currency": CurrencyBells, "bells": bells}, nil
+    case hasTickets:
+        if tickets < 1 || tickets > maxNookMilesTickets {
+            return nil, errors.New(fmt.Sprintf("Nook Miles Tickets must be between 1 and %d", maxNookMilesTickets))
+        }
+        return bson.M{"currency": CurrencyNookMilesTickets, "nookMilesTickets": tickets}, nil
+    }
+
+    if len(items) < 1 || len(items) > maxPriceItems {
+        return nil, errors.New(fmt.Sprintf("Price must have between 1 and %d items", maxPriceItems))
+    }
+    basket := make(bson.A, 0, len(items))
+    seen := make(map[string]bool)
+    for _, i := range items {
+        input := i.(map[string]interface{})
+        itemObjID, err := primitive.ObjectIDFromHex(input["itemID"].(string))
+        if err != nil {
+            return nil, err
+        }
+        variation := input["variation"]
+        key := fmt.Sprintf("%s/%v", itemObjID.Hex(), variation)
+        if seen[key] {
+            return nil, errors.New("Price cannot list the same item more than once")
+        }
+        seen[key] = true
+        quantity := input["quantity"].(int)
+        if quantity < 1 || quantity > maxPriceItemQuantity {
+            return nil, errors.New(fmt.Sprintf("Item quantity must be between 1 and %d", maxPriceItemQuantity))
+        }
+
+        var item bson.M
+        err = db.Collection("items").FindOne(ctx, bson.M{"_id": itemObjID}).Decode(&item)
+        if err == mongo.ErrNoDocuments {
+            return nil, errors.New(fmt.Sprintf("Item in price not found: %s", itemObjID.Hex()))
+        } else if err != nil {
+            return nil, err
+        }
+        if variation != nil {
+            if err = validateVariation(item, variation); err != nil {
+                return nil, err
+            }
+        }
+        basket = append(basket, bson.M{"item": itemObjID, "variation": variation, "quantity": quantity})
+    }
+    return bson.M{"currency": CurrencyItems, "items": basket}, nil
+}
+
+// nookMilesTicketRate works out how many bells a Nook Miles Ticket is worth, from the
+// recent market for the Nook Miles Ticket item. It falls back to the item's current
+// median, and returns false if there is no market for tickets at all.
+func nookMilesTicketRate(ctx context.Context, db mongo.Database) (int, bool, error) {
+    var ticket bson.M
+    err := db.Collection("items").FindOne(ctx, bson.M{"name": NookMilesTicketItemName}).Decode(&ticket)
+    if err == mongo.ErrNoDocuments {
+        return 0, false, nil
+    } else if err != nil {
+        return 0, false, err
+    }
+    samples, _, err := marketSamples(ctx, db, ticket["_id"].(primitive.ObjectID), nil, time.Now().Add(-PriceSuggestionWindow))
+    if err != nil {
+        return 0, false, err
+    }
+    if len(samples) > 0 {
+        return marketStats(samples)["median"].(int), true, nil
+    }
+    if median, ok := toInt(ticket["currentMedian"]); ok && median > 0 {
+        return median, true, nil
+    }
+    return 0, false, nil
+}
+
+// bellValue is the value in bells of a single unit of an item, for pricing baskets. It
+// uses the item's current median, or its in-game price if it has no market yet.
+func bellValue(item bson.M) (int, bool) {
+    if median, ok := toInt(item["currentMedian"]); ok && median > 0 {
+        return median, true
+    }
+    if inGamePrice, ok := toInt(item["inGamePrice"]); ok && inGamePrice > 0 {
+        return inGamePrice, true
+    }
+    return 0, false
+}
+
+// priceNormalizer converts asking prices to bells. The ticket rate and item values it
+// needs are looked up once and reused, so one should be made per aggregation run.
+type priceNormalizer struct {
+    db mongo.Database
+    ticketRate int
+    hasTicketRate bool
+    itemValues map[primitive.ObjectID]int
+}
+
+func newPriceNormalizer(ctx context.Context, db mongo.Database) (*priceNormalizer, error) {
+    rate, ok, err := nookMilesTicketRate(ctx, db)
+    if err != nil {
+        return nil, err
+    }
+    return &priceNormalizer{db, rate, ok, make(map[primitive.ObjectID]int)}, nil
+}
+
+// itemValue returns the bellValue of an item, or 0 if it has none.
+func (n *priceNormalizer) itemValue(ctx context.Context, itemObjID primitive.ObjectID) (int, error) {
+    if value, prs := n.itemValues[itemObjID]; prs {
+        return value, nil
+    }
+    var item bson.M
+    err := n.db.Collection("items").FindOne(ctx, bson.M{"_id": itemObjID}).Decode(&item)
+    if err != nil {
+        return 0, err
+    }
+    value, _ := bellValue(item)
+    n.itemValues[itemObjID] = value
+    return value, nil
+}
+
+// toBells returns the value in bells of a listing's price, or false if it can't be
+// worked out, e.g. because tickets have no exchange rate yet.
+func (n *priceNormalizer) toBells(ctx context.Context, listing bson.M) (int, bool, error) {
+    if price, ok := toInt(listing["price"]); ok {
+        return price, true, nil
+    }
+    askingPrice, ok := listing["askingPrice"].(primitive.M)
+    if !ok {
+        return 0, false, nil
+    }
+    switch askingPrice["currency"] {
+    case CurrencyNookMilesTickets:
+        tickets, _ := toInt(askingPrice["nookMilesTickets"])
+        return tickets * n.ticketRate, n.hasTicketRate, nil
+    case CurrencyItems:
+        total := 0
+        valued := false
+        for _, i := range askingPrice["items"].(primitive.A) {
+            entry := i.(primitive.M)
+            value, err := n.itemValue(ctx, entry["item"].(primitive.ObjectID))
+            if err == mongo.ErrNoDocuments {
+                // items deleted since the listing was made don't count towards its value
+                continue
+            } else if err != nil {
+                return 0, false, err
+            }
+            if value == 0 {
+                return 0, false, nil
+            }
+            quantity, _ := toInt(entry["quantity"])
+            total += value * quantity
+            valued = true
+        }
+        // a basket whose items are all gone is worth nothing that can be worked out
+        return total, valued, nil
+    }
+    return 0, false, nil
+}
+
+// listingBellPrice returns the value in bells of a listing's price, to be stored as its
+// bellPrice so that listings can be sorted and filtered by price whatever they are priced
+// in. It is nil if the value can't be worked out yet.
+func listingBellPrice(ctx context.Context, db mongo.Database, listing bson.M) (interface{}, error) {
+    normalizer, err := newPriceNormalizer(ctx, db)
+    if err != nil {
+        return nil, err
+    }
+    bells, ok, err := normalizer.toBells(ctx, listing)
+    if err != nil || !ok {
+        return nil, err
+    }
+    return bells, nil
+}
+
+// refreshBellPrices recomputes the bellPrice of the open listings that aren't priced in
+// bells, since the ticket rate and the values of items they are priced in move with the
+// market.
+func refreshBellPrices(ctx context.Context, db mongo.Database) error {
+    listingsCollection := db.Collection("listings")
+    normalizer, err := newPriceNormalizer(ctx, db)
+    if err != nil {
+        return err
+    }
+    cursor, err := listingsCollection.Find(ctx, bson.M{
+        "askingPrice": bson.M{"$ne": nil},
+        "accepted": nil,
+        "deleted": bson.M{"$ne": true},
+        "expired": bson.M{"$ne": true},
+    })
+    if err != nil {
+        return err
+    }
+    defer cursor.Close(ctx)
+    for cursor.Next(ctx) {
+        var listing bson.M
+        if err = cursor.Decode(&listing); err != nil {
+            return err
+        }
+        var bellPrice interface{}
+        bells, ok, err := normalizer.toBells(ctx, listing)
+        if err != nil {
+            return err
+        }
+        if ok {
+            bellPrice = bells
+        }
+        _, err = listingsCollection.UpdateOne(ctx, bson.M{"_id": listing["_id"]}, bson.M{"$set": bson.M{"bellPrice": bellPrice}})
+        if err != nil {
+            return err
+        }
+    }
+    if err := cursor.Err(); err != nil {
+        return err
+    }
+    return nil
+}
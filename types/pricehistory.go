@@ -0,0 +1,318 @@
+package types
+
+import (
+    "context"
+    "errors"
+    "sort"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "github.com/graphql-go/graphql"
+)
+
+// Values of IntervalEnum
+const (
+    IntervalDay = "DAY"
+    IntervalWeek = "WEEK"
+    IntervalMonth = "MONTH"
+)
+
+// IntervalEnum is the size of the time buckets market data is grouped into
+var IntervalEnum = graphql.NewEnum(
+    graphql.EnumConfig {
+        Name: "Interval",
+        Values: graphql.EnumValueConfigMap {
+            IntervalDay: &graphql.EnumValueConfig {
+                Value: IntervalDay,
+            },
+            IntervalWeek: &graphql.EnumValueConfig {
+                Value: IntervalWeek,
+            },
+            IntervalMonth: &graphql.EnumValueConfig {
+                Value: IntervalMonth,
+            },
+        },
+    },
+)
+
+// bucketFormats are the $dateToString formats used to group timestamps into buckets.
+// Weeks are ISO weeks, so they start on Monday.
+var bucketFormats = map[string]string {
+    IntervalDay: "%Y-%m-%d",
+    IntervalWeek: "%G-W%V",
+    IntervalMonth: "%Y-%m",
+}
+
+// bucketStart returns the start of the bucket a time falls into.
+func bucketStart(t time.Time, interval string) time.Time {
+    t = t.UTC()
+    day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+    switch interval {
+    case IntervalWeek:
+        return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+    case IntervalMonth:
+        return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+    default:
+        return day
+    }
+}
+
+// PriceHistoryBucketType is a bucket of the priceHistory query. It is not stored in the
+// database.
+var PriceHistoryBucketType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "PriceHistoryBucket",
+        Fields: graphql.Fields {
+            "start": &graphql.Field {
+                Type: graphql.String, // TODO Date scalar
+            },
+            "open": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "high": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "low": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "close": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "median": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "volume": &graphql.Field {
+                Type: graphql.Int,
+            },
+        },
+    },
+)
+
+// priceBucketStages are the pipeline stages shared by every price history source. They
+// expect documents with a ts and a price, and group them into buckets of the interval.
+func priceBucketStages(interval string) []bson.M {
+    return []bson.M{
+        {"$sort": bson.M{"ts": 1}},
+        {"$group": bson.M{
+            "_id": bson.M{"$dateToString": bson.M{"format": bucketFormats[interval], "date": "$ts"}},
+            "firstTs": bson.M{"$min": "$ts"},
+            "lastTs": bson.M{"$max": "$ts"},
+            "open": bson.M{"$first": "$price"},
+            "close": bson.M{"$last": "$price"},
+            "high": bson.M{"$max": "$price"},
+            "low": bson.M{"$min": "$price"},
+            "prices": bson.M{"$push": "$price"},
+            "volume": bson.M{"$sum": 1},
+        }},
+    }
+}
+
+// aggregateBuckets runs a price history pipeline and returns its buckets by key.
+func aggregateBuckets(ctx context.Context, coll mongo.Collection, pipeline []bson.M) (map[string]bson.M, error) {
+    cursor, err := coll.Aggregate(ctx, pipeline)
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+    buckets := make(map[string]bson.M)
+    for cursor.Next(ctx) {
+        var bucket bson.M
+        if err = cursor.Decode(&bucket); err != nil {
+            return nil, err
+        }
+        buckets[bucket["_id"].(string)] = bucket
+    }
+    if err := cursor.Err(); err != nil {
+        return nil, err
+    }
+    return buckets, nil
+}
+
+// mergeBuckets combines two buckets with the same key from different sources.
+func mergeBuckets(a bson.M, b bson.M) bson.M {
+    merged := bson.M{
+        "firstTs": a["firstTs"],
+        "lastTs": a["lastTs"],
+        "open": a["open"],
+        "close": a["close"],
+        "prices": append(a["prices"].(primitive.A), b["prices"].(primitive.A)...),
+    }
+    if b["firstTs"].(primitive.DateTime) < a["firstTs"].(primitive.DateTime) {
+        merged["firstTs"], merged["open"] = b["firstTs"], b["open"]
+    }
+    if b["lastTs"].(primitive.DateTime) > a["lastTs"].(primitive.DateTime) {
+        merged["lastTs"], merged["close"] = b["lastTs"], b["close"]
+    }
+    aHigh, _ := toInt(a["high"])
+    bHigh, _ := toInt(b["high"])
+    merged["high"] = aHigh
+    if bHigh > aHigh {
+        merged["high"] = bHigh
+    }
+    aLow, _ := toInt(a["low"])
+    bLow, _ := toInt(b["low"])
+    merged["low"] = aLow
+    if bLow < aLow {
+        merged["low"] = bLow
+    }
+    aVolume, _ := toInt(a["volume"])
+    bVolume, _ := toInt(b["volume"])
+    merged["volume"] = aVolume + bVolume
+    return merged
+}
+
+// priceHistory buckets the prices of an item between from and to. Prices come from
+// listings and completed transactions. Market records only fill in buckets with no
+// listings or transactions left, since they were computed from the same data. Bundles
+// are only counted through the records, which hold their price per unit. Transactions
+// fall into the bucket of when they were completed.
+func priceHistory(ctx context.Context, db mongo.Database, itemObjID primitive.ObjectID, variation interface{}, from time.Time, to time.Time, interval string) ([]bson.M, error) {
+    tsStage := bson.M{"$project": bson.M{"ts": bson.M{"$toDate": "$_id"}, "price": 1}}
+
+    listingsMatch := bson.M{"item": itemObjID, "price": bson.M{"$ne": nil}, "bundle": bson.M{"$ne": true}, "deleted": bson.M{"$ne": true}, "_id": objectIDRange(from, to)}
+    if variation != nil {
+        listingsMatch["variation"] = variation
+    }
+    listingsPipeline := append([]bson.M{{"$match": listingsMatch}, tsStage}, priceBucketStages(interval)...)
+    buckets, err := aggregateBuckets(ctx, *db.Collection("listings"), listingsPipeline)
+    if err != nil {
+        return nil, err
+    }
+
+    transactionsMatch := bson.M{"listing.item": itemObjID, "listing.bundle": bson.M{"$ne": true}}
+    if variation != nil {
+        transactionsMatch["listing.variation"] = variation
+    }
+    transactionsPipeline := append([]bson.M{
+        {"$match": completedBetween(from, to)},
+        {"$lookup": bson.M{"from": "listings", "localField": "listing", "foreignField": "_id", "as": "listing"}},
+        {"$unwind": "$listing"},
+        {"$match": transactionsMatch},
+        {"$project": bson.M{"ts": completedTime, "price": 1}},
+    }, priceBucketStages(interval)...)
+    transactionBuckets, err := aggregateBuckets(ctx, *db.Collection("transactions"), transactionsPipeline)
+    if err != nil {
+        return nil, err
+    }
+    for key, bucket := range transactionBuckets {
+        if existing, prs := buckets[key]; prs {
+            buckets[key] = mergeBuckets(existing, bucket)
+        } else {
+            buckets[key] = bucket
+        }
+    }
+
+    recordsPipeline := append([]bson.M{
+        {"$match": bson.M{
+            "item": itemObjID,
+            "variation": variation,
+            "date": bson.M{"$gte": from.UTC().Format("2006-01-02"), "$lt": to.UTC().Format("2006-01-02")},
+        }},
+        {"$project": bson.M{"ts": bson.M{"$dateFromString": bson.M{"dateString": "$date"}}, "price": "$median"}},
+    }, priceBucketStages(interval)...)
+    recordBuckets, err := aggregateBuckets(ctx, *db.Collection("records"), recordsPipeline)
+    if err != nil {
+        return nil, err
+    }
+    for key, bucket := range recordBuckets {
+        if _, prs := buckets[key]; !prs {
+            buckets[key] = bucket
+        }
+    }
+
+    history := make([]bson.M, 0, len(buckets))
+    for _, bucket := range buckets {
+        prices := make([]int, 0, len(bucket["prices"].(primitive.A)))
+        for _, price := range bucket["prices"].(primitive.A) {
+            if p, ok := toInt(price); ok {
+                prices = append(prices, p)
+            }
+        }
+        if len(prices) == 0 {
+            continue
+        }
+        start := bucketStart(bucket["firstTs"].(primitive.DateTime).Time(), interval)
+        history = append(history, bson.M{
+            "start": start.Format(time.RFC3339),
+            "open": bucket["open"],
+            "high": bucket["high"],
+            "low": bucket["low"],
+            "close": bucket["close"],
+            "median": marketStats(prices)["median"],
+            "volume": bucket["volume"],
+        })
+    }
+    sort.Slice(history, func(i, j int) bool {
+        return history[i]["start"].(string) < history[j]["start"].(string)
+    })
+    return history, nil
+}
+
+// PriceHistory is a query for charting an item's price over time. Prices between from
+// and to (defaulting to the last 30 days) are grouped into buckets of the interval, each
+// with its open, high, low, close and median price and the number of prices in it.
+func PriceHistory(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: graphql.NewList(PriceHistoryBucketType),
+        Description: "Get the price history of an item",
+        Args: graphql.FieldConfigArgument {
+            "itemID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "variation": &graphql.ArgumentConfig {
+                Type: graphql.String,
+                DefaultValue: nil,
+            },
+            "from": &graphql.ArgumentConfig {
+                Type: graphql.String,
+                DefaultValue: nil,
+            },
+            "to": &graphql.ArgumentConfig {
+                Type: graphql.String,
+                DefaultValue: nil,
+            },
+            "interval": &graphql.ArgumentConfig {
+                Type: IntervalEnum,
+                DefaultValue: IntervalDay,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            itemID, prs := p.Args["itemID"]
+            if !prs {
+                return nil, errors.New("Item ID not given for price history")
+            }
+            itemObjID, err := primitive.ObjectIDFromHex(itemID.(string))
+            if err != nil {
+                return nil, err
+            }
+            to := time.Now()
+            if toArg, prs := p.Args["to"]; prs && toArg != nil {
+                to, err = parseDate(toArg.(string))
+                if err != nil {
+                    return nil, err
+                }
+            }
+            from := to.AddDate(0, 0, -30)
+            if fromArg, prs := p.Args["from"]; prs && fromArg != nil {
+                from, err = parseDate(fromArg.(string))
+                if err != nil {
+                    return nil, err
+                }
+            }
+            if !from.Before(to) {
+                return nil, errors.New("Price history 'from' must be before 'to'")
+            }
+            interval, _ := p.Args["interval"].(string)
+            if interval == "" {
+                interval = IntervalDay
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second * 3)
+            defer cancel()
+
+            return priceHistory(timeout, db, itemObjID, p.Args["variation"], from, to, interval)
+        },
+    }
+}
@@ -0,0 +1,235 @@
+package types
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sort"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "github.com/graphql-go/graphql"
+)
+
+// PriceSuggestionWindow is how far back price suggestions look for market data.
+var PriceSuggestionWindow = 30 * 24 * time.Hour
+
+// PriceWarningFactor is how far outside of the suggested range a new listing's price can
+// be before CreateListing warns about it, e.g. 2 means below half of the low end or above
+// double the high end.
+var PriceWarningFactor = 2.0
+
+// Values of ConfidenceEnum
+const (
+    ConfidenceNone = "NONE"
+    ConfidenceLow = "LOW"
+    ConfidenceMedium = "MEDIUM"
+    ConfidenceHigh = "HIGH"
+)
+
+// ConfidenceEnum is how much market data a price suggestion is based on
+var ConfidenceEnum = graphql.NewEnum(
+    graphql.EnumConfig {
+        Name: "Confidence",
+        Values: graphql.EnumValueConfigMap {
+            ConfidenceNone: &graphql.EnumValueConfig {
+                Value: ConfidenceNone,
+            },
+            ConfidenceLow: &graphql.EnumValueConfig {
+                Value: ConfidenceLow,
+            },
+            ConfidenceMedium: &graphql.EnumValueConfig {
+                Value: ConfidenceMedium,
+            },
+            ConfidenceHigh: &graphql.EnumValueConfig {
+                Value: ConfidenceHigh,
+            },
+        },
+    },
+)
+
+// PriceSuggestionType is the result of the suggestedPrice query. It is not stored in the
+// database.
+var PriceSuggestionType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "PriceSuggestion",
+        Fields: graphql.Fields {
+            "low": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "high": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "recommended": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "confidence": &graphql.Field {
+                Type: ConfidenceEnum,
+            },
+            "sampleSize": &graphql.Field {
+                Type: graphql.Int,
+            },
+        },
+    },
+)
+
+// percentile returns the value at quantile q (0 to 1) of sorted values.
+func percentile(sorted []int, q float64) int {
+    return sorted[int(q * float64(len(sorted) - 1) + 0.5)]
+}
+
+// completedTransactionPrices returns the prices of the transactions for a single unit of
+// an item (and variation, if not nil) that were completed since the given time.
+func completedTransactionPrices(ctx context.Context, db mongo.Database, itemObjID primitive.ObjectID, variation interface{}, since time.Time) ([]int, error) {
+    match := bson.M{"listing.item": itemObjID, "listing.bundle": bson.M{"$ne": true}}
+    if variation != nil {
+        match["listing.variation"] = variation
+    }
+    cursor, err := db.Collection("transactions").Aggregate(ctx, []bson.M{
+        {"$match": completedBetween(since, time.Now())},
+        {"$lookup": bson.M{"from": "listings", "localField": "listing", "foreignField": "_id", "as": "listing"}},
+        {"$unwind": "$listing"},
+        {"$match": match},
+        {"$project": bson.M{"price": 1}},
+    })
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+    prices := make([]int, 0)
+    for cursor.Next(ctx) {
+        var transaction bson.M
+        if err = cursor.Decode(&transaction); err != nil {
+            return nil, err
+        }
+        if price, ok := toInt(transaction["price"]); ok {
+            prices = append(prices, price)
+        }
+    }
+    if err := cursor.Err(); err != nil {
+        return nil, err
+    }
+    return prices, nil
+}
+
+// marketSamples returns the prices an item (and variation, if not nil) has recently
+// gone for: the price of each transaction completed since the given time, followed by
+// the median of each market record made since then. It also returns how many of the
+// samples came from transactions.
+func marketSamples(ctx context.Context, db mongo.Database, itemObjID primitive.ObjectID, variation interface{}, since time.Time) ([]int, int, error) {
+    samples, err := completedTransactionPrices(ctx, db, itemObjID, variation, since)
+    if err != nil {
+        return nil, 0, err
+    }
+    numTransactions := len(samples)
+
+    filter := bson.M{"item": itemObjID, "variation": variation, "date": bson.M{"$gte": since.UTC().Format("2006-01-02")}}
+    cursor, err := db.Collection("records").Find(ctx, filter)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer cursor.Close(ctx)
+    for cursor.Next(ctx) {
+        var record bson.M
+        if err = cursor.Decode(&record); err != nil {
+            return nil, 0, err
+        }
+        if median, ok := toInt(record["median"]); ok {
+            samples = append(samples, median)
+        }
+    }
+    if err := cursor.Err(); err != nil {
+        return nil, 0, err
+    }
+    return samples, numTransactions, nil
+}
+
+// suggestPrice works out a price range for an item (and variation, if not nil) from the
+// market samples within PriceSuggestionWindow. The range runs from the 25th to the 75th
+// percentile of the samples, with the median as the recommended price.
+func suggestPrice(ctx context.Context, db mongo.Database, itemObjID primitive.ObjectID, variation interface{}) (bson.M, error) {
+    samples, numTransactions, err := marketSamples(ctx, db, itemObjID, variation, time.Now().Add(-PriceSuggestionWindow))
+    if err != nil {
+        return nil, err
+    }
+
+    suggestion := bson.M{"confidence": ConfidenceNone, "sampleSize": len(samples)}
+    if len(samples) == 0 {
+        return suggestion, nil
+    }
+    sort.Ints(samples)
+    suggestion["low"] = percentile(samples, 0.25)
+    suggestion["high"] = percentile(samples, 0.75)
+    suggestion["recommended"] = marketStats(samples)["median"]
+    switch {
+    case numTransactions >= 10:
+        suggestion["confidence"] = ConfidenceHigh
+    case len(samples) >= 4:
+        suggestion["confidence"] = ConfidenceMedium
+    default:
+        suggestion["confidence"] = ConfidenceLow
+    }
+    return suggestion, nil
+}
+
+// warnIfUnusualPrice adds a warning to the operation if a price is far outside of the
+// suggested range for an item. Failing to work out a suggestion only means no warning.
+func warnIfUnusualPrice(ctx context.Context, warnCtx context.Context, db mongo.Database, itemObjID primitive.ObjectID, variation interface{}, price int) {
+    suggestion, err := suggestPrice(ctx, db, itemObjID, variation)
+    if err != nil || suggestion["confidence"] == ConfidenceNone {
+        return
+    }
+    low := suggestion["low"].(int)
+    high := suggestion["high"].(int)
+    if float64(price) < float64(low) / PriceWarningFactor || float64(price) > float64(high) * PriceWarningFactor {
+        addWarning(warnCtx, "PRICE_OUTSIDE_SUGGESTED_RANGE", fmt.Sprintf(
+            "Price %d is far outside of the suggested range of %d to %d", price, low, high))
+    }
+}
+
+// SuggestedPrice is a query for the price range a seller should ask for an item,
+// based on recent market records and completed transactions. Leaving out the variation
+// gives a suggestion across all of the item's variations.
+func SuggestedPrice(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: PriceSuggestionType,
+        Description: "Suggest a price for listing an item",
+        Args: graphql.FieldConfigArgument {
+            "itemID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "variation": &graphql.ArgumentConfig {
+                Type: graphql.String,
+                DefaultValue: nil,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            itemID, prs := p.Args["itemID"]
+            if !prs {
+                return nil, errors.New("Item ID not given for price suggestion")
+            }
+            itemObjID, err := primitive.ObjectIDFromHex(itemID.(string))
+            if err != nil {
+                return nil, err
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second * 3)
+            defer cancel()
+
+            var item bson.M
+            err = db.Collection("items").FindOne(timeout, bson.M{"_id": itemObjID}).Decode(&item)
+            if err != nil {
+                return nil, err
+            }
+            if variation := p.Args["variation"]; variation != nil {
+                if err = validateVariation(item, variation); err != nil {
+                    return nil, err
+                }
+            }
+
+            return suggestPrice(timeout, db, itemObjID, p.Args["variation"])
+        },
+    }
+}
@@ -0,0 +1,191 @@
+package types
+
+import (
+    "context"
+    "errors"
+    "log"
+    "math"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "github.com/graphql-go/graphql"
+)
+
+// maxRatingCommentLength is the longest the comment of a rating can be.
+const maxRatingCommentLength = 1000
+
+// RatingType corresponds to the "ratings" collection
+var RatingType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "Rating",
+        Fields: graphql.Fields {
+            "id": &graphql.Field {
+                Type: graphql.ID,
+                Resolve: idResolver,
+            },
+            "created": &graphql.Field {
+                Type: graphql.String,
+                Resolve: timestampResolver,
+            },
+            "score": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "comment": &graphql.Field {
+                Type: graphql.String,
+            },
+        },
+    },
+)
+
+func InitRatingType(ctx context.Context, db mongo.Database) {
+    RatingType.AddFieldConfig("transaction", &graphql.Field {
+        Type: TransactionType,
+        Resolve: resolverGenerator(ctx, "transaction", *db.Collection("transactions")),
+    })
+    RatingType.AddFieldConfig("from", &graphql.Field {
+        Type: UserType,
+        Resolve: resolverGenerator(ctx, "from", *db.Collection("users")),
+    })
+    RatingType.AddFieldConfig("to", &graphql.Field {
+        Type: UserType,
+        Resolve: resolverGenerator(ctx, "to", *db.Collection("users")),
+    })
+    TransactionType.AddFieldConfig("ratings", &graphql.Field {
+        Type: graphql.NewList(RatingType),
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+            cursor, err := db.Collection("ratings").Find(timeout, bson.M{"transaction": p.Source.(primitive.M)["_id"]})
+            if err != nil {
+                return nil, err
+            }
+            defer cursor.Close(timeout)
+            ratings := make([]bson.M, 0)
+            for cursor.Next(timeout) {
+                var rating bson.M
+                if err = cursor.Decode(&rating); err != nil {
+                    return nil, err
+                }
+                ratings = append(ratings, rating)
+            }
+            if err := cursor.Err(); err != nil {
+                return nil, err
+            }
+            return ratings, nil
+        },
+    })
+}
+
+// ratingWeight is how much a rating counts towards reputation, so that ratings on bigger
+// trades count for more without letting one trade outweigh many small ones.
+func ratingWeight(price int) float64 {
+    if price < 0 {
+        price = 0
+    }
+    return 1 + math.Log10(1 + float64(price) / 100000)
+}
+
+// RateTransaction rates the other side of a transaction from 1 to 5, with an optional
+// comment. Each side can rate a transaction once, after it is completed or they have
+// reported it complete themselves.
+func RateTransaction(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: RatingType,
+        Description: "Rate the other side of a transaction",
+        Args: graphql.FieldConfigArgument {
+            "transactionID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "score": &graphql.ArgumentConfig {
+                Type: graphql.Int,
+            },
+            "comment": &graphql.ArgumentConfig {
+                Type: graphql.String,
+                DefaultValue: nil,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            transactionID, prs := p.Args["transactionID"]
+            if !prs {
+                return nil, errors.New("Transaction ID not given for rating")
+            }
+            transactionObjID, err := primitive.ObjectIDFromHex(transactionID.(string))
+            if err != nil {
+                return nil, err
+            }
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for rating")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
+            score, _ := p.Args["score"].(int)
+            if score < 1 || score > 5 {
+                return nil, errors.New("Score must be between 1 and 5")
+            }
+            comment := p.Args["comment"]
+            if c, ok := comment.(string); ok && len(c) > maxRatingCommentLength {
+                return nil, errors.New("Comment is too long")
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second * 3)
+            defer cancel()
+
+            var transaction bson.M
+            err = db.Collection("transactions").FindOne(timeout, bson.M{"_id": transactionObjID}).Decode(&transaction)
+            if err != nil {
+                return nil, err
+            }
+            var to primitive.ObjectID
+            var reported interface{}
+            switch userObjID {
+            case transaction["buyer"]:
+                to = transaction["seller"].(primitive.ObjectID)
+                reported = transaction["buyerReportedComplete"]
+            case transaction["seller"]:
+                to = transaction["buyer"].(primitive.ObjectID)
+                reported = transaction["sellerReportedComplete"]
+            default:
+                return nil, errors.New("Only the buyer and seller can rate a transaction")
+            }
+            if transaction["state"] != TransactionStateCompleted && (transaction["state"] != TransactionStateInProgress || reported == nil) {
+                return nil, errors.New("Transactions can only be rated once they are complete")
+            }
+
+            price, _ := toInt(transaction["price"])
+            rating := bson.M{
+                "transaction": transactionObjID,
+                "from": userObjID,
+                "to": to,
+                "score": score,
+                "comment": comment,
+                "weight": ratingWeight(price),
+            }
+            res, err := db.Collection("ratings").InsertOne(timeout, rating)
+            if isDuplicateKey(err) {
+                return nil, errors.New("You already rated this transaction")
+            } else if err != nil {
+                return nil, err
+            }
+            rating["_id"] = res.InsertedID
+
+            if _, err = recomputeReputation(timeout, db, to); err != nil {
+                log.Println(err)
+            }
+            if transaction["state"] == TransactionStateCompleted {
+                if err = publishReviews(timeout, db, transactionObjID); err != nil {
+                    log.Println(err)
+                }
+            }
+
+            return rating, nil
+        },
+    }
+}
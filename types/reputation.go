@@ -0,0 +1,254 @@
+package types
+
+import (
+    "context"
+    "errors"
+    "log"
+    "math"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "github.com/graphql-go/graphql"
+)
+
+// How much each part of a user's history adds to their reputation
+var (
+    ReputationPerRatingPoint = 5.0 // per star above or below 3, times the rating's weight
+    ReputationPerTrade = 2.0
+    ReputationPerMonth = 1.0
+    MaxAccountAgeReputation = 12.0
+)
+
+// ReputationRecomputeInterval is how often every user's reputation is recomputed, so
+// that points from account age keep up with time passing.
+var ReputationRecomputeInterval = 24 * time.Hour
+
+// ReputationBreakdownType explains how a user's reputation was worked out
+var ReputationBreakdownType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "ReputationBreakdown",
+        Fields: graphql.Fields {
+            "total": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "ratings": &graphql.Field {
+                Type: graphql.Float,
+                Description: "Points from ratings, weighted by the price of each trade",
+            },
+            "ratingCount": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "averageRating": &graphql.Field {
+                Type: graphql.Float,
+            },
+            "completedTrades": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "trades": &graphql.Field {
+                Type: graphql.Float,
+                Description: "Points from completed trades",
+            },
+            "disputesLost": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "disputes": &graphql.Field {
+                Type: graphql.Float,
+                Description: "Points lost to disputes",
+            },
+            "accountAge": &graphql.Field {
+                Type: graphql.Float,
+                Description: "Points from how long the account has existed",
+            },
+            "computed": &graphql.Field {
+                Type: graphql.String, // TODO Date scalar
+            },
+        },
+    },
+)
+
+// recomputeReputation works a user's reputation out again from their history, and stores
+// it along with its breakdown. Only ratings on completed transactions count.
+func recomputeReputation(ctx context.Context, db mongo.Database, userObjID primitive.ObjectID) (bson.M, error) {
+    transactionsCollection := db.Collection("transactions")
+
+    cursor, err := db.Collection("ratings").Find(ctx, bson.M{"to": userObjID})
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+    var ratings []bson.M
+    if err = cursor.All(ctx, &ratings); err != nil {
+        return nil, err
+    }
+    transactionObjIDs := make(bson.A, len(ratings))
+    for i, rating := range ratings {
+        transactionObjIDs[i] = rating["transaction"]
+    }
+    completed := map[primitive.ObjectID]bool{}
+    if len(ratings) > 0 {
+        filter := bson.M{"_id": bson.M{"$in": transactionObjIDs}, "state": TransactionStateCompleted}
+        cursor, err = transactionsCollection.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+        if err != nil {
+            return nil, err
+        }
+        defer cursor.Close(ctx)
+        for cursor.Next(ctx) {
+            var transaction bson.M
+            if err = cursor.Decode(&transaction); err != nil {
+                return nil, err
+            }
+            completed[transaction["_id"].(primitive.ObjectID)] = true
+        }
+        if err := cursor.Err(); err != nil {
+            return nil, err
+        }
+    }
+    ratingPoints, scoreSum, ratingCount := 0.0, 0, 0
+    for _, rating := range ratings {
+        if !completed[rating["transaction"].(primitive.ObjectID)] {
+            continue
+        }
+        score, _ := toInt(rating["score"])
+        weight, ok := rating["weight"].(float64)
+        if !ok {
+            weight = 1
+        }
+        ratingPoints += float64(score - 3) * weight * ReputationPerRatingPoint
+        scoreSum += score
+        ratingCount++
+    }
+    var averageRating interface{}
+    if ratingCount > 0 {
+        averageRating = float64(scoreSum) / float64(ratingCount)
+    }
+
+    tradesFilter := bson.M{
+        "$or": bson.A{bson.M{"buyer": userObjID}, bson.M{"seller": userObjID}},
+        "state": TransactionStateCompleted,
+    }
+    completedTrades, err := transactionsCollection.CountDocuments(ctx, tradesFilter)
+    if err != nil {
+        return nil, err
+    }
+    disputesLost, err := db.Collection("disputes").CountDocuments(ctx, bson.M{"loser": userObjID})
+    if err != nil {
+        return nil, err
+    }
+
+    months := time.Since(userObjID.Timestamp()).Hours() / 24 / 30
+    accountAge := math.Min(math.Floor(months) * ReputationPerMonth, MaxAccountAgeReputation)
+
+    trades := float64(completedTrades) * ReputationPerTrade
+    disputes := -float64(disputesLost) * float64(DisputeLossPenalty)
+    total := int(math.Round(ratingPoints + trades + disputes + accountAge))
+    breakdown := bson.M{
+        "total": total,
+        "ratings": ratingPoints,
+        "ratingCount": ratingCount,
+        "averageRating": averageRating,
+        "completedTrades": completedTrades,
+        "trades": trades,
+        "disputesLost": disputesLost,
+        "disputes": disputes,
+        "accountAge": accountAge,
+        "computed": primitive.NewDateTimeFromTime(time.Now()),
+    }
+    update := bson.M{"$set": bson.M{"reputation": total, "reputationBreakdown": breakdown}}
+    _, err = db.Collection("users").UpdateOne(ctx, bson.M{"_id": userObjID}, update)
+    if err != nil {
+        return nil, err
+    }
+    return breakdown, nil
+}
+
+// recomputeTransactionReputations recomputes the reputations of both sides of a
+// transaction, after something that counts towards them changed.
+func recomputeTransactionReputations(ctx context.Context, db mongo.Database, transaction bson.M) error {
+    for _, key := range []string{"buyer", "seller"} {
+        if _, err := recomputeReputation(ctx, db, transaction[key].(primitive.ObjectID)); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// recomputeAllReputations recomputes the reputation of every user, returning how many
+// were updated. A user whose reputation can't be recomputed is logged and skipped.
+func recomputeAllReputations(ctx context.Context, db mongo.Database) (int, error) {
+    opts := options.Find().SetProjection(bson.M{"_id": 1})
+    cursor, err := db.Collection("users").Find(ctx, bson.M{}, opts)
+    if err != nil {
+        return 0, err
+    }
+    defer cursor.Close(ctx)
+    count := 0
+    for cursor.Next(ctx) {
+        var user bson.M
+        if err = cursor.Decode(&user); err != nil {
+            return count, err
+        }
+        userObjID, ok := user["_id"].(primitive.ObjectID)
+        if !ok {
+            log.Printf("Recomputing reputation of user %v: not an ObjectID", user["_id"])
+            continue
+        }
+        if _, err = recomputeReputation(ctx, db, userObjID); err != nil {
+            log.Printf("Recomputing reputation of user %s: %s", userObjID.Hex(), err)
+            continue
+        }
+        count++
+    }
+    if err := cursor.Err(); err != nil {
+        return 0, err
+    }
+    return count, nil
+}
+
+// RecomputeReputation recomputes the reputation of a user from their history, or of
+// every user if no user is given. Only admins can do this.
+func RecomputeReputation(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: graphql.Int,
+        Description: "Recompute reputations from history, returning how many users were updated",
+        Args: graphql.FieldConfigArgument {
+            "adminID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+                DefaultValue: nil,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            timeout, cancel := context.WithTimeout(ctx, time.Minute)
+            defer cancel()
+
+            if err := requireAdmin(timeout, db, p.Args["adminID"]); err != nil {
+                return nil, err
+            }
+
+            if userID, ok := p.Args["userID"].(string); ok {
+                userObjID, err := primitive.ObjectIDFromHex(userID)
+                if err != nil {
+                    return nil, err
+                }
+                n, err := db.Collection("users").CountDocuments(timeout, bson.M{"_id": userObjID})
+                if err != nil {
+                    return nil, err
+                }
+                if n == 0 {
+                    return nil, errors.New("User not found")
+                }
+                if _, err = recomputeReputation(timeout, db, userObjID); err != nil {
+                    return nil, err
+                }
+                return 1, nil
+            }
+
+            return recomputeAllReputations(timeout, db)
+        },
+    }
+}
@@ -0,0 +1,287 @@
+package types
+
+import (
+    "context"
+    "errors"
+    "log"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "github.com/graphql-go/graphql"
+)
+
+// maxReviewReplyLength is the longest a reply to a review can be.
+const maxReviewReplyLength = 1000
+
+// ReviewReplyType is the reply of the seller to a review by their buyer
+var ReviewReplyType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "ReviewReply",
+        Fields: graphql.Fields {
+            "text": &graphql.Field {
+                Type: graphql.String,
+            },
+            "created": &graphql.Field {
+                Type: graphql.String, // TODO Date scalar
+            },
+        },
+    },
+)
+
+// ReviewType corresponds to the "reviews" collection
+var ReviewType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "Review",
+        Fields: graphql.Fields {
+            "id": &graphql.Field {
+                Type: graphql.ID,
+                Resolve: idResolver,
+            },
+            "created": &graphql.Field {
+                Type: graphql.String,
+                Resolve: timestampResolver,
+            },
+            "score": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "comment": &graphql.Field {
+                Type: graphql.String,
+            },
+            "reply": &graphql.Field {
+                Type: ReviewReplyType,
+            },
+        },
+    },
+)
+
+var ReviewConnectionType = connectionType("Review", ReviewType)
+
+func InitReviewType(ctx context.Context, db mongo.Database) {
+    ReviewType.AddFieldConfig("author", &graphql.Field {
+        Type: UserType,
+        Resolve: resolverGenerator(ctx, "author", *db.Collection("users")),
+    })
+    ReviewType.AddFieldConfig("subject", &graphql.Field {
+        Type: UserType,
+        Resolve: resolverGenerator(ctx, "subject", *db.Collection("users")),
+    })
+    ReviewType.AddFieldConfig("transaction", &graphql.Field {
+        Type: TransactionType,
+        Resolve: resolverGenerator(ctx, "transaction", *db.Collection("transactions")),
+    })
+    UserType.AddFieldConfig("reviews", &graphql.Field {
+        Type: ReviewConnectionType,
+        Description: "Reviews others left for the user, newest first",
+        Args: connectionArgs(graphql.FieldConfigArgument {}),
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            skip, limit, err := pageArgs(p)
+            if err != nil {
+                return nil, err
+            }
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            reviewsCollection := db.Collection("reviews")
+            filter := bson.M{"subject": p.Source.(primitive.M)["_id"], "removed": nil}
+            total, err := reviewsCollection.CountDocuments(timeout, filter)
+            if err != nil {
+                return nil, err
+            }
+            opts := options.Find().SetSort(bson.M{"_id": -1}).SetSkip(int64(skip)).SetLimit(int64(limit))
+            cursor, err := reviewsCollection.Find(timeout, filter, opts)
+            if err != nil {
+                return nil, err
+            }
+            defer cursor.Close(timeout)
+            reviews := make([]bson.M, 0)
+            for cursor.Next(timeout) {
+                var review bson.M
+                if err = cursor.Decode(&review); err != nil {
+                    return nil, err
+                }
+                reviews = append(reviews, review)
+            }
+            if err := cursor.Err(); err != nil {
+                return nil, err
+            }
+            return newConnection(reviews, skip, int(total)), nil
+        },
+    })
+}
+
+// publishReviews writes a review for each rating on a completed transaction that doesn't
+// have one yet. Ratings given before the transaction completed are published once it does.
+func publishReviews(ctx context.Context, db mongo.Database, transactionObjID primitive.ObjectID) error {
+    cursor, err := db.Collection("ratings").Find(ctx, bson.M{"transaction": transactionObjID})
+    if err != nil {
+        return err
+    }
+    defer cursor.Close(ctx)
+    reviewsCollection := db.Collection("reviews")
+    opts := options.Update().SetUpsert(true)
+    for cursor.Next(ctx) {
+        var rating bson.M
+        if err = cursor.Decode(&rating); err != nil {
+            return err
+        }
+        review := bson.M{
+            "rating": rating["_id"],
+            "transaction": transactionObjID,
+            "author": rating["from"],
+            "subject": rating["to"],
+            "score": rating["score"],
+            "comment": rating["comment"],
+            "reply": nil,
+            "removed": nil,
+        }
+        _, err = reviewsCollection.UpdateOne(ctx, bson.M{"rating": rating["_id"]}, bson.M{"$setOnInsert": review}, opts)
+        if err != nil {
+            return err
+        }
+    }
+    if err := cursor.Err(); err != nil {
+        return err
+    }
+    return nil
+}
+
+// ReplyToReview lets a seller reply once to a review of them by their buyer.
+func ReplyToReview(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: ReviewType,
+        Description: "Reply to a review of you as the seller of the trade",
+        Args: graphql.FieldConfigArgument {
+            "reviewID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "text": &graphql.ArgumentConfig {
+                Type: graphql.String,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            reviewID, prs := p.Args["reviewID"]
+            if !prs {
+                return nil, errors.New("Review ID not given for reply")
+            }
+            reviewObjID, err := primitive.ObjectIDFromHex(reviewID.(string))
+            if err != nil {
+                return nil, err
+            }
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for reply")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
+            text, _ := p.Args["text"].(string)
+            if text == "" {
+                return nil, errors.New("Reply cannot be empty")
+            }
+            if len(text) > maxReviewReplyLength {
+                return nil, errors.New("Reply is too long")
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            reviewsCollection := db.Collection("reviews")
+            var review bson.M
+            err = reviewsCollection.FindOne(timeout, bson.M{"_id": reviewObjID, "removed": nil}).Decode(&review)
+            if err == mongo.ErrNoDocuments {
+                return nil, errors.New("Review not found")
+            } else if err != nil {
+                return nil, err
+            }
+            var transaction bson.M
+            err = db.Collection("transactions").FindOne(timeout, bson.M{"_id": review["transaction"]}).Decode(&transaction)
+            if err == mongo.ErrNoDocuments {
+                return nil, errors.New("Transaction of the review not found")
+            } else if err != nil {
+                return nil, err
+            }
+            if review["subject"] != userObjID || transaction["seller"] != userObjID {
+                return nil, errors.New("Only the seller can reply to a review of a trade")
+            }
+
+            reply := bson.M{"text": text, "created": primitive.NewDateTimeFromTime(time.Now())}
+            filter := bson.M{"_id": reviewObjID, "reply": nil}
+            opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+            err = reviewsCollection.FindOneAndUpdate(timeout, filter, bson.M{"$set": bson.M{"reply": reply}}, opts).Decode(&review)
+            if err == mongo.ErrNoDocuments {
+                return nil, errors.New("Review already has a reply")
+            } else if err != nil {
+                return nil, err
+            }
+            return review, nil
+        },
+    }
+}
+
+// RemoveReview hides an abusive review from profiles. Only admins can do this, and the
+// reason is kept on the review. The rating behind it still counts towards reputation.
+func RemoveReview(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: ReviewType,
+        Description: "Remove a review, for admins",
+        Args: graphql.FieldConfigArgument {
+            "reviewID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "adminID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "reason": &graphql.ArgumentConfig {
+                Type: graphql.String,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            reviewID, prs := p.Args["reviewID"]
+            if !prs {
+                return nil, errors.New("Review ID not given for removal")
+            }
+            reviewObjID, err := primitive.ObjectIDFromHex(reviewID.(string))
+            if err != nil {
+                return nil, err
+            }
+            reason, _ := p.Args["reason"].(string)
+            if reason == "" {
+                return nil, errors.New("Reason not given for removing a review")
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            if err = requireAdmin(timeout, db, p.Args["adminID"]); err != nil {
+                return nil, err
+            }
+            adminObjID, _ := primitive.ObjectIDFromHex(p.Args["adminID"].(string))
+
+            removed := bson.M{
+                "by": adminObjID,
+                "reason": reason,
+                "at": primitive.NewDateTimeFromTime(time.Now()),
+            }
+            filter := bson.M{"_id": reviewObjID, "removed": nil}
+            opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+            var review bson.M
+            err = db.Collection("reviews").FindOneAndUpdate(timeout, filter, bson.M{"$set": bson.M{"removed": removed}}, opts).Decode(&review)
+            if err == mongo.ErrNoDocuments {
+                return nil, errors.New("Review not found or already removed")
+            } else if err != nil {
+                return nil, err
+            }
+            if err = audit(timeout, db, AuditReviewRemoved, adminObjID, bson.M{"review": reviewObjID}); err != nil {
+                log.Println(err)
+            }
+            return review, nil
+        },
+    }
+}
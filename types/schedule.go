@@ -0,0 +1,476 @@
+package types
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "github.com/graphql-go/graphql"
+)
+
+// DefaultTradeLength is how long a proposed trade time lasts if no end is given.
+var DefaultTradeLength = 30 * time.Minute
+
+// maxProposedTimes is how many times can be proposed on a single transaction.
+const maxProposedTimes = 20
+
+// icsTimeFormat is how times are written in iCalendar files.
+const icsTimeFormat = "20060102T150405Z"
+
+// slotTimeResolver formats a time of a trade slot in the time zone asked for, or UTC.
+func slotTimeResolver(key string) graphql.FieldResolveFn {
+    return func (p graphql.ResolveParams) (interface{}, error) {
+        t, ok := p.Source.(primitive.M)[key].(primitive.DateTime)
+        if !ok {
+            return nil, nil
+        }
+        loc := time.UTC
+        if timeZone, ok := p.Args["timeZone"].(string); ok {
+            var err error
+            loc, err = time.LoadLocation(timeZone)
+            if err != nil {
+                return nil, errors.New("Unknown time zone: " + timeZone)
+            }
+        }
+        return t.Time().In(loc).Format(time.RFC3339), nil
+    }
+}
+
+var slotTimeArgs = graphql.FieldConfigArgument {
+    "timeZone": &graphql.ArgumentConfig {
+        Type: graphql.String,
+        DefaultValue: nil,
+    },
+}
+
+// TradeSlotType is a time proposed for a trade
+var TradeSlotType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "TradeSlot",
+        Fields: graphql.Fields {
+            "id": &graphql.Field {
+                Type: graphql.ID,
+                Resolve: idResolver,
+            },
+            "start": &graphql.Field {
+                Type: graphql.String,
+                Args: slotTimeArgs,
+                Resolve: slotTimeResolver("start"),
+            },
+            "end": &graphql.Field {
+                Type: graphql.String,
+                Args: slotTimeArgs,
+                Resolve: slotTimeResolver("end"),
+            },
+        },
+    },
+)
+
+func InitTradeSlotType(ctx context.Context, db mongo.Database) {
+    TradeSlotType.AddFieldConfig("proposedBy", &graphql.Field {
+        Type: UserType,
+        Resolve: resolverGenerator(ctx, "proposedBy", *db.Collection("users")),
+    })
+}
+
+// parseTradeTime reads a time for a trade. Times with an offset are taken as they are;
+// times without one, like 2020-06-01T18:30, are in the given location.
+func parseTradeTime(s string, loc *time.Location) (time.Time, error) {
+    if t, err := time.Parse(time.RFC3339, s); err == nil {
+        return t, nil
+    }
+    t, err := time.ParseInLocation("2006-01-02T15:04", s, loc)
+    if err != nil {
+        return time.Time{}, errors.New("Time must be RFC 3339 or YYYY-MM-DDTHH:MM: " + s)
+    }
+    return t, nil
+}
+
+// userLocation returns the location of a user's time zone, or UTC if they haven't set one.
+func userLocation(user bson.M) *time.Location {
+    if timeZone, ok := user["timeZone"].(string); ok {
+        if loc, err := time.LoadLocation(timeZone); err == nil {
+            return loc
+        }
+    }
+    return time.UTC
+}
+
+// loadTradeParticipant gets a transaction that is in progress and checks that a user is
+// its buyer or seller, returning the ObjectID of the other side.
+func loadTradeParticipant(ctx context.Context, db mongo.Database, transactionObjID primitive.ObjectID, userObjID primitive.ObjectID) (bson.M, primitive.ObjectID, error) {
+    var transaction bson.M
+    err := db.Collection("transactions").FindOne(ctx, bson.M{"_id": transactionObjID}).Decode(&transaction)
+    if err != nil {
+        return nil, primitive.NilObjectID, err
+    }
+    var other primitive.ObjectID
+    switch userObjID {
+    case transaction["buyer"]:
+        other = transaction["seller"].(primitive.ObjectID)
+    case transaction["seller"]:
+        other = transaction["buyer"].(primitive.ObjectID)
+    default:
+        return nil, primitive.NilObjectID, errors.New("Only the buyer and seller can schedule a trade")
+    }
+    if transaction["state"] != TransactionStateInProgress {
+        return nil, primitive.NilObjectID, errors.New("Only transactions in progress can be scheduled")
+    }
+    return transaction, other, nil
+}
+
+// SetTimeZone sets the time zone of a user, given as an IANA name like America/New_York.
+// Trade times they propose without an offset are read in this time zone.
+func SetTimeZone(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: UserType,
+        Description: "Set the time zone of a user",
+        Args: graphql.FieldConfigArgument {
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "timeZone": &graphql.ArgumentConfig {
+                Type: graphql.String,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for setting a time zone")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
+            timeZone, _ := p.Args["timeZone"].(string)
+            if _, err = time.LoadLocation(timeZone); err != nil || timeZone == "" {
+                return nil, errors.New("Unknown time zone: " + timeZone)
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+            var user bson.M
+            err = db.Collection("users").FindOneAndUpdate(timeout, bson.M{"_id": userObjID}, bson.M{"$set": bson.M{"timeZone": timeZone}}, opts).Decode(&user)
+            if err != nil {
+                return nil, err
+            }
+            return user, nil
+        },
+    }
+}
+
+// ProposeTradeTime proposes a time slot for a trade to the other side of a transaction.
+func ProposeTradeTime(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: TransactionType,
+        Description: "Propose a time for a trade",
+        Args: graphql.FieldConfigArgument {
+            "transactionID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "start": &graphql.ArgumentConfig {
+                Type: graphql.String,
+            },
+            "end": &graphql.ArgumentConfig {
+                Type: graphql.String,
+                DefaultValue: nil,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            transactionID, prs := p.Args["transactionID"]
+            if !prs {
+                return nil, errors.New("Transaction ID not given for proposing a trade time")
+            }
+            transactionObjID, err := primitive.ObjectIDFromHex(transactionID.(string))
+            if err != nil {
+                return nil, err
+            }
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for proposing a trade time")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            _, other, err := loadTradeParticipant(timeout, db, transactionObjID, userObjID)
+            if err != nil {
+                return nil, err
+            }
+            var user bson.M
+            err = db.Collection("users").FindOne(timeout, bson.M{"_id": userObjID}).Decode(&user)
+            if err != nil {
+                return nil, err
+            }
+            loc := userLocation(user)
+
+            startArg, _ := p.Args["start"].(string)
+            start, err := parseTradeTime(startArg, loc)
+            if err != nil {
+                return nil, err
+            }
+            end := start.Add(DefaultTradeLength)
+            if endArg, ok := p.Args["end"].(string); ok {
+                end, err = parseTradeTime(endArg, loc)
+                if err != nil {
+                    return nil, err
+                }
+            }
+            if !start.After(time.Now()) {
+                return nil, errors.New("Trade times must be in the future")
+            }
+            if !end.After(start) {
+                return nil, errors.New("Trade times must end after they start")
+            }
+
+            slot := bson.M{
+                "_id": primitive.NewObjectID(),
+                "start": primitive.NewDateTimeFromTime(start),
+                "end": primitive.NewDateTimeFromTime(end),
+                "proposedBy": userObjID,
+            }
+            filter := bson.M{
+                "_id": transactionObjID,
+                "state": TransactionStateInProgress,
+                fmt.Sprintf("proposedTimes.%d", maxProposedTimes - 1): bson.M{"$exists": false},
+            }
+            opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+            var transaction bson.M
+            err = db.Collection("transactions").FindOneAndUpdate(timeout, filter, bson.M{"$push": bson.M{"proposedTimes": slot}}, opts).Decode(&transaction)
+            if err == mongo.ErrNoDocuments {
+                return nil, errors.New(fmt.Sprintf("Transaction is no longer in progress or already has %d proposed times", maxProposedTimes))
+            } else if err != nil {
+                return nil, err
+            }
+
+            message := "A time was proposed for your trade: " + start.UTC().Format(time.RFC3339)
+            if err = notify(timeout, db, other, NotificationTradeTimeProposed, message, bson.M{"transaction": transactionObjID}); err != nil {
+                log.Println(err)
+            }
+
+            return transaction, nil
+        },
+    }
+}
+
+// ConfirmTradeTime confirms one of the times the other side of a transaction proposed.
+func ConfirmTradeTime(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: TransactionType,
+        Description: "Confirm a proposed time for a trade",
+        Args: graphql.FieldConfigArgument {
+            "transactionID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "slotID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            transactionID, prs := p.Args["transactionID"]
+            if !prs {
+                return nil, errors.New("Transaction ID not given for confirming a trade time")
+            }
+            transactionObjID, err := primitive.ObjectIDFromHex(transactionID.(string))
+            if err != nil {
+                return nil, err
+            }
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for confirming a trade time")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
+            slotID, prs := p.Args["slotID"]
+            if !prs {
+                return nil, errors.New("Slot ID not given for confirming a trade time")
+            }
+            slotObjID, err := primitive.ObjectIDFromHex(slotID.(string))
+            if err != nil {
+                return nil, err
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            transaction, other, err := loadTradeParticipant(timeout, db, transactionObjID, userObjID)
+            if err != nil {
+                return nil, err
+            }
+            var slot bson.M
+            proposed, _ := transaction["proposedTimes"].(primitive.A)
+            for _, s := range proposed {
+                if s.(primitive.M)["_id"] == slotObjID {
+                    slot = s.(primitive.M)
+                }
+            }
+            if slot == nil {
+                return nil, errors.New("Trade time not found")
+            }
+            if slot["proposedBy"] == userObjID {
+                return nil, errors.New("Cannot confirm a time you proposed")
+            }
+            if start, _ := slot["start"].(primitive.DateTime); !start.Time().After(time.Now()) {
+                return nil, errors.New("That trade time has already started")
+            }
+
+            filter := bson.M{"_id": transactionObjID, "state": TransactionStateInProgress}
+            update := bson.M{"$set": bson.M{"confirmedTime": slot}}
+            opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+            err = db.Collection("transactions").FindOneAndUpdate(timeout, filter, update, opts).Decode(&transaction)
+            if err == mongo.ErrNoDocuments {
+                return nil, errors.New("Transaction is no longer in progress")
+            } else if err != nil {
+                return nil, err
+            }
+
+            start := slot["start"].(primitive.DateTime).Time()
+            message := "Your trade is confirmed for " + start.UTC().Format(time.RFC3339)
+            if err = notify(timeout, db, other, NotificationTradeTimeConfirmed, message, bson.M{"transaction": transactionObjID}); err != nil {
+                log.Println(err)
+            }
+
+            return transaction, nil
+        },
+    }
+}
+
+// icsEscape escapes text for an iCalendar property value.
+func icsEscape(s string) string {
+    return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
+
+// ResetCalendarToken gives a user a new calendar token, which their calendar of upcoming
+// trades is fetched with. Any token they had before stops working. With revoke set, the
+// old token is taken away without a new one.
+func ResetCalendarToken(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: graphql.String,
+        Description: "Replace or revoke the token of a user's trade calendar",
+        Args: graphql.FieldConfigArgument {
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "revoke": &graphql.ArgumentConfig {
+                Type: graphql.Boolean,
+                DefaultValue: false,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            userID, prs := p.Args["userID"]
+            if !prs {
+                return nil, errors.New("User ID not given for resetting a calendar token")
+            }
+            userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+            if err != nil {
+                return nil, err
+            }
+            var token interface{}
+            if revoke, _ := p.Args["revoke"].(bool); !revoke {
+                if token, err = randomToken(); err != nil {
+                    return nil, err
+                }
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            res, err := db.Collection("users").UpdateOne(timeout, bson.M{"_id": userObjID}, bson.M{"$set": bson.M{"calendarToken": token}})
+            if err != nil {
+                return nil, err
+            }
+            if res.MatchedCount == 0 {
+                return nil, errors.New("User not found")
+            }
+            return token, nil
+        },
+    }
+}
+
+// UpcomingTradesCalendar writes the confirmed trades that haven't ended yet of the user
+// with a calendar token as an iCalendar file. It returns mongo.ErrNoDocuments if no user
+// has the token.
+func UpcomingTradesCalendar(ctx context.Context, db mongo.Database, token string) (string, error) {
+    if token == "" {
+        return "", mongo.ErrNoDocuments
+    }
+    var user bson.M
+    if err := db.Collection("users").FindOne(ctx, bson.M{"calendarToken": token}).Decode(&user); err != nil {
+        return "", err
+    }
+    userObjID := user["_id"].(primitive.ObjectID)
+    filter := bson.M{
+        "$or": bson.A{bson.M{"buyer": userObjID}, bson.M{"seller": userObjID}},
+        "state": TransactionStateInProgress,
+        "confirmedTime.end": bson.M{"$gte": primitive.NewDateTimeFromTime(time.Now())},
+    }
+    opts := options.Find().SetSort(bson.M{"confirmedTime.start": 1})
+    cursor, err := db.Collection("transactions").Find(ctx, filter, opts)
+    if err != nil {
+        return "", err
+    }
+    defer cursor.Close(ctx)
+
+    var b strings.Builder
+    b.WriteString("BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//Animal Crossing Exchange//Trades//EN\r\n")
+    now := time.Now().UTC().Format(icsTimeFormat)
+    for cursor.Next(ctx) {
+        var transaction bson.M
+        if err = cursor.Decode(&transaction); err != nil {
+            return "", err
+        }
+        slot := transaction["confirmedTime"].(primitive.M)
+        start := slot["start"].(primitive.DateTime).Time().UTC()
+        end := slot["end"].(primitive.DateTime).Time().UTC()
+
+        summary := "ACE trade"
+        var listing bson.M
+        err = db.Collection("listings").FindOne(ctx, bson.M{"_id": transaction["listing"]}).Decode(&listing)
+        if err == nil {
+            var item bson.M
+            if db.Collection("items").FindOne(ctx, bson.M{"_id": listing["item"]}).Decode(&item) == nil {
+                summary = fmt.Sprintf("ACE trade: %v", item["name"])
+            }
+        }
+        role := "Buying"
+        if transaction["seller"] == userObjID {
+            role = "Selling"
+        }
+        description := fmt.Sprintf("%s for %v bells", role, transaction["price"])
+
+        b.WriteString("BEGIN:VEVENT\r\n")
+        fmt.Fprintf(&b, "UID:%s@ace\r\n", transaction["_id"].(primitive.ObjectID).Hex())
+        fmt.Fprintf(&b, "DTSTAMP:%s\r\n", now)
+        fmt.Fprintf(&b, "DTSTART:%s\r\n", start.Format(icsTimeFormat))
+        fmt.Fprintf(&b, "DTEND:%s\r\n", end.Format(icsTimeFormat))
+        fmt.Fprintf(&b, "SUMMARY:%s\r\n", icsEscape(summary))
+        fmt.Fprintf(&b, "DESCRIPTION:%s\r\n", icsEscape(description))
+        b.WriteString("END:VEVENT\r\n")
+    }
+    if err := cursor.Err(); err != nil {
+        return "", err
+    }
+    b.WriteString("END:VCALENDAR\r\n")
+    return b.String(), nil
+}
@@ -3,10 +3,20 @@ package types
 import (
     "context"
 
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
     "go.mongodb.org/mongo-driver/mongo"
     "github.com/graphql-go/graphql"
 )
 
+// Values of the state field of a transaction
+const (
+    TransactionStateInProgress = "inProgress"
+    TransactionStateCompleted = "completed"
+    TransactionStateFailed = "failed"
+    TransactionStateDisputed = "disputed"
+)
+
 type TransactionStruct struct {
     id string
     state string
@@ -41,6 +51,10 @@ var TransactionType = graphql.NewObject(
             "price": &graphql.Field {
                 Type: graphql.Int,
             },
+            "lineItems": &graphql.Field {
+                Type: graphql.NewList(LineItemType),
+                Description: "What was sold, which may be only part of the listing",
+            },
             "buyerReportedComplete": &graphql.Field {
                 Type: graphql.String, // TODO Date scalar
             },
@@ -53,6 +67,23 @@ var TransactionType = graphql.NewObject(
             "note": &graphql.Field {
                 Type: graphql.String,
             },
+            "settled": &graphql.Field {
+                Type: graphql.String, // TODO Date scalar
+                Description: "When the transaction stopped being in progress",
+            },
+            "autoSettled": &graphql.Field {
+                Type: graphql.Boolean,
+                Description: "Whether the transaction was settled because a deadline passed",
+            },
+            "dodoCodeExpiresAt": &graphql.Field {
+                Type: graphql.String, // TODO Date scalar
+                Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+                    if dodoCode, ok := p.Source.(primitive.M)["dodoCode"].(primitive.M); ok {
+                        return dodoCode["expiresAt"], nil
+                    }
+                    return nil, nil
+                },
+            },
         },
     },
 )
@@ -78,5 +109,85 @@ func InitTransactionType(ctx context.Context, db mongo.Database) {
         Type: UserType,
         Resolve: resolverGenerator(ctx, "unhappyUser", *db.Collection("users")),
     })
+    TransactionType.AddFieldConfig("messages", messagesField(ctx, db, "transaction"))
+    TransactionType.AddFieldConfig("dodoCode", &graphql.Field {
+        Type: graphql.String,
+        Description: "The Dodo code shared for the trade, only shown to the other side",
+        Args: graphql.FieldConfigArgument {
+            "viewerID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "secret": &graphql.ArgumentConfig {
+                Type: graphql.String,
+                Description: "The secret of the transaction, from transactionSecret",
+            },
+        },
+        Resolve: dodoCodeResolver(ctx, db),
+    })
+    TransactionType.AddFieldConfig("proposedTimes", &graphql.Field {
+        Type: graphql.NewList(TradeSlotType),
+        Description: "Times proposed for the trade by either side",
+    })
+    TransactionType.AddFieldConfig("confirmedTime", &graphql.Field {
+        Type: TradeSlotType,
+        Description: "The proposed time both sides agreed on",
+    })
 }
 
+// createTransaction starts a transaction between the seller of a listing and a buyer at
+// the agreed price for the given line items of the listing, and adds it to the
+// transactions of both users.
+func createTransaction(ctx context.Context, db mongo.Database, listing bson.M, buyerObjID primitive.ObjectID, price int, lineItems primitive.A) (bson.M, error) {
+    transactionsCollection := db.Collection("transactions")
+    usersCollection := db.Collection("users")
+    sellerObjID := listing["seller"].(primitive.ObjectID)
+
+    sold := make(bson.A, len(lineItems))
+    for i, l := range lineItems {
+        line := l.(primitive.M)
+        sold[i] = bson.M{"item": line["item"], "variation": line["variation"], "quantity": line["quantity"]}
+    }
+
+    res, err := transactionsCollection.InsertOne(ctx, bson.M{
+        "state": TransactionStateInProgress,
+        "price": price,
+        "lineItems": sold,
+        "buyerReportedComplete": nil,
+        "sellerReportedComplete": nil,
+        "reportedFailed": nil,
+        "note": nil,
+        "settled": nil,
+        "autoSettled": false,
+        "dodoCode": nil,
+        "proposedTimes": bson.A{},
+        "confirmedTime": nil,
+        "listing": listing["_id"],
+        "buyer": buyerObjID,
+        "seller": sellerObjID,
+        "goesFirst": nil,
+        "unhappyUser": nil,
+    })
+    if err != nil {
+        return nil, err
+    }
+    var transaction bson.M
+    err = transactionsCollection.FindOne(ctx, bson.M{"_id": res.InsertedID}).Decode(&transaction)
+    if err != nil {
+        return nil, err
+    }
+
+    err = addToBsonArray(ctx, buyerObjID, *usersCollection, "transactions", res.InsertedID)
+    if err != nil {
+        transactionsCollection.DeleteOne(ctx, bson.M{"_id": res.InsertedID})
+        return nil, err
+    }
+
+    err = addToBsonArray(ctx, sellerObjID, *usersCollection, "transactions", res.InsertedID)
+    if err != nil {
+        transactionsCollection.DeleteOne(ctx, bson.M{"_id": res.InsertedID})
+        pullFromBsonArray(ctx, buyerObjID, *usersCollection, "transactions", res.InsertedID)
+        return nil, err
+    }
+
+    return transaction, nil
+}
@@ -0,0 +1,365 @@
+package types
+
+import (
+    "context"
+    "errors"
+    "log"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "github.com/graphql-go/graphql"
+)
+
+// TransactionReportDeadline is how long one side of a transaction has to answer after the
+// other reports it complete or failed. If they stay silent the report stands.
+var TransactionReportDeadline = 7 * 24 * time.Hour
+
+// TransactionStaleDeadline is how long a transaction can go without either side reporting
+// on it, counted from when it started or the end of its confirmed trade time.
+var TransactionStaleDeadline = 14 * 24 * time.Hour
+
+// StaleTransactionsDispute makes transactions neither side reported on become disputed
+// for an admin to look at, instead of failing.
+var StaleTransactionsDispute = false
+
+// TransactionSweepInterval is how often transactions past a deadline are looked for.
+var TransactionSweepInterval = time.Hour
+
+// settleTransaction ends an in-progress transaction matching filter in the given state,
+// setting any other fields in set, and lets both sides know. A dispute is opened for
+// transactions that end up disputed. If the transaction is no longer in progress or
+// doesn't match, nil is returned.
+func settleTransaction(ctx context.Context, db mongo.Database, filter bson.M, state string, set bson.M) (bson.M, error) {
+    settle := bson.M{"state": TransactionStateInProgress}
+    for key, val := range filter {
+        settle[key] = val
+    }
+    if set == nil {
+        set = bson.M{}
+    }
+    set["state"] = state
+    set["settled"] = primitive.NewDateTimeFromTime(time.Now())
+
+    opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+    var transaction bson.M
+    err := db.Collection("transactions").FindOneAndUpdate(ctx, settle, bson.M{"$set": set}, opts).Decode(&transaction)
+    if err == mongo.ErrNoDocuments {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+
+    if state == TransactionStateDisputed {
+        reason := "Neither side reported on the trade in time"
+        if transaction["unhappyUser"] != nil {
+            reason = "One side reported the trade complete and the other reported it failed"
+        }
+        _, err = insertDispute(ctx, db, transaction["_id"].(primitive.ObjectID), transaction["unhappyUser"], reason, transaction["note"])
+        if err != nil {
+            log.Println(err)
+        }
+    }
+
+    if state == TransactionStateFailed {
+        if err = releaseTransaction(ctx, db, transaction); err != nil {
+            log.Println(err)
+        }
+    }
+
+    if state == TransactionStateCompleted {
+        if err = recomputeTransactionReputations(ctx, db, transaction); err != nil {
+            log.Println(err)
+        }
+        if err = publishReviews(ctx, db, transaction["_id"].(primitive.ObjectID)); err != nil {
+            log.Println(err)
+        }
+    }
+
+    var kind, message string
+    switch state {
+    case TransactionStateCompleted:
+        kind, message = NotificationTransactionCompleted, "Your trade was completed"
+    case TransactionStateFailed:
+        kind, message = NotificationTransactionFailed, "Your trade was marked as failed"
+    case TransactionStateDisputed:
+        kind, message = NotificationTransactionDisputed, "Your trade is disputed and will be looked at by an admin"
+    }
+    refs := bson.M{"transaction": transaction["_id"]}
+    for _, key := range []string{"buyer", "seller"} {
+        if err = notify(ctx, db, transaction[key].(primitive.ObjectID), kind, message, refs); err != nil {
+            log.Println(err)
+        }
+    }
+    return transaction, nil
+}
+
+// releaseTransaction puts what a failed transaction was for back on its listing, so it
+// can be sold to someone else.
+func releaseTransaction(ctx context.Context, db mongo.Database, transaction bson.M) error {
+    var listing bson.M
+    err := db.Collection("listings").FindOne(ctx, bson.M{"_id": transaction["listing"]}).Decode(&listing)
+    if err == mongo.ErrNoDocuments {
+        return nil
+    } else if err != nil {
+        return err
+    }
+    lineItems, ok := transaction["lineItems"].(primitive.A)
+    if !ok {
+        lineItems = listingLineItems(listing)
+    }
+    buyerObjID, _ := transaction["buyer"].(primitive.ObjectID)
+    return releaseLineItems(ctx, db, listing, lineItems, buyerObjID)
+}
+
+// transactionReportArgs reads the transaction and the side of it reporting for the
+// report mutations. The keys of the reporting and other side's completion reports are
+// returned along with it.
+func transactionReportArgs(ctx context.Context, db mongo.Database, args map[string]interface{}) (bson.M, primitive.ObjectID, string, string, error) {
+    transactionID, prs := args["transactionID"]
+    if !prs {
+        return nil, primitive.NilObjectID, "", "", errors.New("Transaction ID not given for report")
+    }
+    transactionObjID, err := primitive.ObjectIDFromHex(transactionID.(string))
+    if err != nil {
+        return nil, primitive.NilObjectID, "", "", err
+    }
+    userID, prs := args["userID"]
+    if !prs {
+        return nil, primitive.NilObjectID, "", "", errors.New("User ID not given for report")
+    }
+    userObjID, err := primitive.ObjectIDFromHex(userID.(string))
+    if err != nil {
+        return nil, primitive.NilObjectID, "", "", err
+    }
+
+    var transaction bson.M
+    err = db.Collection("transactions").FindOne(ctx, bson.M{"_id": transactionObjID}).Decode(&transaction)
+    if err != nil {
+        return nil, primitive.NilObjectID, "", "", err
+    }
+    var own, other string
+    switch userObjID {
+    case transaction["buyer"]:
+        own, other = "buyerReportedComplete", "sellerReportedComplete"
+    case transaction["seller"]:
+        own, other = "sellerReportedComplete", "buyerReportedComplete"
+    default:
+        return nil, primitive.NilObjectID, "", "", errors.New("Only the buyer and seller can report on a transaction")
+    }
+    if transaction["state"] != TransactionStateInProgress {
+        return nil, primitive.NilObjectID, "", "", errors.New("Transaction is no longer in progress")
+    }
+    return transaction, userObjID, own, other, nil
+}
+
+// unchangedFilter matches a transaction only if none of the report fields changed since
+// it was read.
+func unchangedFilter(transaction bson.M) bson.M {
+    return bson.M{
+        "_id": transaction["_id"],
+        "buyerReportedComplete": transaction["buyerReportedComplete"],
+        "sellerReportedComplete": transaction["sellerReportedComplete"],
+        "unhappyUser": transaction["unhappyUser"],
+    }
+}
+
+var errTransactionChanged = errors.New("Transaction changed while reporting, try again")
+
+// ReportTransactionComplete reports that a trade went through. Once both sides have, the
+// transaction is completed. If the other side already reported it failed, it becomes
+// disputed.
+func ReportTransactionComplete(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: TransactionType,
+        Description: "Report a transaction as complete",
+        Args: graphql.FieldConfigArgument {
+            "transactionID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            transaction, userObjID, own, other, err := transactionReportArgs(timeout, db, p.Args)
+            if err != nil {
+                return nil, err
+            }
+            if transaction[own] != nil {
+                return nil, errors.New("You already reported this transaction complete")
+            }
+
+            filter := unchangedFilter(transaction)
+            now := primitive.NewDateTimeFromTime(time.Now())
+            var settled bson.M
+            unhappyUser, _ := transaction["unhappyUser"].(primitive.ObjectID)
+            switch {
+            case transaction["unhappyUser"] != nil && unhappyUser != userObjID:
+                settled, err = settleTransaction(timeout, db, filter, TransactionStateDisputed, bson.M{own: now})
+            case transaction[other] != nil:
+                settled, err = settleTransaction(timeout, db, filter, TransactionStateCompleted, bson.M{own: now, "reportedFailed": nil, "unhappyUser": nil})
+            default:
+                // taking back a failure report is fine while the other side hasn't answered
+                opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+                filter["state"] = TransactionStateInProgress
+                update := bson.M{"$set": bson.M{own: now, "reportedFailed": nil, "unhappyUser": nil}}
+                err = db.Collection("transactions").FindOneAndUpdate(timeout, filter, update, opts).Decode(&settled)
+                if err == mongo.ErrNoDocuments {
+                    return nil, errTransactionChanged
+                }
+            }
+            if err != nil {
+                return nil, err
+            }
+            if settled == nil {
+                return nil, errTransactionChanged
+            }
+            return settled, nil
+        },
+    }
+}
+
+// ReportTransactionFailed reports that a trade didn't go through. Once both sides have,
+// the transaction fails. If the other side already reported it complete, it becomes
+// disputed.
+func ReportTransactionFailed(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: TransactionType,
+        Description: "Report a transaction as failed",
+        Args: graphql.FieldConfigArgument {
+            "transactionID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "userID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "note": &graphql.ArgumentConfig {
+                Type: graphql.String,
+                DefaultValue: nil,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+
+            transaction, userObjID, own, other, err := transactionReportArgs(timeout, db, p.Args)
+            if err != nil {
+                return nil, err
+            }
+            if transaction[own] != nil {
+                return nil, errors.New("You already reported this transaction complete")
+            }
+            if transaction["unhappyUser"] == userObjID {
+                return nil, errors.New("You already reported this transaction failed")
+            }
+
+            filter := unchangedFilter(transaction)
+            now := primitive.NewDateTimeFromTime(time.Now())
+            set := bson.M{"reportedFailed": now, "unhappyUser": userObjID}
+            if note, ok := p.Args["note"].(string); ok {
+                set["note"] = note
+            }
+            var settled bson.M
+            switch {
+            case transaction[other] != nil:
+                settled, err = settleTransaction(timeout, db, filter, TransactionStateDisputed, set)
+            case transaction["unhappyUser"] != nil:
+                delete(set, "unhappyUser")
+                delete(set, "reportedFailed")
+                settled, err = settleTransaction(timeout, db, filter, TransactionStateFailed, set)
+            default:
+                opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+                filter["state"] = TransactionStateInProgress
+                err = db.Collection("transactions").FindOneAndUpdate(timeout, filter, bson.M{"$set": set}, opts).Decode(&settled)
+                if err == mongo.ErrNoDocuments {
+                    return nil, errTransactionChanged
+                }
+            }
+            if err != nil {
+                return nil, err
+            }
+            if settled == nil {
+                return nil, errTransactionChanged
+            }
+            return settled, nil
+        },
+    }
+}
+
+// settleStaleTransactions ends transactions past their deadlines. A report one side made
+// that the other didn't answer stands, and transactions neither side reported on fail,
+// or become disputed if StaleTransactionsDispute is set. A transaction that can't be
+// settled is logged and left for the next run.
+func settleStaleTransactions(ctx context.Context, db mongo.Database) error {
+    reportCutoff := primitive.NewDateTimeFromTime(time.Now().Add(-TransactionReportDeadline))
+    staleCutoff := time.Now().Add(-TransactionStaleDeadline)
+    staleState := TransactionStateFailed
+    if StaleTransactionsDispute {
+        staleState = TransactionStateDisputed
+    }
+
+    sweeps := []struct {
+        filter bson.M
+        state string
+    } {
+        {
+            filter: bson.M{
+                "unhappyUser": nil,
+                "$or": bson.A{
+                    bson.M{"buyerReportedComplete": bson.M{"$lte": reportCutoff}, "sellerReportedComplete": nil},
+                    bson.M{"sellerReportedComplete": bson.M{"$lte": reportCutoff}, "buyerReportedComplete": nil},
+                },
+            },
+            state: TransactionStateCompleted,
+        },
+        {
+            filter: bson.M{"reportedFailed": bson.M{"$lte": reportCutoff}},
+            state: TransactionStateFailed,
+        },
+        {
+            filter: bson.M{
+                "_id": bson.M{"$lt": primitive.NewObjectIDFromTimestamp(staleCutoff)},
+                "buyerReportedComplete": nil,
+                "sellerReportedComplete": nil,
+                "reportedFailed": nil,
+                "$or": bson.A{
+                    bson.M{"confirmedTime": nil},
+                    bson.M{"confirmedTime.end": bson.M{"$lte": primitive.NewDateTimeFromTime(staleCutoff)}},
+                },
+            },
+            state: staleState,
+        },
+    }
+
+    transactionsCollection := db.Collection("transactions")
+    for _, sweep := range sweeps {
+        sweep.filter["state"] = TransactionStateInProgress
+        cursor, err := transactionsCollection.Find(ctx, sweep.filter)
+        if err != nil {
+            return err
+        }
+        defer cursor.Close(ctx)
+        for cursor.Next(ctx) {
+            var transaction bson.M
+            if err = cursor.Decode(&transaction); err != nil {
+                log.Println(err)
+                continue
+            }
+            filter := bson.M{"$and": bson.A{sweep.filter, bson.M{"_id": transaction["_id"]}}}
+            _, err = settleTransaction(ctx, db, filter, sweep.state, bson.M{"autoSettled": true})
+            if err != nil {
+                log.Printf("Settling transaction %s: %s", transaction["_id"].(primitive.ObjectID).Hex(), err)
+            }
+        }
+        if err := cursor.Err(); err != nil {
+            return err
+        }
+    }
+    return nil
+}
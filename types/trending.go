@@ -0,0 +1,249 @@
+package types
+
+import (
+    "context"
+    "errors"
+    "math"
+    "sort"
+    "sync"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "github.com/graphql-go/graphql"
+)
+
+// TrendingRefreshInterval is how often the trending items cache is recomputed.
+var TrendingRefreshInterval = 10 * time.Minute
+
+// Weights of each signal in the score of a trending item. Price change is a fraction,
+// so a 10% move with the default weight counts as much as 10 new listings.
+var (
+    TrendingListingWeight = 1.0
+    TrendingInquiryWeight = 2.0
+    TrendingPriceChangeWeight = 100.0
+)
+
+// trendingCacheSize is how many items are kept in the cache for each window.
+const trendingCacheSize = 100
+
+// windowDurations are the lengths of the windows trending items are computed over.
+var windowDurations = map[string]time.Duration {
+    IntervalDay: 24 * time.Hour,
+    IntervalWeek: 7 * 24 * time.Hour,
+    IntervalMonth: 30 * 24 * time.Hour,
+}
+
+// trendingCache holds the latest trending items for each window, so that the trendingItems
+// query doesn't have to run the aggregations on every request.
+var trendingCache = struct {
+    sync.RWMutex
+    items map[string][]bson.M
+}{items: make(map[string][]bson.M)}
+
+// TrendingItemType is a result of the trendingItems query. It is not stored in the database.
+var TrendingItemType = graphql.NewObject(
+    graphql.ObjectConfig {
+        Name: "TrendingItem",
+        Fields: graphql.Fields {
+            "score": &graphql.Field {
+                Type: graphql.Float,
+            },
+            "newListings": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "inquiries": &graphql.Field {
+                Type: graphql.Int,
+            },
+            "priceChange": &graphql.Field {
+                Type: graphql.Float,
+                Description: "Change of the median price over the window, as a fraction",
+            },
+        },
+    },
+)
+
+func InitTrendingItemType(ctx context.Context, db mongo.Database) {
+    TrendingItemType.AddFieldConfig("item", &graphql.Field {
+        Type: ItemType,
+        Resolve: resolverGenerator(ctx, "item", *db.Collection("items")),
+    })
+}
+
+// countByItem runs a pipeline that ends in documents with an item field and returns how
+// many documents there were for each item.
+func countByItem(ctx context.Context, coll mongo.Collection, pipeline []bson.M) (map[primitive.ObjectID]int, error) {
+    pipeline = append(pipeline, bson.M{"$group": bson.M{"_id": "$item", "count": bson.M{"$sum": 1}}})
+    cursor, err := coll.Aggregate(ctx, pipeline)
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+    counts := make(map[primitive.ObjectID]int)
+    for cursor.Next(ctx) {
+        var group bson.M
+        if err = cursor.Decode(&group); err != nil {
+            return nil, err
+        }
+        if itemObjID, ok := group["_id"].(primitive.ObjectID); ok {
+            counts[itemObjID], _ = toInt(group["count"])
+        }
+    }
+    if err := cursor.Err(); err != nil {
+        return nil, err
+    }
+    return counts, nil
+}
+
+// computeTrending ranks items by the listings created, the inquiries made and the change
+// in their median price over a window.
+func computeTrending(ctx context.Context, db mongo.Database, window string) ([]bson.M, error) {
+    since := time.Now().Add(-windowDurations[window])
+    sinceID := bson.M{"$gte": primitive.NewObjectIDFromTimestamp(since)}
+
+    // deleted and expired listings are left out, the same as they are from item listings
+    listings, err := countByItem(ctx, *db.Collection("listings"), []bson.M{
+        {"$match": bson.M{"_id": sinceID, "deleted": bson.M{"$ne": true}, "expired": bson.M{"$ne": true}}},
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    inquiries, err := countByItem(ctx, *db.Collection("inquiries"), []bson.M{
+        {"$match": bson.M{"_id": sinceID}},
+        {"$lookup": bson.M{"from": "listings", "localField": "listing", "foreignField": "_id", "as": "listing"}},
+        {"$unwind": "$listing"},
+        {"$project": bson.M{"item": "$listing.item"}},
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    cursor, err := db.Collection("records").Aggregate(ctx, []bson.M{
+        {"$match": bson.M{"variation": nil, "date": bson.M{"$gte": since.UTC().Format("2006-01-02")}}},
+        {"$sort": bson.M{"date": 1}},
+        {"$group": bson.M{
+            "_id": "$item",
+            "first": bson.M{"$first": "$median"},
+            "last": bson.M{"$last": "$median"},
+        }},
+    })
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+    priceChanges := make(map[primitive.ObjectID]float64)
+    for cursor.Next(ctx) {
+        var group bson.M
+        if err = cursor.Decode(&group); err != nil {
+            return nil, err
+        }
+        itemObjID, ok := group["_id"].(primitive.ObjectID)
+        first, _ := toInt(group["first"])
+        last, _ := toInt(group["last"])
+        if ok && first > 0 {
+            priceChanges[itemObjID] = float64(last - first) / float64(first)
+        }
+    }
+    if err := cursor.Err(); err != nil {
+        return nil, err
+    }
+
+    itemObjIDs := make(map[primitive.ObjectID]bool)
+    for id := range listings {
+        itemObjIDs[id] = true
+    }
+    for id := range inquiries {
+        itemObjIDs[id] = true
+    }
+    for id := range priceChanges {
+        itemObjIDs[id] = true
+    }
+
+    trending := make([]bson.M, 0, len(itemObjIDs))
+    for id := range itemObjIDs {
+        score := TrendingListingWeight * float64(listings[id]) +
+            TrendingInquiryWeight * float64(inquiries[id]) +
+            TrendingPriceChangeWeight * math.Abs(priceChanges[id])
+        trending = append(trending, bson.M{
+            "item": id,
+            "score": score,
+            "newListings": listings[id],
+            "inquiries": inquiries[id],
+            "priceChange": priceChanges[id],
+        })
+    }
+    sort.Slice(trending, func(i, j int) bool {
+        return trending[i]["score"].(float64) > trending[j]["score"].(float64)
+    })
+    if len(trending) > trendingCacheSize {
+        trending = trending[:trendingCacheSize]
+    }
+    return trending, nil
+}
+
+// refreshTrending recomputes the trending items of every window and stores them in the cache.
+func refreshTrending(ctx context.Context, db mongo.Database) error {
+    for window := range windowDurations {
+        trending, err := computeTrending(ctx, db, window)
+        if err != nil {
+            return err
+        }
+        trendingCache.Lock()
+        trendingCache.items[window] = trending
+        trendingCache.Unlock()
+    }
+    return nil
+}
+
+// TrendingItems is a query for the items with the most market activity over a window.
+// Results come from a cache refreshed every TrendingRefreshInterval, and are only
+// computed on the spot if the cache hasn't been filled yet.
+func TrendingItems(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: graphql.NewList(TrendingItemType),
+        Description: "Get the items with the most market activity",
+        Args: graphql.FieldConfigArgument {
+            "window": &graphql.ArgumentConfig {
+                Type: IntervalEnum,
+                DefaultValue: IntervalDay,
+            },
+            "limit": &graphql.ArgumentConfig {
+                Type: graphql.Int,
+                DefaultValue: 10,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            window, _ := p.Args["window"].(string)
+            if _, ok := windowDurations[window]; !ok {
+                window = IntervalDay
+            }
+            limit, _ := p.Args["limit"].(int)
+            if limit < 1 || limit > trendingCacheSize {
+                return nil, errors.New("Limit must be between 1 and 100")
+            }
+
+            trendingCache.RLock()
+            trending, prs := trendingCache.items[window]
+            trendingCache.RUnlock()
+            if !prs {
+                timeout, cancel := context.WithTimeout(ctx, time.Second * 3)
+                defer cancel()
+                var err error
+                trending, err = computeTrending(timeout, db, window)
+                if err != nil {
+                    return nil, err
+                }
+                trendingCache.Lock()
+                trendingCache.items[window] = trending
+                trendingCache.Unlock()
+            }
+
+            if len(trending) > limit {
+                trending = trending[:limit]
+            }
+            return trending, nil
+        },
+    }
+}
@@ -3,6 +3,8 @@ package types
 
 import (
     "context"
+    "crypto/rand"
+    "encoding/hex"
     "errors"
     "fmt"
     "time"
@@ -87,12 +89,119 @@ func resolverGenerator(ctx context.Context, objKey string, collection mongo.Coll
                 return nil, err
             }
             return obj, nil
-        case primitive.Null: // or it could be null
-            // TODO: make sure this works when we have operations for types that can have null values
+        case nil: // or it could be null, which is decoded as nil
             return nil, nil
-        default: // or objKey might not be part of the document
+        default: // or something that isn't a reference at all
             return nil, errors.New(fmt.Sprintf("Invalid param for extraction from db.%s: %s", collection.Name(), objKey))
         }
     }
 }
 
+// withArgFilters wraps a resolver that returns a list of documents, such as one made by
+// resolverGenerator, so that only documents matching the field's arguments are returned.
+// Each key is both the name of an argument and the document key it's compared against.
+// Arguments that weren't given don't filter anything.
+func withArgFilters(resolve graphql.FieldResolveFn, keys ...string) graphql.FieldResolveFn {
+    return func (p graphql.ResolveParams) (interface{}, error) {
+        res, err := resolve(p)
+        if err != nil {
+            return nil, err
+        }
+        docs, ok := res.([]bson.M)
+        if !ok {
+            return res, nil
+        }
+        filtered := make([]bson.M, 0, len(docs))
+        for _, doc := range docs {
+            matches := true
+            for _, key := range keys {
+                if val, prs := p.Args[key]; prs && doc[key] != val {
+                    matches = false
+                    break
+                }
+            }
+            if matches {
+                filtered = append(filtered, doc)
+            }
+        }
+        return filtered, nil
+    }
+}
+
+// hiding wraps a resolver that returns a list of documents so that documents where any
+// of the given keys is true are left out, e.g. to keep deleted documents out of public
+// queries.
+func hiding(resolve graphql.FieldResolveFn, keys ...string) graphql.FieldResolveFn {
+    return func (p graphql.ResolveParams) (interface{}, error) {
+        res, err := resolve(p)
+        if err != nil {
+            return nil, err
+        }
+        docs, ok := res.([]bson.M)
+        if !ok {
+            return res, nil
+        }
+        visible := make([]bson.M, 0, len(docs))
+        for _, doc := range docs {
+            hidden := false
+            for _, key := range keys {
+                if doc[key] == true {
+                    hidden = true
+                    break
+                }
+            }
+            if !hidden {
+                visible = append(visible, doc)
+            }
+        }
+        return visible, nil
+    }
+}
+
+// parseDate reads a date passed as a GraphQL argument, either as a plain day
+// (2006-01-02) or as an RFC 3339 timestamp. Plain days are taken to be in UTC.
+func parseDate(s string) (time.Time, error) {
+    if t, err := time.Parse("2006-01-02", s); err == nil {
+        return t, nil
+    }
+    t, err := time.Parse(time.RFC3339, s)
+    if err != nil {
+        return time.Time{}, errors.New(fmt.Sprintf("Invalid date, expected YYYY-MM-DD or RFC 3339: %s", s))
+    }
+    return t, nil
+}
+
+// objectIDRange returns a filter on _id matching documents created within [from, to),
+// using the creation time embedded in every ObjectID.
+func objectIDRange(from time.Time, to time.Time) bson.M {
+    return bson.M{
+        "$gte": primitive.NewObjectIDFromTimestamp(from),
+        "$lt": primitive.NewObjectIDFromTimestamp(to),
+    }
+}
+
+// toInt converts a number decoded from a document to an int. Depending on its size and
+// how it was computed, a number can come out of the database as an int32, int64 or double.
+func toInt(val interface{}) (int, bool) {
+    switch n := val.(type) {
+    case int32:
+        return int(n), true
+    case int64:
+        return int(n), true
+    case float64:
+        return int(n), true
+    case int:
+        return n, true
+    default:
+        return 0, false
+    }
+}
+
+// randomToken makes an unguessable token of 32 hex digits, for secrets handed out to users.
+func randomToken() (string, error) {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(b), nil
+}
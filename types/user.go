@@ -47,6 +47,10 @@ var UserType = graphql.NewObject(
             "reputation": &graphql.Field {
                 Type: graphql.Int,
             },
+            "reputationBreakdown": &graphql.Field {
+                Type: ReputationBreakdownType,
+                Description: "How the reputation was worked out, null until it first changes",
+            },
             "admin": &graphql.Field {
                 Type: graphql.Boolean,
             },
@@ -56,6 +60,10 @@ var UserType = graphql.NewObject(
             "banNote": &graphql.Field {
                 Type: graphql.String,
             },
+            "timeZone": &graphql.Field {
+                Type: graphql.String,
+                Description: "IANA name of the time zone of the user, like Europe/London",
+            },
         },
     },
 )
@@ -63,7 +71,7 @@ var UserType = graphql.NewObject(
 func InitUserType(ctx context.Context, db mongo.Database) {
     UserType.AddFieldConfig("listings", &graphql.Field {
         Type: graphql.NewList(ListingType),
-        Resolve: resolverGenerator(ctx, "listings", *db.Collection("listings")),
+        Resolve: hiding(resolverGenerator(ctx, "listings", *db.Collection("listings")), "deleted"),
     })
     UserType.AddFieldConfig("inquiries", &graphql.Field {
         Type: graphql.NewList(ListingInquiryType),
@@ -73,6 +81,32 @@ func InitUserType(ctx context.Context, db mongo.Database) {
         Type: graphql.NewList(TransactionType),
         Resolve: resolverGenerator(ctx, "transactions", *db.Collection("transactions")),
     })
+    UserType.AddFieldConfig("buyOrders", &graphql.Field {
+        Type: graphql.NewList(BuyOrderType),
+        Resolve: resolverGenerator(ctx, "buyOrders", *db.Collection("buyorders")),
+    })
+    UserType.AddFieldConfig("notifications", &graphql.Field {
+        Type: graphql.NewList(NotificationType),
+        Args: graphql.FieldConfigArgument {
+            "viewerID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "unreadOnly": &graphql.ArgumentConfig {
+                Type: graphql.Boolean,
+                DefaultValue: false,
+            },
+        },
+        Resolve: userNotificationsResolver(ctx, db),
+    })
+    UserType.AddFieldConfig("unreadMessages", &graphql.Field {
+        Type: graphql.Int,
+        Args: graphql.FieldConfigArgument {
+            "viewerID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+        },
+        Resolve: unreadMessagesResolver(ctx, db),
+    })
 }
 
 // AddUser creates a new user from a Discord ID. Before adding the user to the DB,
@@ -104,12 +138,15 @@ func AddUser(ctx context.Context, usersCollection mongo.Collection) graphql.Fiel
                 "discordID": discordID,
                 "lastLogin": primitive.NewDateTimeFromTime(time.Now()),
                 "reputation": 0,
+                "reputationBreakdown": nil,
                 "admin": false,
                 "banned": nil,
                 "banNote": nil,
+                "timeZone": "UTC",
                 "transactions": bson.A{},
                 "listings": bson.A{},
                 "inquiries": bson.A{},
+                "buyOrders": bson.A{},
             })
             if err != nil {
                 return nil, err
@@ -221,23 +258,27 @@ func BanUser(ctx context.Context, usersCollection mongo.Collection) graphql.Fiel
             if err != nil {
                 return nil, err
             }
-            note := p.Args["note"]
-            date := time.Now().String()
-            filter := bson.M{"_id": objID}
-            update := bson.D{{"$set", bson.M{"banned": date, "banNote": note}}}
-            opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
             timeout, cancel := context.WithTimeout(ctx, time.Second)
             defer cancel()
-            var bannedUser bson.M
-            err = usersCollection.FindOneAndUpdate(timeout, filter, update, opts).Decode(&bannedUser)
-            if err != nil {
-                return nil, err
-            }
-            return bannedUser, nil
+            return banUser(timeout, usersCollection, objID, p.Args["note"])
         },
     }
 }
 
+// banUser sets the banned and banNote fields on a user, returning the banned user.
+func banUser(ctx context.Context, usersCollection mongo.Collection, objID primitive.ObjectID, note interface{}) (bson.M, error) {
+    date := time.Now().String()
+    filter := bson.M{"_id": objID}
+    update := bson.M{"$set": bson.M{"banned": date, "banNote": note}}
+    opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+    var bannedUser bson.M
+    err := usersCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&bannedUser)
+    if err != nil {
+        return nil, err
+    }
+    return bannedUser, nil
+}
+
 // UnbanUser clears the banned and banNote fields on a user in the database.
 func UnbanUser(ctx context.Context, usersCollection mongo.Collection) graphql.Field {
     return graphql.Field {
@@ -272,3 +313,45 @@ func UnbanUser(ctx context.Context, usersCollection mongo.Collection) graphql.Fi
     }
 }
 
+// requireSelfOrAdmin checks that the viewer with the given ID is the user, or an admin,
+// for fields that only the user themself should be able to read.
+func requireSelfOrAdmin(ctx context.Context, db mongo.Database, viewerID interface{}, userObjID interface{}) error {
+    id, ok := viewerID.(string)
+    if !ok {
+        return errors.New("Viewer ID not given")
+    }
+    viewerObjID, err := primitive.ObjectIDFromHex(id)
+    if err != nil {
+        return err
+    }
+    if viewerObjID != userObjID {
+        if err = requireAdmin(ctx, db, id); err != nil {
+            return errors.New("Only the user and admins can see this")
+        }
+    }
+    return nil
+}
+
+// requireAdmin checks that the user with the given ID is an admin who isn't banned,
+// for operations that only admins are allowed to perform.
+func requireAdmin(ctx context.Context, db mongo.Database, adminID interface{}) error {
+    id, ok := adminID.(string)
+    if !ok {
+        return errors.New("Admin ID not given")
+    }
+    objID, err := primitive.ObjectIDFromHex(id)
+    if err != nil {
+        return err
+    }
+    var admin bson.M
+    err = db.Collection("users").FindOne(ctx, bson.M{"_id": objID}).Decode(&admin)
+    if err == mongo.ErrNoDocuments {
+        return errors.New("Admin not found")
+    } else if err != nil {
+        return err
+    }
+    if admin["admin"] != true || admin["banned"] != nil {
+        return errors.New("User is not an admin")
+    }
+    return nil
+}
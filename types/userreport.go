@@ -4,14 +4,42 @@ import (
     "context"
     "errors"
     "fmt"
+    "log"
     "time"
 
     "go.mongodb.org/mongo-driver/bson"
     "go.mongodb.org/mongo-driver/bson/primitive"
     "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
     "github.com/graphql-go/graphql"
 )
 
+// Values of the status field of a report
+const (
+    ReportStatusOpen = "OPEN"
+    ReportStatusResolved = "RESOLVED"
+    ReportStatusDismissed = "DISMISSED"
+)
+
+var ReportStatusEnum = graphql.NewEnum(
+    graphql.EnumConfig {
+        Name: "ReportStatus",
+        Values: graphql.EnumValueConfigMap {
+            ReportStatusOpen: &graphql.EnumValueConfig {
+                Value: ReportStatusOpen,
+            },
+            ReportStatusResolved: &graphql.EnumValueConfig {
+                Value: ReportStatusResolved,
+                Description: "A moderator acted on the report",
+            },
+            ReportStatusDismissed: &graphql.EnumValueConfig {
+                Value: ReportStatusDismissed,
+                Description: "A moderator decided the report needed no action",
+            },
+        },
+    },
+)
+
 // UserReportType corresponds to the "reports" collection
 var UserReportType = graphql.NewObject(
     graphql.ObjectConfig {
@@ -25,13 +53,67 @@ var UserReportType = graphql.NewObject(
                 Type: graphql.String,
                 Resolve: timestampResolver,
             },
+            "reason": &graphql.Field {
+                Type: ReportReasonEnum,
+            },
             "note": &graphql.Field {
                 Type: graphql.String,
             },
+            "status": &graphql.Field {
+                Type: ReportStatusEnum,
+            },
+            "moderatorNote": &graphql.Field {
+                Type: graphql.String,
+            },
+            "closed": &graphql.Field {
+                Type: graphql.String, // TODO Date scalar
+            },
+            "banned": &graphql.Field {
+                Type: graphql.Boolean,
+                Description: "Whether the reported user was banned from the report",
+            },
+        },
+    },
+)
+
+// Values of the reason field of a report
+const (
+    ReportReasonScam = "SCAM"
+    ReportReasonNoShow = "NO_SHOW"
+    ReportReasonHarassment = "HARASSMENT"
+    ReportReasonSpam = "SPAM"
+    ReportReasonPriceManipulation = "PRICE_MANIPULATION"
+    ReportReasonOther = "OTHER"
+)
+
+var ReportReasonEnum = graphql.NewEnum(
+    graphql.EnumConfig {
+        Name: "ReportReason",
+        Values: graphql.EnumValueConfigMap {
+            ReportReasonScam: &graphql.EnumValueConfig {
+                Value: ReportReasonScam,
+            },
+            ReportReasonNoShow: &graphql.EnumValueConfig {
+                Value: ReportReasonNoShow,
+            },
+            ReportReasonHarassment: &graphql.EnumValueConfig {
+                Value: ReportReasonHarassment,
+            },
+            ReportReasonSpam: &graphql.EnumValueConfig {
+                Value: ReportReasonSpam,
+            },
+            ReportReasonPriceManipulation: &graphql.EnumValueConfig {
+                Value: ReportReasonPriceManipulation,
+            },
+            ReportReasonOther: &graphql.EnumValueConfig {
+                Value: ReportReasonOther,
+            },
         },
     },
 )
 
+var UserReportConnectionType = connectionType("UserReport", UserReportType)
+
 func InitUserReportType(ctx context.Context, db mongo.Database) {
     UserReportType.AddFieldConfig("reporter", &graphql.Field {
         Type: UserType,
@@ -41,13 +123,89 @@ func InitUserReportType(ctx context.Context, db mongo.Database) {
         Type: UserType,
         Resolve: resolverGenerator(ctx, "scumbag", *db.Collection("users")),
     })
+    UserReportType.AddFieldConfig("listing", &graphql.Field {
+        Type: ListingType,
+        Resolve: resolverGenerator(ctx, "listing", *db.Collection("listings")),
+    })
+    UserReportType.AddFieldConfig("inquiry", &graphql.Field {
+        Type: ListingInquiryType,
+        Resolve: resolverGenerator(ctx, "inquiry", *db.Collection("inquiries")),
+    })
+    UserReportType.AddFieldConfig("transaction", &graphql.Field {
+        Type: TransactionType,
+        Resolve: resolverGenerator(ctx, "transaction", *db.Collection("transactions")),
+    })
+    UserReportType.AddFieldConfig("closedBy", &graphql.Field {
+        Type: UserType,
+        Resolve: resolverGenerator(ctx, "closedBy", *db.Collection("users")),
+    })
+    UserType.AddFieldConfig("openReports", &graphql.Field {
+        Type: graphql.Int,
+        Description: "How many open reports there are against the user",
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            timeout, cancel := context.WithTimeout(ctx, time.Second)
+            defer cancel()
+            filter := bson.M{"scumbag": p.Source.(primitive.M)["_id"], "status": ReportStatusOpen}
+            count, err := db.Collection("reports").CountDocuments(timeout, filter)
+            if err != nil {
+                return nil, err
+            }
+            return count, nil
+        },
+    })
 }
 
-// ReportUser creates a new report from a reporter, a problematic user, and a note. If
-// a report with the same users has already been created, an error is returned. For now,
-// the function does not check to see if the users actually exist, only that the IDs are
-// valid ObjectIDs.
-func ReportUser(ctx context.Context, reportsCollection mongo.Collection) graphql.Field {
+// reportContext checks the listing, inquiry or transaction given with a report exists and
+// that the reported user took part in it, returning its ObjectID, or nil if none is given.
+func reportContext(ctx context.Context, db mongo.Database, id interface{}, key string, sObjID primitive.ObjectID) (interface{}, error) {
+    idString, ok := id.(string)
+    if !ok {
+        return nil, nil
+    }
+    objID, err := primitive.ObjectIDFromHex(idString)
+    if err != nil {
+        return nil, err
+    }
+    collections := map[string]string{"listing": "listings", "inquiry": "inquiries", "transaction": "transactions"}
+    var doc bson.M
+    err = db.Collection(collections[key]).FindOne(ctx, bson.M{"_id": objID}).Decode(&doc)
+    if err == mongo.ErrNoDocuments {
+        return nil, errors.New(fmt.Sprintf("Reported %s not found", key))
+    } else if err != nil {
+        return nil, err
+    }
+
+    involved := false
+    switch key {
+    case "listing":
+        involved = doc["seller"] == sObjID
+    case "inquiry":
+        involved = doc["buyer"] == sObjID
+        if !involved {
+            var listing bson.M
+            err = db.Collection("listings").FindOne(ctx, bson.M{"_id": doc["listing"]}).Decode(&listing)
+            if err != nil {
+                return nil, err
+            }
+            involved = listing["seller"] == sObjID
+        }
+    case "transaction":
+        involved = doc["buyer"] == sObjID || doc["seller"] == sObjID
+    }
+    if !involved {
+        return nil, errors.New(fmt.Sprintf("Reported user has nothing to do with the %s", key))
+    }
+    return objID, nil
+}
+
+// ReportUser creates a new report from a reporter, a problematic user, a reason and a
+// note. Both users have to exist, and users can't report themselves. The listing, inquiry
+// or transaction the report is about can be given, as long as the reported user took
+// part in it. If an open report with the same users has already been created, an error
+// is returned.
+func ReportUser(ctx context.Context, db mongo.Database) graphql.Field {
+    reportsCollection := db.Collection("reports")
+
     return graphql.Field {
         Type: UserReportType,
         Description: "Report a user",
@@ -58,9 +216,24 @@ func ReportUser(ctx context.Context, reportsCollection mongo.Collection) graphql
             "scumbagID": &graphql.ArgumentConfig {
                 Type: graphql.ID,
             },
+            "reason": &graphql.ArgumentConfig {
+                Type: ReportReasonEnum,
+            },
             "note": &graphql.ArgumentConfig {
                 Type: graphql.String,
             },
+            "listingID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+                DefaultValue: nil,
+            },
+            "inquiryID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+                DefaultValue: nil,
+            },
+            "transactionID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+                DefaultValue: nil,
+            },
         },
         Resolve: func (p graphql.ResolveParams) (interface{}, error) {
             reporterID, prs := p.Args["reporterID"]
@@ -79,27 +252,57 @@ func ReportUser(ctx context.Context, reportsCollection mongo.Collection) graphql
             if err != nil {
                 return nil, err
             }
+            if rObjID == sObjID {
+                return nil, errors.New("Users cannot report themselves")
+            }
+            reason, prs := p.Args["reason"]
+            if !prs || reason == nil {
+                return nil, errors.New("Reason not given for user report")
+            }
             note, prs := p.Args["note"]
             if !prs {
                 return nil, errors.New("Note not given for user report")
             }
             timeout, cancel := context.WithTimeout(ctx, time.Second)
             defer cancel()
-            var userreport bson.M
-            err = reportsCollection.FindOne(timeout, bson.M{"reporter": rObjID, "scumbag": sObjID}).Decode(&userreport)
-            if err != nil && err.Error() != "mongo: no documents in result" {
-                return nil, err
-            } else if err == nil {
-                return nil, errors.New(fmt.Sprintf("Report already created"))
+
+            usersCollection := db.Collection("users")
+            for _, objID := range []primitive.ObjectID{rObjID, sObjID} {
+                count, err := usersCollection.CountDocuments(timeout, bson.M{"_id": objID})
+                if err != nil {
+                    return nil, err
+                }
+                if count == 0 {
+                    return nil, errors.New("User not found: " + objID.Hex())
+                }
             }
-            res, err := reportsCollection.InsertOne(timeout, bson.M{
+
+            report := bson.M{
                 "reporter": rObjID,
                 "scumbag": sObjID,
+                "reason": reason,
                 "note": note,
-            })
-            if err != nil {
+                "status": ReportStatusOpen,
+                "moderatorNote": nil,
+                "closedBy": nil,
+                "closed": nil,
+                "banned": false,
+            }
+            for _, key := range []string{"listing", "inquiry", "transaction"} {
+                report[key], err = reportContext(timeout, db, p.Args[key + "ID"], key, sObjID)
+                if err != nil {
+                    return nil, err
+                }
+            }
+
+            // the one_open_report_per_pair index makes sure there's one open report at most
+            res, err := reportsCollection.InsertOne(timeout, report)
+            if isDuplicateKey(err) {
+                return nil, errors.New("Report already created")
+            } else if err != nil {
                 return nil, err
             }
+            var userreport bson.M
             err = reportsCollection.FindOne(timeout, bson.M{"_id": res.InsertedID}).Decode(&userreport)
             if err != nil {
                 return nil, err
@@ -109,3 +312,199 @@ func ReportUser(ctx context.Context, reportsCollection mongo.Collection) graphql
     }
 }
 
+// Reports gets reports for moderators to look at, oldest first, optionally only those
+// against one user.
+func Reports(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: UserReportConnectionType,
+        Description: "Get user reports, for admins",
+        Args: connectionArgs(graphql.FieldConfigArgument {
+            "adminID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "status": &graphql.ArgumentConfig {
+                Type: ReportStatusEnum,
+                DefaultValue: ReportStatusOpen,
+            },
+            "scumbagID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+                DefaultValue: nil,
+            },
+        }),
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            skip, limit, err := pageArgs(p)
+            if err != nil {
+                return nil, err
+            }
+
+            timeout, cancel := context.WithTimeout(ctx, time.Second * 3)
+            defer cancel()
+
+            if err = requireAdmin(timeout, db, p.Args["adminID"]); err != nil {
+                return nil, err
+            }
+
+            filter := bson.M{}
+            if status, ok := p.Args["status"].(string); ok {
+                filter["status"] = status
+            }
+            if scumbagID, ok := p.Args["scumbagID"].(string); ok {
+                sObjID, err := primitive.ObjectIDFromHex(scumbagID)
+                if err != nil {
+                    return nil, err
+                }
+                filter["scumbag"] = sObjID
+            }
+            reportsCollection := db.Collection("reports")
+            total, err := reportsCollection.CountDocuments(timeout, filter)
+            if err != nil {
+                return nil, err
+            }
+            opts := options.Find().SetSort(bson.M{"_id": 1}).SetSkip(int64(skip)).SetLimit(int64(limit))
+            cursor, err := reportsCollection.Find(timeout, filter, opts)
+            if err != nil {
+                return nil, err
+            }
+            defer cursor.Close(timeout)
+            reports := make([]bson.M, 0)
+            for cursor.Next(timeout) {
+                var report bson.M
+                if err = cursor.Decode(&report); err != nil {
+                    return nil, err
+                }
+                reports = append(reports, report)
+            }
+            if err := cursor.Err(); err != nil {
+                return nil, err
+            }
+            return newConnection(reports, skip, int(total)), nil
+        },
+    }
+}
+
+// closeReport closes an open report with the given status and the moderator's note,
+// and lets the reporter know it was looked at.
+func closeReport(ctx context.Context, db mongo.Database, args map[string]interface{}, status string, set bson.M) (bson.M, error) {
+    reportID, prs := args["reportID"]
+    if !prs {
+        return nil, errors.New("Report ID not given for closing a report")
+    }
+    reportObjID, err := primitive.ObjectIDFromHex(reportID.(string))
+    if err != nil {
+        return nil, err
+    }
+    if err = requireAdmin(ctx, db, args["adminID"]); err != nil {
+        return nil, err
+    }
+    adminObjID, _ := primitive.ObjectIDFromHex(args["adminID"].(string))
+
+    if set == nil {
+        set = bson.M{}
+    }
+    set["status"] = status
+    set["moderatorNote"] = args["note"]
+    set["closedBy"] = adminObjID
+    set["closed"] = primitive.NewDateTimeFromTime(time.Now())
+    filter := bson.M{"_id": reportObjID, "status": ReportStatusOpen}
+    opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+    var report bson.M
+    err = db.Collection("reports").FindOneAndUpdate(ctx, filter, bson.M{"$set": set}, opts).Decode(&report)
+    if err == mongo.ErrNoDocuments {
+        return nil, errors.New("Report not found or already closed")
+    } else if err != nil {
+        return nil, err
+    }
+
+    err = notify(ctx, db, report["reporter"].(primitive.ObjectID), NotificationReportClosed, "A moderator looked at your report", bson.M{"report": reportObjID})
+    if err != nil {
+        log.Println(err)
+    }
+    return report, nil
+}
+
+// ResolveReport closes a report as acted on, optionally banning the reported user
+// straight away with the given ban note, or the moderator's note if none is given. The
+// ban comes first, so that a report is never stored as banned for a ban that failed.
+func ResolveReport(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: UserReportType,
+        Description: "Resolve a user report, for admins",
+        Args: graphql.FieldConfigArgument {
+            "reportID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "adminID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "note": &graphql.ArgumentConfig {
+                Type: graphql.String,
+                DefaultValue: nil,
+            },
+            "ban": &graphql.ArgumentConfig {
+                Type: graphql.Boolean,
+                DefaultValue: false,
+            },
+            "banNote": &graphql.ArgumentConfig {
+                Type: graphql.String,
+                DefaultValue: nil,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            timeout, cancel := context.WithTimeout(ctx, time.Second * 3)
+            defer cancel()
+
+            ban, _ := p.Args["ban"].(bool)
+            if ban {
+                if err := requireAdmin(timeout, db, p.Args["adminID"]); err != nil {
+                    return nil, err
+                }
+                reportID, _ := p.Args["reportID"].(string)
+                reportObjID, err := primitive.ObjectIDFromHex(reportID)
+                if err != nil {
+                    return nil, err
+                }
+                var open bson.M
+                err = db.Collection("reports").FindOne(timeout, bson.M{"_id": reportObjID, "status": ReportStatusOpen}).Decode(&open)
+                if err == mongo.ErrNoDocuments {
+                    return nil, errors.New("Report not found or already closed")
+                } else if err != nil {
+                    return nil, err
+                }
+                banNote := p.Args["banNote"]
+                if banNote == nil {
+                    banNote = p.Args["note"]
+                }
+                _, err = banUser(timeout, *db.Collection("users"), open["scumbag"].(primitive.ObjectID), banNote)
+                if err != nil {
+                    return nil, err
+                }
+            }
+            return closeReport(timeout, db, p.Args, ReportStatusResolved, bson.M{"banned": ban})
+        },
+    }
+}
+
+// DismissReport closes a report as needing no action.
+func DismissReport(ctx context.Context, db mongo.Database) graphql.Field {
+    return graphql.Field {
+        Type: UserReportType,
+        Description: "Dismiss a user report, for admins",
+        Args: graphql.FieldConfigArgument {
+            "reportID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "adminID": &graphql.ArgumentConfig {
+                Type: graphql.ID,
+            },
+            "note": &graphql.ArgumentConfig {
+                Type: graphql.String,
+                DefaultValue: nil,
+            },
+        },
+        Resolve: func (p graphql.ResolveParams) (interface{}, error) {
+            timeout, cancel := context.WithTimeout(ctx, time.Second * 3)
+            defer cancel()
+            return closeReport(timeout, db, p.Args, ReportStatusDismissed, nil)
+        },
+    }
+}
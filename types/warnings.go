@@ -0,0 +1,98 @@
+package types
+
+import (
+    "context"
+    "sync"
+
+    "github.com/graphql-go/graphql"
+    "github.com/graphql-go/graphql/gqlerrors"
+)
+
+type warningsKey struct{}
+
+// warning is a problem with an operation that isn't worth failing it over.
+type warning struct {
+    Code string `json:"code"`
+    Message string `json:"message"`
+}
+
+// warningList collects the warnings raised while executing a single operation.
+type warningList struct {
+    mu sync.Mutex
+    warnings []warning
+}
+
+// addWarning records a warning for the operation that ctx belongs to. Resolvers should
+// pass the Context of their ResolveParams. Warnings raised outside of an operation run
+// with WarningsExtension are dropped.
+func addWarning(ctx context.Context, code string, message string) {
+    list, ok := ctx.Value(warningsKey{}).(*warningList)
+    if !ok {
+        return
+    }
+    list.mu.Lock()
+    defer list.mu.Unlock()
+    list.warnings = append(list.warnings, warning{code, message})
+}
+
+// WarningsExtension is a GraphQL extension that returns the warnings raised by resolvers
+// under "warnings" in the extensions of the result, leaving the data untouched.
+type WarningsExtension struct{}
+
+func (WarningsExtension) Init(ctx context.Context, p *graphql.Params) context.Context {
+    if ctx == nil {
+        ctx = context.Background()
+    }
+    return context.WithValue(ctx, warningsKey{}, &warningList{})
+}
+
+func (WarningsExtension) Name() string {
+    return "warnings"
+}
+
+func (WarningsExtension) ParseDidStart(ctx context.Context) (context.Context, graphql.ParseFinishFunc) {
+    return ctx, func(error) {}
+}
+
+func (WarningsExtension) ValidationDidStart(ctx context.Context) (context.Context, graphql.ValidationFinishFunc) {
+    return ctx, func([]gqlerrors.FormattedError) {}
+}
+
+// ExecutionDidStart adds the warnings to the result once execution finishes. This is done
+// here rather than through HasResult, which can't see the operation and so would add an
+// empty "warnings" to every result.
+func (ext WarningsExtension) ExecutionDidStart(ctx context.Context) (context.Context, graphql.ExecutionFinishFunc) {
+    return ctx, func(result *graphql.Result) {
+        warnings := ext.GetResult(ctx)
+        if warnings == nil {
+            return
+        }
+        if result.Extensions == nil {
+            result.Extensions = make(map[string]interface{})
+        }
+        result.Extensions[ext.Name()] = warnings
+    }
+}
+
+func (WarningsExtension) ResolveFieldDidStart(ctx context.Context, info *graphql.ResolveInfo) (context.Context, graphql.ResolveFieldFinishFunc) {
+    return ctx, func(interface{}, error) {}
+}
+
+func (WarningsExtension) HasResult() bool {
+    return false
+}
+
+// GetResult returns the warnings raised so far in the operation ctx belongs to, or nil if
+// there aren't any.
+func (WarningsExtension) GetResult(ctx context.Context) interface{} {
+    list, ok := ctx.Value(warningsKey{}).(*warningList)
+    if !ok {
+        return nil
+    }
+    list.mu.Lock()
+    defer list.mu.Unlock()
+    if len(list.warnings) == 0 {
+        return nil
+    }
+    return list.warnings
+}